@@ -200,6 +200,7 @@ func Register(r *macaron.Macaron) {
 			r.Delete("/:id", DeleteDataSource)
 			r.Get("/:id", wrap(GetDataSourceById))
 			r.Get("/name/:name", wrap(GetDataSourceByName))
+			r.Get("/:id/proxy-test", wrap(ProxyDataSourceTest))
 		}, reqOrgAdmin)
 
 		r.Get("/datasources/id/:name", wrap(GetDataSourceIdByName), reqSignedIn)
@@ -309,6 +310,8 @@ func Register(r *macaron.Macaron) {
 	r.Post("/api/streams/push", reqSignedIn, bind(dtos.StreamMessage{}), liveConn.PushToStream)
 
 	InitAppPluginRoutes(r)
+	registerDataProxyListeners()
+	m.OnDataSourceConn = updateProxyPoolConns
 
 	r.NotFound(NotFoundHandler)
 }
@@ -13,20 +13,33 @@ import (
 	"github.com/grafana/grafana/pkg/middleware"
 	m "github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/plugins"
+	"github.com/grafana/grafana/pkg/setting"
 	"github.com/grafana/grafana/pkg/util"
 )
 
-var pluginProxyTransport = &http.Transport{
-	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	Proxy:           http.ProxyFromEnvironment,
-	Dial: (&net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}).Dial,
-	TLSHandshakeTimeout: 10 * time.Second,
+var pluginProxyTransport *http.Transport
+
+// newPluginProxyTransport only verifies the certificates of app plugin routes
+// with data_proxy_tls_verify, they were never verified before
+func newPluginProxyTransport() *http.Transport {
+	if !setting.DataProxy().TLSVerify {
+		log.Warn("Plugins: TLS certificates of app plugin routes are not verified, set data_proxy_tls_verify to verify them")
+	}
+
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: !setting.DataProxy().TLSVerify},
+		Proxy:           http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
 }
 
 func InitAppPluginRoutes(r *macaron.Macaron) {
+	pluginProxyTransport = newPluginProxyTransport()
+
 	for _, plugin := range plugins.Apps {
 		for _, route := range plugin.Routes {
 			url := util.JoinUrlFragments("/api/plugin-proxy/"+plugin.Id, route.Path)
@@ -0,0 +1,134 @@
+package azuremonitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/api/tokenproxy"
+	"github.com/grafana/grafana/pkg/middleware"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+const (
+	defaultLoginUrl      = "https://login.microsoftonline.com"
+	defaultManagementUrl = "https://management.azure.com"
+
+	// tokens are refreshed this long before they expire
+	tokenExpiryDelta = 5 * time.Minute
+)
+
+type datasourceInfo struct {
+	DatasourceId  int64
+	Updated       time.Time
+	TenantId      string
+	ClientId      string
+	ClientSecret  string
+	LoginUrl      string
+	ManagementUrl string
+}
+
+func getDatasourceInfo(ds *m.DataSource) *datasourceInfo {
+	decrypted := ds.SecureJsonData.Decrypt()
+
+	info := &datasourceInfo{
+		DatasourceId:  ds.Id,
+		Updated:       ds.Updated,
+		TenantId:      decrypted["tenantId"],
+		ClientId:      decrypted["clientId"],
+		ClientSecret:  decrypted["clientSecret"],
+		LoginUrl:      defaultLoginUrl,
+		ManagementUrl: defaultManagementUrl,
+	}
+
+	// other azure clouds use different endpoints
+	if ds.JsonData != nil {
+		info.LoginUrl = ds.JsonData.Get("loginUrl").MustString(defaultLoginUrl)
+		info.ManagementUrl = ds.JsonData.Get("managementUrl").MustString(defaultManagementUrl)
+	}
+
+	return info
+}
+
+// GetEndpoints returns the management and login urls the token of the
+// datasource is sent to
+func GetEndpoints(ds *m.DataSource) []string {
+	info := getDatasourceInfo(ds)
+	return []string{info.ManagementUrl, info.LoginUrl}
+}
+
+type accessToken struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresIn   json.Number `json:"expires_in"`
+	expires     time.Time
+}
+
+// tokens are cached per datasource, the tenant and client id are not secret
+// so they can not tell datasources of different orgs apart
+type tokenCacheKey struct {
+	datasourceId int64
+	updated      time.Time
+}
+
+var tokenCache map[tokenCacheKey]*accessToken = make(map[tokenCacheKey]*accessToken)
+var tokenCacheLock sync.Mutex
+
+// getAccessToken gets an Azure AD token for the management api with the
+// client credentials grant, tokens are cached until the datasource changes
+func getAccessToken(info *datasourceInfo, client *http.Client) (string, error) {
+	cacheKey := tokenCacheKey{datasourceId: info.DatasourceId, updated: info.Updated}
+
+	tokenCacheLock.Lock()
+	defer tokenCacheLock.Unlock()
+
+	if token, ok := tokenCache[cacheKey]; ok && time.Now().Before(token.expires) {
+		return token.AccessToken, nil
+	}
+
+	if info.TenantId == "" || info.ClientId == "" {
+		return "", errors.New("Azure tenant id and client id are required")
+	}
+
+	params := url.Values{}
+	params.Set("grant_type", "client_credentials")
+	params.Set("client_id", info.ClientId)
+	params.Set("client_secret", info.ClientSecret)
+	params.Set("resource", strings.TrimSuffix(info.ManagementUrl, "/")+"/")
+
+	tokenUrl := util.JoinUrlFragments(info.LoginUrl, info.TenantId+"/oauth2/token")
+	resp, err := client.PostForm(tokenUrl, params)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Azure AD token request failed with status %d", resp.StatusCode)
+	}
+
+	token := &accessToken{}
+	if err := json.NewDecoder(resp.Body).Decode(token); err != nil {
+		return "", err
+	}
+
+	expiresIn, _ := token.ExpiresIn.Int64()
+	token.expires = time.Now().Add(time.Duration(expiresIn)*time.Second - tokenExpiryDelta)
+	tokenCache[cacheKey] = token
+
+	return token.AccessToken, nil
+}
+
+// HandleRequest proxies the request to the management api with the access token
+// of the datasource
+func HandleRequest(c *middleware.Context, ds *m.DataSource, wrapTransport func(http.RoundTripper) http.RoundTripper) {
+	info := getDatasourceInfo(ds)
+	tokenproxy.HandleRequest(c, ds, info.ManagementUrl, func(client *http.Client) (string, error) {
+		return getAccessToken(info, client)
+	}, wrapTransport)
+}
@@ -0,0 +1,62 @@
+package azuremonitor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAzureMonitor(t *testing.T) {
+	Convey("When getting an Azure AD token", t, func() {
+		tokenRequests := 0
+		var form map[string][]string
+		var path string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenRequests++
+			path = r.URL.Path
+			r.ParseForm()
+			form = r.PostForm
+			fmt.Fprint(w, `{"access_token":"token","expires_in":"3599"}`)
+		}))
+		defer server.Close()
+
+		info := &datasourceInfo{
+			DatasourceId:  1,
+			TenantId:      "tenant",
+			ClientId:      "client",
+			ClientSecret:  "secret",
+			LoginUrl:      server.URL,
+			ManagementUrl: "https://management.azure.com",
+		}
+
+		Convey("Should use the client credentials grant and cache the token", func() {
+			token, err := getAccessToken(info, http.DefaultClient)
+			So(err, ShouldBeNil)
+			So(token, ShouldEqual, "token")
+			So(path, ShouldEqual, "/tenant/oauth2/token")
+			So(form["client_secret"], ShouldResemble, []string{"secret"})
+			So(form["resource"], ShouldResemble, []string{"https://management.azure.com/"})
+
+			getAccessToken(info, http.DefaultClient)
+			So(tokenRequests, ShouldEqual, 1)
+		})
+
+		Convey("Should not share tokens between datasources with the same tenant and client", func() {
+			getAccessToken(info, http.DefaultClient)
+
+			otherOrg := *info
+			otherOrg.DatasourceId = 2
+			otherOrg.ClientSecret = "wrong"
+			getAccessToken(&otherOrg, http.DefaultClient)
+			So(tokenRequests, ShouldEqual, 2)
+			So(form["client_secret"], ShouldResemble, []string{"wrong"})
+		})
+
+		Reset(func() {
+			tokenCache = make(map[tokenCacheKey]*accessToken)
+		})
+	})
+}
@@ -1,9 +1,11 @@
 package cloudwatch
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -31,16 +33,38 @@ type cwRequest struct {
 	Action     string `json:"action"`
 	Body       []byte `json:"-"`
 	DataSource *m.DataSource
+	// the context of the proxied request, with the data proxy timeout
+	ctx context.Context
 }
 
 type datasourceInfo struct {
 	Profile       string
 	Region        string
 	AssumeRoleArn string
-	Namespace     string
+	// the external id the role requires from third parties assuming it
+	ExternalId string
+	Namespace  string
 
 	AccessKey string
 	SecretKey string
+	// the url of the CloudWatch API, empty for the endpoint of the region
+	Endpoint string
+
+	HTTPClient *http.Client
+}
+
+// GetEndpoint returns the endpoint json data option, the url of the CloudWatch
+// API for VPC endpoints and other clouds. Without a scheme https is used, like
+// the AWS SDK does
+func GetEndpoint(ds *m.DataSource) string {
+	if ds.JsonData == nil {
+		return ""
+	}
+	endpoint := strings.TrimSpace(ds.JsonData.Get("endpoint").MustString())
+	if endpoint != "" && !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	return endpoint
 }
 
 func (req *cwRequest) GetDatasourceInfo() *datasourceInfo {
@@ -59,13 +83,44 @@ func (req *cwRequest) GetDatasourceInfo() *datasourceInfo {
 
 	return &datasourceInfo{
 		AssumeRoleArn: assumeRoleArn,
+		ExternalId:    req.DataSource.JsonData.Get("externalId").MustString(),
 		Region:        req.Region,
 		Profile:       req.DataSource.Database,
 		AccessKey:     accessKey,
 		SecretKey:     secretKey,
+		Endpoint:      GetEndpoint(req.DataSource),
+		HTTPClient:    newHttpClient(req.ctx),
 	}
 }
 
+// contextTransport sends the requests of the aws clients with the context of
+// the proxied request, so they stop when it times out or the client goes away
+type contextTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport.RoundTrip(req.WithContext(t.ctx))
+}
+
+func newHttpClient(ctx context.Context) *http.Client {
+	if ctx == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: &contextTransport{ctx: ctx, transport: http.DefaultTransport}}
+}
+
+// handleAwsError answers 504 when the request took longer than the data proxy
+// timeout
+func handleAwsError(req *cwRequest, c *middleware.Context, err error) {
+	if req.ctx != nil && req.ctx.Err() == context.DeadlineExceeded {
+		c.JsonApiErr(504, "Gateway Timeout", err)
+		return
+	}
+	c.JsonApiErr(500, "Unable to call AWS API", err)
+}
+
 func init() {
 	actionHandlers = map[string]actionHandler{
 		"GetMetricStatistics":     handleGetMetricStatistics,
@@ -89,94 +144,129 @@ type cache struct {
 var awsCredentialCache map[string]cache = make(map[string]cache)
 var credentialCacheLock sync.RWMutex
 
-func getCredentials(dsInfo *datasourceInfo) *credentials.Credentials {
-	cacheKey := dsInfo.Profile + ":" + dsInfo.AssumeRoleArn
+// assumeRoleRefreshWindow is how long before they expire the temporary
+// credentials of an assumed role are requested again, so requests never sign
+// with credentials that expire on their way to AWS
+const assumeRoleRefreshWindow = time.Minute
+
+// getCredentialCacheKey includes everything the assumed role credentials
+// depend on, the base identity and the role
+func getCredentialCacheKey(dsInfo *datasourceInfo) string {
+	return strings.Join([]string{dsInfo.Profile, dsInfo.AccessKey, dsInfo.AssumeRoleArn, dsInfo.ExternalId}, ":")
+}
+
+// isCredentialFresh reports whether cached credentials can still be used at now
+func isCredentialFresh(c cache, now time.Time) bool {
+	return c.expiration != nil && c.expiration.After(now.Add(assumeRoleRefreshWindow))
+}
+
+// getBaseCredentialProviders returns the providers of the identity of the
+// datasource: the environment, the access keys of the datasource, the shared
+// credentials profile or the EC2 role
+func getBaseCredentialProviders(dsInfo *datasourceInfo, sess *session.Session) []credentials.Provider {
+	return []credentials.Provider{
+		&credentials.EnvProvider{},
+		&credentials.StaticProvider{Value: credentials.Value{
+			AccessKeyID:     dsInfo.AccessKey,
+			SecretAccessKey: dsInfo.SecretKey,
+		}},
+		&credentials.SharedCredentialsProvider{Filename: "", Profile: dsInfo.Profile},
+		&ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(sess), ExpiryWindow: 5 * time.Minute},
+	}
+}
+
+// getCredentials returns the credentials of the datasource. With an assume
+// role arn the base identity requests temporary credentials of the role from
+// STS, they are cached until shortly before they expire
+func getCredentials(dsInfo *datasourceInfo) (*credentials.Credentials, error) {
+	cacheKey := getCredentialCacheKey(dsInfo)
 	credentialCacheLock.RLock()
-	if _, ok := awsCredentialCache[cacheKey]; ok {
-		if awsCredentialCache[cacheKey].expiration != nil &&
-			(*awsCredentialCache[cacheKey].expiration).After(time.Now().UTC()) {
-			result := awsCredentialCache[cacheKey].credential
-			credentialCacheLock.RUnlock()
-			return result
-		}
+	if cached, ok := awsCredentialCache[cacheKey]; ok && isCredentialFresh(cached, time.Now().UTC()) {
+		credentialCacheLock.RUnlock()
+		return cached.credential, nil
 	}
 	credentialCacheLock.RUnlock()
 
-	accessKeyId := ""
-	secretAccessKey := ""
-	sessionToken := ""
-	var expiration *time.Time
-	expiration = nil
-	if strings.Index(dsInfo.AssumeRoleArn, "arn:aws:iam:") == 0 {
-		params := &sts.AssumeRoleInput{
-			RoleArn:         aws.String(dsInfo.AssumeRoleArn),
-			RoleSessionName: aws.String("GrafanaSession"),
-			DurationSeconds: aws.Int64(900),
-		}
+	sess := session.New()
+	if strings.Index(dsInfo.AssumeRoleArn, "arn:aws:iam:") != 0 {
+		return credentials.NewChainCredentials(getBaseCredentialProviders(dsInfo, sess)), nil
+	}
 
-		stsSess := session.New()
-		stsCreds := credentials.NewChainCredentials(
-			[]credentials.Provider{
-				&credentials.EnvProvider{},
-				&credentials.SharedCredentialsProvider{Filename: "", Profile: dsInfo.Profile},
-				&ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(stsSess), ExpiryWindow: 5 * time.Minute},
-			})
-		stsConfig := &aws.Config{
-			Region:      aws.String(dsInfo.Region),
-			Credentials: stsCreds,
-		}
+	params := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(dsInfo.AssumeRoleArn),
+		RoleSessionName: aws.String("GrafanaSession"),
+		DurationSeconds: aws.Int64(900),
+	}
+	if dsInfo.ExternalId != "" {
+		params.ExternalId = aws.String(dsInfo.ExternalId)
+	}
 
-		svc := sts.New(session.New(stsConfig), stsConfig)
-		resp, err := svc.AssumeRole(params)
-		if err != nil {
-			// ignore
-			log.Error(3, "CloudWatch: Failed to assume role", err)
-		}
-		if resp.Credentials != nil {
-			accessKeyId = *resp.Credentials.AccessKeyId
-			secretAccessKey = *resp.Credentials.SecretAccessKey
-			sessionToken = *resp.Credentials.SessionToken
-			expiration = resp.Credentials.Expiration
-		}
+	stsConfig := &aws.Config{
+		Region:      aws.String(dsInfo.Region),
+		Credentials: credentials.NewChainCredentials(getBaseCredentialProviders(dsInfo, sess)),
+		HTTPClient:  dsInfo.HTTPClient,
 	}
 
-	sess := session.New()
-	creds := credentials.NewChainCredentials(
-		[]credentials.Provider{
-			&credentials.StaticProvider{Value: credentials.Value{
-				AccessKeyID:     accessKeyId,
-				SecretAccessKey: secretAccessKey,
-				SessionToken:    sessionToken,
-			}},
-			&credentials.EnvProvider{},
-			&credentials.StaticProvider{Value: credentials.Value{
-				AccessKeyID:     dsInfo.AccessKey,
-				SecretAccessKey: dsInfo.SecretKey,
-			}},
-			&credentials.SharedCredentialsProvider{Filename: "", Profile: dsInfo.Profile},
-			&ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(sess), ExpiryWindow: 5 * time.Minute},
-		})
+	svc := sts.New(session.New(stsConfig), stsConfig)
+	resp, err := svc.AssumeRole(params)
+	if err != nil {
+		log.Error(3, "CloudWatch: Failed to assume role", err)
+		return nil, err
+	}
+	if resp.Credentials == nil {
+		return nil, errors.New("STS returned no credentials for role " + dsInfo.AssumeRoleArn)
+	}
+
+	creds := credentials.NewStaticCredentials(
+		*resp.Credentials.AccessKeyId,
+		*resp.Credentials.SecretAccessKey,
+		*resp.Credentials.SessionToken,
+	)
 
 	credentialCacheLock.Lock()
 	awsCredentialCache[cacheKey] = cache{
 		credential: creds,
-		expiration: expiration,
+		expiration: resp.Credentials.Expiration,
 	}
 	credentialCacheLock.Unlock()
 
-	return creds
+	return creds, nil
 }
 
-func getAwsConfig(req *cwRequest) *aws.Config {
+func getAwsConfig(req *cwRequest) (*aws.Config, error) {
+	dsInfo := req.GetDatasourceInfo()
+	creds, err := getCredentials(dsInfo)
+	if err != nil {
+		return nil, err
+	}
+
 	cfg := &aws.Config{
 		Region:      aws.String(req.Region),
-		Credentials: getCredentials(req.GetDatasourceInfo()),
+		Credentials: creds,
+		HTTPClient:  dsInfo.HTTPClient,
+	}
+	return cfg, nil
+}
+
+// getCloudWatchConfig is getAwsConfig for the CloudWatch API, the EC2 API
+// always uses the endpoint of the region
+func getCloudWatchConfig(req *cwRequest) (*aws.Config, error) {
+	cfg, err := getAwsConfig(req)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint := GetEndpoint(req.DataSource); endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
 	}
-	return cfg
+	return cfg, nil
 }
 
 func handleGetMetricStatistics(req *cwRequest, c *middleware.Context) {
-	cfg := getAwsConfig(req)
+	cfg, err := getCloudWatchConfig(req)
+	if err != nil {
+		handleAwsError(req, c, err)
+		return
+	}
 	svc := cloudwatch.New(session.New(cfg), cfg)
 
 	reqParam := &struct {
@@ -212,7 +302,7 @@ func handleGetMetricStatistics(req *cwRequest, c *middleware.Context) {
 
 	resp, err := svc.GetMetricStatistics(params)
 	if err != nil {
-		c.JsonApiErr(500, "Unable to call AWS API", err)
+		handleAwsError(req, c, err)
 		return
 	}
 
@@ -220,7 +310,11 @@ func handleGetMetricStatistics(req *cwRequest, c *middleware.Context) {
 }
 
 func handleListMetrics(req *cwRequest, c *middleware.Context) {
-	cfg := getAwsConfig(req)
+	cfg, err := getCloudWatchConfig(req)
+	if err != nil {
+		handleAwsError(req, c, err)
+		return
+	}
 	svc := cloudwatch.New(session.New(cfg), cfg)
 
 	reqParam := &struct {
@@ -239,7 +333,7 @@ func handleListMetrics(req *cwRequest, c *middleware.Context) {
 	}
 
 	var resp cloudwatch.ListMetricsOutput
-	err := svc.ListMetricsPages(params,
+	err = svc.ListMetricsPages(params,
 		func(page *cloudwatch.ListMetricsOutput, lastPage bool) bool {
 			metrics, _ := awsutil.ValuesAtPath(page, "Metrics")
 			for _, metric := range metrics {
@@ -248,7 +342,7 @@ func handleListMetrics(req *cwRequest, c *middleware.Context) {
 			return !lastPage
 		})
 	if err != nil {
-		c.JsonApiErr(500, "Unable to call AWS API", err)
+		handleAwsError(req, c, err)
 		return
 	}
 
@@ -256,7 +350,11 @@ func handleListMetrics(req *cwRequest, c *middleware.Context) {
 }
 
 func handleDescribeAlarms(req *cwRequest, c *middleware.Context) {
-	cfg := getAwsConfig(req)
+	cfg, err := getCloudWatchConfig(req)
+	if err != nil {
+		handleAwsError(req, c, err)
+		return
+	}
 	svc := cloudwatch.New(session.New(cfg), cfg)
 
 	reqParam := &struct {
@@ -287,7 +385,7 @@ func handleDescribeAlarms(req *cwRequest, c *middleware.Context) {
 
 	resp, err := svc.DescribeAlarms(params)
 	if err != nil {
-		c.JsonApiErr(500, "Unable to call AWS API", err)
+		handleAwsError(req, c, err)
 		return
 	}
 
@@ -295,7 +393,11 @@ func handleDescribeAlarms(req *cwRequest, c *middleware.Context) {
 }
 
 func handleDescribeAlarmsForMetric(req *cwRequest, c *middleware.Context) {
-	cfg := getAwsConfig(req)
+	cfg, err := getCloudWatchConfig(req)
+	if err != nil {
+		handleAwsError(req, c, err)
+		return
+	}
 	svc := cloudwatch.New(session.New(cfg), cfg)
 
 	reqParam := &struct {
@@ -327,7 +429,7 @@ func handleDescribeAlarmsForMetric(req *cwRequest, c *middleware.Context) {
 
 	resp, err := svc.DescribeAlarmsForMetric(params)
 	if err != nil {
-		c.JsonApiErr(500, "Unable to call AWS API", err)
+		handleAwsError(req, c, err)
 		return
 	}
 
@@ -335,7 +437,11 @@ func handleDescribeAlarmsForMetric(req *cwRequest, c *middleware.Context) {
 }
 
 func handleDescribeAlarmHistory(req *cwRequest, c *middleware.Context) {
-	cfg := getAwsConfig(req)
+	cfg, err := getCloudWatchConfig(req)
+	if err != nil {
+		handleAwsError(req, c, err)
+		return
+	}
 	svc := cloudwatch.New(session.New(cfg), cfg)
 
 	reqParam := &struct {
@@ -359,7 +465,7 @@ func handleDescribeAlarmHistory(req *cwRequest, c *middleware.Context) {
 
 	resp, err := svc.DescribeAlarmHistory(params)
 	if err != nil {
-		c.JsonApiErr(500, "Unable to call AWS API", err)
+		handleAwsError(req, c, err)
 		return
 	}
 
@@ -367,7 +473,11 @@ func handleDescribeAlarmHistory(req *cwRequest, c *middleware.Context) {
 }
 
 func handleDescribeInstances(req *cwRequest, c *middleware.Context) {
-	cfg := getAwsConfig(req)
+	cfg, err := getAwsConfig(req)
+	if err != nil {
+		handleAwsError(req, c, err)
+		return
+	}
 	svc := ec2.New(session.New(cfg), cfg)
 
 	reqParam := &struct {
@@ -387,7 +497,7 @@ func handleDescribeInstances(req *cwRequest, c *middleware.Context) {
 	}
 
 	var resp ec2.DescribeInstancesOutput
-	err := svc.DescribeInstancesPages(params,
+	err = svc.DescribeInstancesPages(params,
 		func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
 			reservations, _ := awsutil.ValuesAtPath(page, "Reservations")
 			for _, reservation := range reservations {
@@ -396,7 +506,7 @@ func handleDescribeInstances(req *cwRequest, c *middleware.Context) {
 			return !lastPage
 		})
 	if err != nil {
-		c.JsonApiErr(500, "Unable to call AWS API", err)
+		handleAwsError(req, c, err)
 		return
 	}
 
@@ -407,6 +517,7 @@ func HandleRequest(c *middleware.Context, ds *m.DataSource) {
 	var req cwRequest
 	req.Body, _ = ioutil.ReadAll(c.Req.Request.Body)
 	req.DataSource = ds
+	req.ctx = c.Req.Request.Context()
 	json.Unmarshal(req.Body, &req)
 
 	if handler, found := actionHandlers[req.Action]; !found {
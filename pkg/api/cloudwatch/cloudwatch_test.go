@@ -0,0 +1,122 @@
+package cloudwatch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func TestCloudWatchEndpoint(t *testing.T) {
+	Convey("When a datasource sets an endpoint", t, func() {
+		ds := &m.DataSource{JsonData: simplejson.NewFromAny(map[string]interface{}{"endpoint": "monitoring.us-gov-west-1.amazonaws.com"})}
+		req := &cwRequest{Region: "us-gov-west-1", DataSource: ds}
+
+		Convey("Should use https without a scheme", func() {
+			So(GetEndpoint(ds), ShouldEqual, "https://monitoring.us-gov-west-1.amazonaws.com")
+		})
+
+		Convey("Should only use it for the CloudWatch API", func() {
+			cwConfig, err := getCloudWatchConfig(req)
+			So(err, ShouldBeNil)
+			So(*cwConfig.Endpoint, ShouldEqual, "https://monitoring.us-gov-west-1.amazonaws.com")
+
+			ec2Config, err := getAwsConfig(req)
+			So(err, ShouldBeNil)
+			So(ec2Config.Endpoint, ShouldBeNil)
+		})
+	})
+
+	Convey("When a datasource sets no endpoint", t, func() {
+		req := &cwRequest{Region: "us-east-1", DataSource: &m.DataSource{JsonData: simplejson.New()}}
+		cfg, err := getCloudWatchConfig(req)
+		So(err, ShouldBeNil)
+		So(cfg.Endpoint, ShouldBeNil)
+	})
+}
+
+func TestCloudWatchAssumeRole(t *testing.T) {
+	Convey("When caching the credentials of an assumed role", t, func() {
+		dsInfo := &datasourceInfo{Profile: "default", AccessKey: "AKID", AssumeRoleArn: "arn:aws:iam::123456789012:role/grafana"}
+
+		Convey("Should cache them by base identity and external id", func() {
+			key := getCredentialCacheKey(dsInfo)
+			So(getCredentialCacheKey(&datasourceInfo{Profile: "default", AccessKey: "AKID2", AssumeRoleArn: dsInfo.AssumeRoleArn}), ShouldNotEqual, key)
+			So(getCredentialCacheKey(&datasourceInfo{Profile: "default", AccessKey: "AKID", AssumeRoleArn: dsInfo.AssumeRoleArn, ExternalId: "tenant-1"}), ShouldNotEqual, key)
+		})
+
+		Convey("Should use cached credentials until shortly before they expire", func() {
+			now := time.Now()
+			soon, later := now.Add(30*time.Second), now.Add(10*time.Minute)
+			So(isCredentialFresh(cache{expiration: &later}, now), ShouldBeTrue)
+			So(isCredentialFresh(cache{expiration: &soon}, now), ShouldBeFalse)
+			So(isCredentialFresh(cache{}, now), ShouldBeFalse)
+		})
+
+		Convey("Should return the cached credentials without calling STS", func() {
+			later := time.Now().UTC().Add(10 * time.Minute)
+			creds := credentials.NewStaticCredentials("ASIA", "secret", "token")
+			key := getCredentialCacheKey(dsInfo)
+			credentialCacheLock.Lock()
+			awsCredentialCache[key] = cache{credential: creds, expiration: &later}
+			credentialCacheLock.Unlock()
+			defer func() {
+				credentialCacheLock.Lock()
+				delete(awsCredentialCache, key)
+				credentialCacheLock.Unlock()
+			}()
+
+			result, err := getCredentials(dsInfo)
+			So(err, ShouldBeNil)
+			So(result, ShouldEqual, creds)
+		})
+	})
+
+	Convey("When a datasource assumes no role", t, func() {
+		dsInfo := &datasourceInfo{AccessKey: "AKID", SecretKey: "secret"}
+
+		Convey("Should use the access keys of the datasource", func() {
+			os.Unsetenv("AWS_ACCESS_KEY_ID")
+			os.Unsetenv("AWS_ACCESS_KEY")
+			creds, err := getCredentials(dsInfo)
+			So(err, ShouldBeNil)
+
+			value, err := creds.Get()
+			So(err, ShouldBeNil)
+			So(value.AccessKeyID, ShouldEqual, "AKID")
+		})
+	})
+}
+
+func TestCloudWatchHttpClient(t *testing.T) {
+	Convey("When the aws clients send requests", t, func() {
+		release := make(chan bool)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+		}))
+		defer backend.Close()
+		defer close(release)
+
+		Convey("Should stop them when the proxied request times out", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			_, err := newHttpClient(ctx).Get(backend.URL)
+
+			So(err, ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+		})
+	})
+}
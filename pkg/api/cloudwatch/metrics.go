@@ -196,7 +196,7 @@ func handleGetMetrics(req *cwRequest, c *middleware.Context) {
 		cwData.Namespace = reqParam.Parameters.Namespace
 
 		if namespaceMetrics, err = getMetricsForCustomMetrics(cwData, getAllMetrics); err != nil {
-			c.JsonApiErr(500, "Unable to call AWS API", err)
+			handleAwsError(req, c, err)
 			return
 		}
 	}
@@ -232,7 +232,7 @@ func handleGetDimensions(req *cwRequest, c *middleware.Context) {
 		dsInfo.Namespace = reqParam.Parameters.Namespace
 
 		if dimensionValues, err = getDimensionsForCustomMetrics(dsInfo, getAllMetrics); err != nil {
-			c.JsonApiErr(500, "Unable to call AWS API", err)
+			handleAwsError(req, c, err)
 			return
 		}
 	}
@@ -247,9 +247,19 @@ func handleGetDimensions(req *cwRequest, c *middleware.Context) {
 }
 
 func getAllMetrics(cwData *datasourceInfo) (cloudwatch.ListMetricsOutput, error) {
+	var resp cloudwatch.ListMetricsOutput
+	creds, err := getCredentials(cwData)
+	if err != nil {
+		return resp, err
+	}
+
 	cfg := &aws.Config{
 		Region:      aws.String(cwData.Region),
-		Credentials: getCredentials(cwData),
+		Credentials: creds,
+		HTTPClient:  cwData.HTTPClient,
+	}
+	if cwData.Endpoint != "" {
+		cfg.Endpoint = aws.String(cwData.Endpoint)
 	}
 
 	svc := cloudwatch.New(session.New(cfg), cfg)
@@ -258,8 +268,7 @@ func getAllMetrics(cwData *datasourceInfo) (cloudwatch.ListMetricsOutput, error)
 		Namespace: aws.String(cwData.Namespace),
 	}
 
-	var resp cloudwatch.ListMetricsOutput
-	err := svc.ListMetricsPages(params,
+	err = svc.ListMetricsPages(params,
 		func(page *cloudwatch.ListMetricsOutput, lastPage bool) bool {
 			metrics, _ := awsutil.ValuesAtPath(page, "Metrics")
 			for _, metric := range metrics {
@@ -1,14 +1,31 @@
 package api
 
 import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/grafana/grafana/pkg/api/azuremonitor"
 	"github.com/grafana/grafana/pkg/api/cloudwatch"
 	"github.com/grafana/grafana/pkg/api/keystone"
+	"github.com/grafana/grafana/pkg/api/stackdriver"
 	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/securejsondata"
+	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/log"
 	"github.com/grafana/grafana/pkg/metrics"
 	"github.com/grafana/grafana/pkg/middleware"
@@ -17,107 +34,1010 @@ import (
 	"github.com/grafana/grafana/pkg/util"
 )
 
+var dataproxyLogger log.Logger = log.New("data-proxy-log")
+
+// headers that are always passed on when a datasource restricts the
+// forwarded headers with forwardHeaders
+var standardProxyHeaders = map[string]bool{
+	"Accept":             true,
+	"Accept-Encoding":    true,
+	"Accept-Language":    true,
+	"Authorization":      true,
+	"Cache-Control":      true,
+	"Content-Encoding":   true,
+	"Content-Length":     true,
+	"Content-Type":       true,
+	"User-Agent":         true,
+	"X-Auth-Token":       true,
+	"X-DS-Authorization": true,
+	"X-Grafana-User":     true,
+	"X-Request-Id":       true,
+}
+
+// hop-by-hop headers, RFC 7230 section 6.1. They only apply to a single
+// connection and are never passed on
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers and the headers named in
+// the Connection header
+func removeHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+func filterForwardedHeaders(header http.Header, forwardHeaders map[string]bool) {
+	grpcWeb := isGrpcWebContentType(header.Get("Content-Type"))
+	for name := range header {
+		if !standardProxyHeaders[name] && !forwardHeaders[name] && !(grpcWeb && grpcWebHeaders[name]) {
+			header.Del(name)
+		}
+	}
+}
+
+// getCustomHeaders reads the static headers configured as httpHeaderName1..N in
+// json data, the matching httpHeaderValue1..N values are kept in secure json data
+func getCustomHeaders(jsonData *simplejson.Json, secureJsonData securejsondata.SecureJsonData) http.Header {
+	headers := make(http.Header)
+
+	var decrypted map[string]string
+	for i := 1; ; i++ {
+		name := jsonData.Get(fmt.Sprintf("httpHeaderName%d", i)).MustString()
+		if name == "" {
+			break
+		}
+
+		if decrypted == nil {
+			decrypted = secureJsonData.Decrypt()
+		}
+		headers.Add(name, decrypted[fmt.Sprintf("httpHeaderValue%d", i)])
+	}
+
+	return headers
+}
+
+// appendQueryParam adds a parameter without re-encoding, and thereby
+// re-ordering, the existing query string
+func appendQueryParam(rawQuery string, name string, value string) string {
+	param := url.QueryEscape(name) + "=" + url.QueryEscape(value)
+	if rawQuery == "" {
+		return param
+	}
+	return rawQuery + "&" + param
+}
+
+type proxyQueryParam struct {
+	name  string
+	value string
+}
+
+// getProxyQueryParams reads a json data map of query parameters, sorted by
+// name so the query string is the same for every request
+func getProxyQueryParams(jsonData *simplejson.Json, key string) []proxyQueryParam {
+	values := jsonData.Get(key).MustMap()
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	params := make([]proxyQueryParam, 0, len(names))
+	for _, name := range names {
+		params = append(params, proxyQueryParam{name: name, value: fmt.Sprint(values[name])})
+	}
+	return params
+}
+
+// query parameters that carry credentials and must never end up in the logs
+var redactedQueryParams = map[string]bool{
+	"p":             true,
+	"password":      true,
+	"api_key":       true,
+	"apikey":        true,
+	"key":           true,
+	"token":         true,
+	"access_token":  true,
+	"client_secret": true,
+	"secret":        true,
+}
+
+// redactUrl hides passwords and tokens in the url so it can be logged
+func redactUrl(u *url.URL) string {
+	redacted := *u
+
+	if redacted.User != nil {
+		if _, exists := redacted.User.Password(); exists {
+			redacted.User = url.UserPassword(redacted.User.Username(), "-redacted-")
+		}
+	}
+
+	queryVals := redacted.Query()
+	changed := false
+	for name := range queryVals {
+		if redactedQueryParams[strings.ToLower(name)] {
+			queryVals.Set(name, "-redacted-")
+			changed = true
+		}
+	}
+	if changed {
+		redacted.RawQuery = queryVals.Encode()
+	}
+
+	return redacted.String()
+}
+
+// keepProxyCookies removes all cookies but the ones in keep from the request,
+// the cookies of the grafana session are always removed
+func keepProxyCookies(req *http.Request, keep map[string]bool) {
+	if len(keep) == 0 {
+		req.Header.Del("Cookie")
+		return
+	}
+
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+
+	for _, cookie := range cookies {
+		if !keep[cookie.Name] || isGrafanaCookie(cookie.Name) {
+			continue
+		}
+		req.AddCookie(cookie)
+	}
+}
+
+func isGrafanaCookie(name string) bool {
+	return name == setting.SessionOptions.CookieName || name == setting.CookieUserName || name == setting.CookieRememberName
+}
+
+// applyRoutePath prefixes the proxy path with the routePath json data option,
+// paths that already start with the prefix are left as they are
+func applyRoutePath(routePath string, proxyPath string) string {
+	prefix := strings.Trim(routePath, "/")
+	if prefix == "" {
+		return proxyPath
+	}
+
+	path := strings.TrimPrefix(proxyPath, "/")
+	if path == prefix || strings.HasPrefix(path, prefix+"/") {
+		return proxyPath
+	}
+
+	if path == "" {
+		return prefix
+	}
+
+	return prefix + "/" + path
+}
+
 func NewReverseProxy(ds *m.DataSource, proxyPath string, targetUrl *url.URL) *httputil.ReverseProxy {
+	jsonData := ds.JsonData
+	if jsonData == nil {
+		jsonData = simplejson.New()
+	}
+
+	var forwardHeaders map[string]bool
+	if headers, exists := jsonData.CheckGet("forwardHeaders"); exists {
+		forwardHeaders = make(map[string]bool)
+		for _, name := range headers.MustStringArray() {
+			forwardHeaders[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+
+	proxyPath = applyRoutePath(jsonData.Get("routePath").MustString(), proxyPath)
+	customHeaders := getCustomHeaders(jsonData, ds.SecureJsonData)
+	preserveQueryOrder := jsonData.Get("preserveQueryOrder").MustBool(false)
+	// virtual host for backends behind a load balancer that routes by Host
+	customHost := jsonData.Get("customHost").MustString()
+
+	// OpenTSDB accepts gzip request bodies since 2.2, tsdbVersion 2
+	compressRequest := ds.Type == m.DS_OPENTSDB && jsonData.Get("compressRequest").MustBool(false) &&
+		jsonData.Get("tsdbVersion").MustInt(1) >= 2
+
+	// Prometheus stops evaluating queries after their timeout parameter
+	queryTimeout := ""
+	if ds.Type == m.DS_PROMETHEUS {
+		queryTimeout = strings.TrimSpace(jsonData.Get("queryTimeout").MustString())
+	}
+
+	compressBackendResponses := usesBackendCompression(ds)
+
+	// the user agent of the browser is only passed on with passThroughUserAgent
+	userAgent := jsonData.Get("userAgent").MustString()
+	if userAgent == "" {
+		userAgent = "Grafana/" + setting.BuildVersion
+	}
+	passThroughUserAgent := jsonData.Get("passThroughUserAgent").MustBool(false)
+
+	defaultQueryParams := getProxyQueryParams(jsonData, "defaultQueryParams")
+	forcedQueryParams := getProxyQueryParams(jsonData, "forcedQueryParams")
+
+	keepCookies := make(map[string]bool)
+	for _, name := range jsonData.Get("keepCookies").MustStringArray() {
+		keepCookies[name] = true
+	}
+
+	// the forwarding headers are kept when the headers of the client are
+	// filtered
+	forwardClientIp := usesProxyForwardedFor(ds)
+	if forwardClientIp && forwardHeaders != nil {
+		for _, name := range proxyForwardedHeaders {
+			forwardHeaders[name] = true
+		}
+	}
+
 	director := func(req *http.Request) {
+		// done first so the client can not remove the headers set below by
+		// naming them in its Connection header, ProxyDataSourceRequest strips
+		// them before it sets headers as well
+		removeHopHeaders(req.Header)
+
+		setProxyForwardedHeaders(req, forwardClientIp)
+		if forwardHeaders != nil {
+			filterForwardedHeaders(req.Header, forwardHeaders)
+		}
+
+		addProxyVia(req.Header)
+
+		if !passThroughUserAgent || req.Header.Get("User-Agent") == "" {
+			req.Header.Set("User-Agent", userAgent)
+		}
+
+		for name, values := range customHeaders {
+			req.Header.Del(name)
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+
 		req.URL.Scheme = targetUrl.Scheme
 		req.URL.Host = targetUrl.Host
 		req.Host = targetUrl.Host
+		if customHost != "" {
+			req.Host = customHost
+		}
 
 		reqQueryVals := req.URL.Query()
 
+		// credentials are set by the auth schemes of newDataProxyTransport
 		if ds.Type == m.DS_INFLUXDB_08 {
 			req.URL.Path = util.JoinUrlFragments(targetUrl.Path, "db/"+ds.Database+"/"+proxyPath)
-			reqQueryVals.Add("u", ds.User)
-			reqQueryVals.Add("p", ds.Password)
-			req.URL.RawQuery = reqQueryVals.Encode()
 		} else if ds.Type == m.DS_INFLUXDB {
 			req.URL.Path = util.JoinUrlFragments(targetUrl.Path, proxyPath)
-			req.URL.RawQuery = reqQueryVals.Encode()
-			if !ds.BasicAuth {
-				req.Header.Del("Authorization")
-				req.Header.Add("Authorization", util.GetBasicAuthHeader(ds.User, ds.Password))
+			if !preserveQueryOrder {
+				req.URL.RawQuery = reqQueryVals.Encode()
+			}
+		} else if ds.Type == m.DS_PROMETHEUS {
+			req.URL.Path = util.JoinUrlFragments(targetUrl.Path, proxyPath)
+			if queryTimeout != "" && isPrometheusQueryPath(proxyPath) && reqQueryVals.Get("timeout") == "" {
+				req.URL.RawQuery = appendQueryParam(req.URL.RawQuery, "timeout", queryTimeout)
+			}
+		} else if ds.Type == m.DS_OPENTSDB {
+			req.URL.Path = util.JoinUrlFragments(targetUrl.Path, proxyPath)
+			if req.Method == "POST" && req.Body != nil {
+				// the query endpoint rejects bodies that are not sent as json
+				req.Header.Set("Content-Type", "application/json")
+				if compressRequest {
+					gzipProxyRequestBody(req)
+				}
 			}
 		} else {
 			req.URL.Path = util.JoinUrlFragments(targetUrl.Path, proxyPath)
 		}
 
-		if ds.BasicAuth {
-			req.Header.Del("Authorization")
-			req.Header.Add("Authorization", util.GetBasicAuthHeader(ds.BasicAuthUser, ds.BasicAuthPassword))
+		// forced parameters replace the ones of the client, which replace the
+		// defaults
+		if len(defaultQueryParams) > 0 {
+			clientQueryVals := req.URL.Query()
+			for _, param := range defaultQueryParams {
+				if _, exists := clientQueryVals[param.name]; !exists {
+					req.URL.RawQuery = appendQueryParam(req.URL.RawQuery, param.name, param.value)
+				}
+			}
+		}
+		for _, param := range forcedQueryParams {
+			req.URL.RawQuery = setQueryParam(req.URL.RawQuery, param.name, param.value)
 		}
 
-		dsAuth := req.Header.Get("X-DS-Authorization")
-		if len(dsAuth) > 0 {
-			req.Header.Del("X-DS-Authorization")
-			req.Header.Del("Authorization")
-			req.Header.Add("Authorization", dsAuth)
+		// compressed responses are only passed on to clients that accept them, and
+		// not when the gzip middleware would compress them a second time. With
+		// compressBackendResponses proxyGzipTransport decompresses them instead
+		if !compressBackendResponses {
+			req.Header.Set("Accept-Encoding", getProxyAcceptEncoding(req.Header))
 		}
 
-		// clear cookie headers
-		req.Header.Del("Cookie")
+		// clear cookie headers, except for the cookies named in keepCookies
+		keepProxyCookies(req, keepCookies)
 		req.Header.Del("Set-Cookie")
 
-		log.Info("Proxying call to %s", req.URL.String())
+		// only log the redacted url, headers carry credentials and are never logged
+		dataproxyLogger.Info("Proxying call", "url", redactUrl(req.URL), "requestId", req.Header.Get("X-Request-ID"))
+	}
+
+	flushInterval := getProxyFlushInterval(jsonData)
+	if flushInterval < 0 {
+		// flushing after every write is done by flushingResponseWriter
+		flushInterval = 0
+	}
+
+	return &httputil.ReverseProxy{Director: director, FlushInterval: flushInterval}
+}
+
+// isPrometheusQueryPath reports whether the path is one of the query endpoints
+// that take a timeout parameter
+func isPrometheusQueryPath(proxyPath string) bool {
+	proxyPath = strings.Trim(proxyPath, "/")
+	return proxyPath == "api/v1/query" || proxyPath == "api/v1/query_range"
+}
+
+// gzipProxyRequestBody compresses the request body while it is sent, the
+// transport closes the body when the request fails so the copy never blocks
+func gzipProxyRequestBody(req *http.Request) {
+	body := req.Body
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, body)
+		if err == nil {
+			err = zw.Close()
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+
+	req.Body = pr
+	req.ContentLength = -1
+	req.Header.Del("Content-Length")
+	req.Header.Set("Content-Encoding", "gzip")
+}
+
+// getProxyFlushInterval returns how often the response is flushed to the client,
+// the flushInterval json data option in milliseconds overrides the server setting.
+// Negative values flush after every write, 0 only flushes when the response is done
+func getProxyFlushInterval(jsonData *simplejson.Json) time.Duration {
+	interval := setting.DataProxy().FlushInterval
+	if jsonData != nil {
+		if value, exists := jsonData.CheckGet("flushInterval"); exists {
+			interval = value.MustInt(interval)
+		}
+	}
+
+	return time.Duration(interval) * time.Millisecond
+}
+
+// isEventStreamRequest reports requests of Server-Sent Events clients, each
+// event is flushed to the client as it arrives instead of every flushInterval
+func isEventStreamRequest(req *http.Request) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accept, ";", 2)[0])
+		if strings.ToLower(mediaType) == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+// flushingResponseWriter flushes after every write for streaming endpoints
+type flushingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *flushingResponseWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.Flush()
+	return n, err
+}
+
+func (w *flushingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// CloseNotify is passed on so the reverse proxy can still cancel the backend request
+func (w *flushingResponseWriter) CloseNotify() <-chan bool {
+	if notifier, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// proxyClientWatch cancels the context of a proxied request when the client
+// closes its connection, so the backend stops working on a query nobody waits
+// for. Servers before go 1.8 do not cancel request contexts themselves
+type proxyClientWatch struct {
+	cancel context.CancelFunc
+	closed int32
+}
+
+func watchProxyClient(w http.ResponseWriter, req *http.Request) (*http.Request, *proxyClientWatch) {
+	ctx, cancel := context.WithCancel(req.Context())
+	watch := &proxyClientWatch{cancel: cancel}
+
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closeNotify := notifier.CloseNotify()
+		go func() {
+			select {
+			case <-closeNotify:
+				atomic.StoreInt32(&watch.closed, 1)
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	return req.WithContext(ctx), watch
+}
+
+// clientClosed reports whether the client went away before the response was
+// written
+func (w *proxyClientWatch) clientClosed() bool {
+	return atomic.LoadInt32(&w.closed) == 1
+}
+
+func (w *proxyClientWatch) stop() {
+	w.cancel()
+}
+
+var proxyTypeTimers = struct {
+	sync.Mutex
+	timers map[string]metrics.Timer
+}{timers: make(map[string]metrics.Timer)}
+
+// getProxyTypeTimer returns the latency timer for a datasource type and
+// response status class, timers are registered on first use
+func getProxyTypeTimer(dsType string, status int) metrics.Timer {
+	statusClass := fmt.Sprintf("%dxx", status/100)
+	key := dsType + "." + statusClass
+
+	proxyTypeTimers.Lock()
+	defer proxyTypeTimers.Unlock()
+
+	timer, exists := proxyTypeTimers.timers[key]
+	if !exists {
+		timer = metrics.RegTimer("api.dataproxy.request.type", "type", dsType, "status", statusClass)
+		proxyTypeTimers.timers[key] = timer
+	}
+
+	return timer
+}
+
+// causes of failed proxied requests counted by countProxyError
+const (
+	proxyErrorWhitelistDenied = "whitelist_denied"
+	proxyErrorOrgDisabled     = "org_disabled"
+	proxyErrorNotFound        = "datasource_not_found"
+	proxyErrorLoadFailed      = "datasource_load_failed"
+	proxyErrorKeystoneFailed  = "keystone_failed"
+	proxyErrorBackend5xx      = "backend_5xx"
+	proxyErrorBackendTimeout  = "timeout"
+	proxyErrorClientCanceled  = "client_canceled"
+	proxyErrorBreakerOpen     = "breaker_open"
+	proxyErrorRetryAfter      = "retry_after"
+	proxyErrorServerBusy      = "server_busy"
+)
+
+var proxyErrorCounters = struct {
+	sync.Mutex
+	counters map[string]metrics.Counter
+}{counters: make(map[string]metrics.Counter)}
+
+// getProxyErrorCounter returns the counter of failed requests for a cause and
+// datasource type, the type is empty when the datasource could not be loaded
+func getProxyErrorCounter(cause string, dsType string) metrics.Counter {
+	key := cause + "." + dsType
+
+	proxyErrorCounters.Lock()
+	defer proxyErrorCounters.Unlock()
+
+	counter, exists := proxyErrorCounters.counters[key]
+	if !exists {
+		tags := []string{"cause", cause}
+		if dsType != "" {
+			tags = append(tags, "type", dsType)
+		}
+		counter = metrics.RegCounter("api.dataproxy.request.errors", tags...)
+		proxyErrorCounters.counters[key] = counter
+	}
+
+	return counter
+}
+
+func countProxyError(cause string, dsType string) {
+	getProxyErrorCounter(cause, dsType).Inc(1)
+}
+
+var proxyInFlight = struct {
+	sync.Mutex
+	counts map[string]int64
+	gauges map[string]metrics.Gauge
+}{counts: make(map[string]int64), gauges: make(map[string]metrics.Gauge)}
+
+// trackProxyInFlight counts a proxied request of the datasource type as in
+// flight, the returned func must be called when the request is done
+func trackProxyInFlight(dsType string) func() {
+	updateProxyInFlight(dsType, 1)
+	return func() { updateProxyInFlight(dsType, -1) }
+}
+
+func updateProxyInFlight(dsType string, delta int64) {
+	proxyInFlight.Lock()
+	defer proxyInFlight.Unlock()
+
+	gauge, exists := proxyInFlight.gauges[dsType]
+	if !exists {
+		gauge = metrics.RegGauge("api.dataproxy.request.inflight", "type", dsType)
+		proxyInFlight.gauges[dsType] = gauge
+	}
+
+	proxyInFlight.counts[dsType] += delta
+	gauge.Update(proxyInFlight.counts[dsType])
+}
+
+// isProxyMethodAllowed limits the methods viewers can proxy, so they can not
+// change the data behind a datasource. viewerMethods in json data overrides
+// the server wide data_proxy_viewer_methods setting
+func isProxyMethodAllowed(c *middleware.Context, ds *m.DataSource) bool {
+	if c.HasUserRole(m.ROLE_EDITOR) {
+		return true
+	}
+
+	method := c.Req.Request.Method
+	if ds.JsonData != nil {
+		if methods, exists := ds.JsonData.CheckGet("viewerMethods"); exists {
+			for _, allowed := range methods.MustStringArray() {
+				if strings.ToUpper(allowed) == method {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	return setting.DataProxy().ViewerMethods[method]
+}
+
+// isProxyTypeAllowed checks the datasource type against data_proxy_allowed_types,
+// an empty list allows all types
+func isProxyTypeAllowed(ds *m.DataSource) bool {
+	allowed := setting.DataProxy().AllowedTypes
+	return len(allowed) == 0 || allowed[ds.Type]
+}
+
+// getProxyRequestId reuses the correlation id sent by the client, ids that
+// are too long or contain anything but letters, digits, dashes and
+// underscores are replaced by a generated one so they are safe to log
+func getProxyRequestId(req *http.Request) string {
+	requestId := req.Header.Get("X-Request-ID")
+	if requestId == "" || len(requestId) > 128 {
+		return util.GetRandomString(32)
+	}
+
+	for _, char := range requestId {
+		if !(char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char >= '0' && char <= '9' || char == '-' || char == '_') {
+			return util.GetRandomString(32)
+		}
+	}
+
+	return requestId
+}
+
+var errProxyRequestBodyTooLarge = errors.New("Request body is larger than data_proxy_max_request_body")
+
+// limitProxyRequestBody returns false when the content length of the request
+// is larger than limit. Bodies of unknown length, like chunked bulk inserts,
+// are streamed to the backend and fail once they pass the limit, buffering
+// them would hold large ingest requests in memory
+func limitProxyRequestBody(req *http.Request, limit int64) bool {
+	if limit <= 0 || req.Body == nil {
+		return true
+	}
+
+	if req.ContentLength > limit {
+		return false
+	}
+
+	// the server never reads more than the content length
+	if req.ContentLength < 0 {
+		req.Body = &limitedProxyBody{ReadCloser: req.Body, remaining: limit}
+	}
+
+	return true
+}
+
+type limitedProxyBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedProxyBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errProxyRequestBodyTooLarge
+	}
+
+	// one byte more than the limit is read to tell a body of exactly the
+	// limit from a larger one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return 0, errProxyRequestBodyTooLarge
+	}
+	return n, err
+}
+
+// checkProxyTarget replies with an error and returns false when the proxy may
+// not send the request to the url
+func checkProxyTarget(c *middleware.Context, ds *m.DataSource, targetUrl *url.URL) bool {
+	if len(setting.DataProxyWhiteList) > 0 && !isInDataProxyWhiteList(targetUrl) {
+		countProxyError(proxyErrorWhitelistDenied, ds.Type)
+		c.JsonApiErr(403, fmt.Sprintf("Data proxy host %s is not included in whitelist", targetUrl.Host), nil)
+		return false
+	}
+
+	if isProxyLoop(c.Req.Request) {
+		c.JsonApiErr(508, "Proxy loop detected, the request already passed through this server", nil)
+		return false
+	}
+
+	if resolvesToBlockedAddress(targetUrl) {
+		c.JsonApiErr(403, fmt.Sprintf("Data proxy host %s resolves to a blocked address", targetUrl.Host), nil)
+		return false
+	}
+
+	if isGrafanaAddress(targetUrl) {
+		c.JsonApiErr(400, "Datasource url points at Grafana itself", nil)
+		return false
+	}
+
+	return true
+}
+
+// checkProxySocket is checkProxyTarget for unix socket datasources
+func checkProxySocket(c *middleware.Context, ds *m.DataSource, socket string) bool {
+	if len(setting.DataProxyWhiteList) > 0 && !isSocketInDataProxyWhiteList(socket) {
+		countProxyError(proxyErrorWhitelistDenied, ds.Type)
+		c.JsonApiErr(403, fmt.Sprintf("Data proxy socket %s is not included in whitelist", socket), nil)
+		return false
 	}
 
-	return &httputil.ReverseProxy{Director: director, FlushInterval: time.Millisecond * 200}
+	if isProxyLoop(c.Req.Request) {
+		c.JsonApiErr(508, "Proxy loop detected, the request already passed through this server", nil)
+		return false
+	}
+
+	if isBlockedSocket() {
+		c.JsonApiErr(403, fmt.Sprintf("Data proxy socket %s is blocked", socket), nil)
+		return false
+	}
+
+	return true
 }
 
 func getDatasource(id int64, orgId int64) (*m.DataSource, error) {
+	if setting.DataProxy().DataSourceCacheTTL > 0 {
+		if ds, exists := getCachedDataSource(id, orgId); exists {
+			return ds, nil
+		}
+	}
+
 	query := m.GetDataSourceByIdQuery{Id: id, OrgId: orgId}
 	if err := bus.Dispatch(&query); err != nil {
 		return nil, err
 	}
 
+	if setting.DataProxy().DataSourceCacheTTL > 0 {
+		cacheDataSource(query.Result, time.Duration(setting.DataProxy().DataSourceCacheTTL)*time.Second)
+	}
+
 	return query.Result, nil
 }
 
+// isProxyPathAllowed checks the path against the allowedPaths json data option,
+// a list of path prefixes and regular expressions starting with ^. Without the
+// option all paths are allowed
+func isProxyPathAllowed(ds *m.DataSource, proxyPath string) bool {
+	if ds.JsonData == nil {
+		return true
+	}
+
+	allowedPaths, exists := ds.JsonData.CheckGet("allowedPaths")
+	if !exists {
+		return true
+	}
+
+	// the backend resolves dot segments, so they are resolved before checking
+	cleanPath := strings.TrimPrefix(path.Clean("/"+proxyPath), "/")
+
+	for _, allowed := range allowedPaths.MustStringArray() {
+		if strings.HasPrefix(allowed, "^") {
+			pattern, err := regexp.Compile(allowed)
+			if err != nil {
+				dataproxyLogger.Warn("Invalid allowedPaths pattern", "datasource", ds.Name, "pattern", allowed, "error", err)
+				continue
+			}
+			if pattern.MatchString(cleanPath) {
+				return true
+			}
+			continue
+		}
+
+		prefix := strings.Trim(allowed, "/")
+		if prefix == "" || cleanPath == prefix || strings.HasPrefix(cleanPath, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getKeystoneScope reads the keystoneDomain and keystoneProject json data
+// options, empty options keep the project of the org and the user domain
+func getKeystoneScope(ds *m.DataSource) keystone.TokenScope {
+	return keystone.TokenScope{
+		Domain:  ds.JsonData.Get("keystoneDomain").MustString(),
+		Project: ds.JsonData.Get("keystoneProject").MustString(),
+	}
+}
+
+func usesKeystoneAuth(ds *m.DataSource) bool {
+	keystoneAuth := ds.JsonData.Get("keystoneAuth").MustBool(false)
+
+	// Try authType (new setting name) as well if keystoneAuth is missing/false
+	if !keystoneAuth {
+		keystoneAuth = (ds.JsonData.Get("authMode").MustString("") == "Keystone")
+	}
+
+	return keystoneAuth
+}
+
 func ProxyDataSourceRequest(c *middleware.Context) {
 	c.TimeRequest(metrics.M_DataSource_ProxyReq_Timer)
 
-	ds, err := getDatasource(c.ParamsInt64(":id"), c.OrgId)
+	dsId := c.ParamsInt64(":id")
+
+	// checked before the datasource is loaded, the answer is the same whether
+	// it exists or not
+	if setting.DataProxy().DisabledOrgs[c.OrgId] {
+		countProxyError(proxyErrorOrgDisabled, "")
+		c.JsonApiErr(403, "The data proxy is disabled for this organization", nil)
+		return
+	}
+
+	// checked before anything else is done for the request, a saturated
+	// server does not even load the datasource
+	releaseServer, acquired := acquireServerProxySlot()
+	if !acquired {
+		countProxyError(proxyErrorServerBusy, "")
+		c.Resp.Header().Set("Retry-After", "1")
+		c.JsonApiErr(503, "Too many concurrent data proxy requests", nil)
+		return
+	}
+	defer releaseServer()
+
+	ds, err := getDatasource(dsId, c.OrgId)
+	defer auditProxyRequest(c, dsId, ds)
 
 	if err != nil {
+		if err == m.ErrDataSourceNotFound {
+			countProxyError(proxyErrorNotFound, "")
+			c.JsonApiErr(404, "Data source not found", nil)
+			return
+		}
+		countProxyError(proxyErrorLoadFailed, "")
 		c.JsonApiErr(500, "Unable to load datasource meta data", err)
 		return
 	}
 
+	// deferred so rejected, failed and cancelled requests are counted as done
+	defer trackProxyInFlight(ds.Type)()
+
+	// canceled when the datasource is updated or deleted meanwhile
+	req, unwatch := watchProxyDataSource(c.Req.Request, ds.Id)
+	defer unwatch()
+	c.Req.Request = req
+
+	if minRole := m.RoleType(ds.JsonData.Get("minRole").MustString()); minRole.IsValid() && !c.HasUserRole(minRole) {
+		c.JsonApiErr(403, "Access denied to this datasource", nil)
+		return
+	}
+
+	if !isProxyTypeAllowed(ds) {
+		c.JsonApiErr(403, fmt.Sprintf("Datasources of type %s can not be reached through the proxy", ds.Type), nil)
+		return
+	}
+
+	if !isProxyMethodAllowed(c, ds) {
+		c.JsonApiErr(405, fmt.Sprintf("Method %s is not allowed for your role on this datasource", c.Req.Request.Method), nil)
+		return
+	}
+
+	release, acquired := acquireProxySlot(ds)
+	if !acquired {
+		c.JsonApiErr(429, "Too many concurrent requests to this datasource", nil)
+		return
+	}
+	defer release()
+
+	if !limitProxyRequestBody(c.Req.Request, setting.DataProxy().MaxRequestBody) {
+		c.JsonApiErr(413, fmt.Sprintf("Request body is larger than %d bytes", setting.DataProxy().MaxRequestBody), nil)
+		return
+	}
+
+	if limit := getProxyMaxHeaderBytes(ds); limit > 0 && getProxyHeaderBytes(c.Req.Header) > limit {
+		c.JsonApiErr(431, fmt.Sprintf("Request headers are larger than %d bytes", limit), nil)
+		return
+	}
+
 	if ds.Type == m.DS_CLOUDWATCH {
+		// the credentials are only sent to a custom endpoint the proxy may reach
+		if endpoint := cloudwatch.GetEndpoint(ds); endpoint != "" {
+			endpointUrl, err := url.Parse(endpoint)
+			if err != nil || endpointUrl.Host == "" || (endpointUrl.Scheme != "https" && endpointUrl.Scheme != "http") {
+				c.JsonApiErr(400, fmt.Sprintf("Invalid CloudWatch endpoint url %q", endpoint), err)
+				return
+			}
+			if !checkProxyTarget(c, ds, endpointUrl) {
+				return
+			}
+		}
+
+		// the aws clients send their requests with the context of the request,
+		// the idle timeout mode does not apply as the responses are not streamed
+		if timeout := time.Duration(getProxyTimeout(ds)) * time.Second; timeout > 0 {
+			ctx, cancel := context.WithTimeout(c.Req.Request.Context(), timeout)
+			defer cancel()
+			c.Req.Request = c.Req.Request.WithContext(ctx)
+		}
+
+		start := time.Now()
 		cloudwatch.HandleRequest(c, ds)
+		if c.Req.Request.Context().Err() == context.DeadlineExceeded {
+			countProxyError(proxyErrorBackendTimeout, ds.Type)
+		}
+		getProxyTypeTimer(ds.Type, c.Resp.Status()).UpdateSince(start)
+		return
+	}
+
+	// the management and login urls can be changed for other azure clouds and
+	// the token url comes with the google service account key
+	if ds.Type == m.DS_AZURE_MONITOR {
+		proxyBearerTokenRequest(c, ds, azuremonitor.GetEndpoints(ds), azuremonitor.HandleRequest)
+		return
+	}
+
+	if ds.Type == m.DS_STACKDRIVER {
+		proxyBearerTokenRequest(c, ds, stackdriver.GetEndpoints(ds), stackdriver.HandleRequest)
 		return
 	}
 
 	if ds.Type == m.DS_INFLUXDB {
-		if c.Query("db") != ds.Database {
+		params, err := readInfluxDBParams(c.Req.Request)
+		if err != nil {
+			if isRequestBodyTooLargeError(err) {
+				c.JsonApiErr(413, fmt.Sprintf("Request body is larger than %d bytes", setting.DataProxy().MaxRequestBody), nil)
+				return
+			}
+			c.JsonApiErr(400, err.Error(), nil)
+			return
+		}
+		if params.Get("db") != ds.Database {
 			c.JsonApiErr(403, "Datasource is not configured to allow this database", nil)
 			return
 		}
+		if usesInfluxDBReadOnly(ds) {
+			if err := checkInfluxDBReadOnly(c.Req.Request, c.Params("*"), params); err != nil {
+				c.JsonApiErr(403, err.Error(), nil)
+				return
+			}
+		}
+	}
+
+	targetUrl, err := parseDataSourceUrl(ds.Url)
+	if err != nil {
+		c.JsonApiErr(400, fmt.Sprintf("Invalid datasource url %q", ds.Url), err)
+		return
+	}
+	if !strings.Contains(ds.Url, "://") {
+		dataproxyLogger.Warn("Datasource url has no scheme, using http", "datasource", ds.Name, "url", targetUrl.Host)
 	}
 
-	targetUrl, _ := url.Parse(ds.Url)
-	if len(setting.DataProxyWhiteList) > 0 {
-		if _, exists := setting.DataProxyWhiteList[targetUrl.Host]; !exists {
-			c.JsonApiErr(403, "Data proxy hostname and ip are not included in whitelist", nil)
+	if socket := ds.UnixSocketPath(); socket != "" {
+		if !checkProxySocket(c, ds, socket) {
 			return
 		}
+	} else if !checkProxyTarget(c, ds, targetUrl) {
+		return
 	}
 
-	keystoneAuth := ds.JsonData.Get("keystoneAuth").MustBool(false)
+	backupUrls, err := getProxyBackupUrls(ds)
+	if err != nil {
+		c.JsonApiErr(400, err.Error(), err)
+		return
+	}
+	for _, backupUrl := range backupUrls {
+		if !checkProxyTarget(c, ds, backupUrl) {
+			return
+		}
+	}
 
-	// Try authType (new setting name) as well if keystoneAuth is missing/false
-	if !keystoneAuth {
-		keystoneAuth = (ds.JsonData.Get("authMode").MustString("") == "Keystone")
+	// removed before the headers below are set, the client could otherwise
+	// remove them by naming them in its Connection header. Websocket
+	// handshakes keep their upgrade headers
+	webSocket := isWebSocketRequest(c.Req.Request)
+
+	// the dry run header is never passed on to the datasource
+	dryRun := isProxyDryRun(c.Req.Request)
+	c.Req.Request.Header.Del(proxyDryRunHeader)
+	if dryRun {
+		if !(c.OrgRole == m.ROLE_ADMIN || c.IsGrafanaAdmin) {
+			c.JsonApiErr(403, "Dry runs of proxied requests are only allowed for admins", nil)
+			return
+		}
+		if webSocket {
+			c.JsonApiErr(400, "Dry runs of websocket requests are not supported", nil)
+			return
+		}
+	}
+
+	removeHopHeaders(c.Req.Request.Header)
+	if webSocket {
+		c.Req.Request.Header.Set("Connection", "Upgrade")
+		c.Req.Request.Header.Set("Upgrade", "websocket")
 	}
 
-	if keystoneAuth {
-		token, err := keystone.GetToken(c)
+	if usesKeystoneAuth(ds) {
+		token, err := keystone.GetToken(c, getKeystoneScope(ds))
 		if err != nil {
+			countProxyError(proxyErrorKeystoneFailed, ds.Type)
 			c.JsonApiErr(500, "Failed to get keystone token", err)
 			return
 		}
 		c.Req.Request.Header["X-Auth-Token"] = []string{token}
 	}
 
+	// the token takes the place of an X-DS-Authorization header of the client,
+	// which replaces the credentials of the datasource
+	if usesOAuthPassThru(ds) {
+		token, ok := getOAuthPassThruToken(c)
+		if !ok {
+			c.JsonApiErr(401, "No OAuth access token for this datasource, sign in with OAuth again", nil)
+			return
+		}
+		c.Req.Request.Header.Set("X-DS-Authorization", "Bearer "+token)
+	}
+
+	// never pass on a user header sent by the client
+	c.Req.Request.Header.Del("X-Grafana-User")
+	if ds.JsonData.Get("sendUserHeader").MustBool(false) && c.IsSignedIn && c.Login != "" {
+		c.Req.Request.Header.Set("X-Grafana-User", c.Login)
+	}
+
+	requestId := getProxyRequestId(c.Req.Request)
+	c.Req.Request.Header.Set("X-Request-ID", requestId)
+	c.Resp.Header().Set("X-Request-ID", requestId)
+
 	proxyPath := c.Params("*")
 
 	if ds.Type == m.DS_ES {
@@ -133,14 +1053,161 @@ func ProxyDataSourceRequest(c *middleware.Context) {
 			c.JsonApiErr(403, "Posts not allowed on proxied Elasticsearch datasource except on /_msearch", nil)
 			return
 		}
+
+		pattern, err := getElasticsearchIndexPattern(ds)
+		if err != nil {
+			c.JsonApiErr(400, err.Error(), err)
+			return
+		}
+		if pattern != nil {
+			if err := checkElasticsearchIndices(c.Req.Request, proxyPath, pattern); err != nil {
+				if isRequestBodyTooLargeError(err) {
+					c.JsonApiErr(413, fmt.Sprintf("Request body is larger than %d bytes", setting.DataProxy().MaxRequestBody), nil)
+					return
+				}
+				c.JsonApiErr(403, err.Error(), nil)
+				return
+			}
+		}
 	}
 
-	proxy := NewReverseProxy(ds, proxyPath, targetUrl)
-	proxy.Transport, err = ds.GetHttpTransport()
+	if !isProxyPathAllowed(ds, proxyPath) {
+		c.JsonApiErr(403, fmt.Sprintf("Path %s is not allowed on this datasource", proxyPath), nil)
+		return
+	}
+
+	transport, err := getProxyTransport(ds, c.SignedInUser)
 	if err != nil {
-		c.JsonApiErr(400, "Unable to load TLS certificate", err)
+		c.JsonApiErr(500, err.Error(), err)
+		return
+	}
+
+	if ds.UsesProxyProtocol() {
+		c.Req.Request = c.Req.Request.WithContext(m.WithProxyProtocolSource(c.Req.Request.Context(), getProxyProtocolSource(c)))
+	}
+
+	if webSocket {
+		proxy := NewReverseProxy(ds, proxyPath, targetUrl)
+		start := time.Now()
+		if err := proxyWebSocket(c.Resp, c.Req.Request, ds, proxy.Director, transport); err != nil {
+			c.JsonApiErr(502, "Failed to open websocket to datasource", err)
+			return
+		}
+		getProxyTypeTimer(ds.Type, http.StatusSwitchingProtocols).UpdateSince(start)
 		return
 	}
-	proxy.ServeHTTP(c.Resp, c.Req.Request)
+
+	req, clientWatch := watchProxyClient(c.Resp, c.Req.Request)
+	defer clientWatch.stop()
+	c.Req.Request = req
+
+	var idleCtx *proxyIdleContext
+	if timeout := time.Duration(getProxyTimeout(ds)) * time.Second; timeout > 0 {
+		if usesProxyIdleTimeout(ds) {
+			ctx, stop := newProxyIdleContext(c.Req.Request.Context(), timeout)
+			defer stop()
+			idleCtx = ctx
+			c.Req.Request = c.Req.Request.WithContext(ctx)
+		} else {
+			ctx, cancel := context.WithTimeout(c.Req.Request.Context(), timeout)
+			defer cancel()
+			c.Req.Request = c.Req.Request.WithContext(ctx)
+		}
+	}
+
+	if usesProxyStickySessions(ds) {
+		c.Req.Request = withProxyStickyKey(c.Req.Request, getProxyStickySession(c))
+	}
+	c.Req.Request = withProxyNoCache(c.Req.Request)
+
+	proxy := NewReverseProxy(ds, proxyPath, targetUrl)
+	if dryRun {
+		proxy.Transport = newDataProxyDryRunTransport(ds, transport)
+	} else {
+		proxy.Transport = newDataProxyTransport(ds, transport, c.OrgRole == m.ROLE_ADMIN || c.IsGrafanaAdmin)
+	}
+	if usesKeystoneAuth(ds) {
+		scope := getKeystoneScope(ds)
+		proxy.Transport = &keystoneTransport{
+			transport: proxy.Transport,
+			refresh:   func() (string, error) { return keystone.RefreshToken(c, scope) },
+		}
+	}
+
+	start := time.Now()
+	var w http.ResponseWriter = c.Resp
+	if getProxyFlushInterval(ds.JsonData) < 0 || isGrpcWebRequest(c.Req.Request) || isEventStreamRequest(c.Req.Request) {
+		w = &flushingResponseWriter{c.Resp}
+	}
+	if idleCtx != nil {
+		w = &idleTimeoutResponseWriter{ResponseWriter: w, ctx: idleCtx}
+	}
+	proxy.ServeHTTP(w, c.Req.Request)
+	if clientWatch.clientClosed() {
+		countProxyError(proxyErrorClientCanceled, ds.Type)
+		dataproxyLogger.Debug("Proxy request canceled by client", "datasource", ds.Name, "requestId", requestId)
+	}
+	getProxyTypeTimer(ds.Type, c.Resp.Status()).UpdateSince(start)
 	c.Resp.Header().Del("Set-Cookie")
 }
+
+// proxyBearerTokenRequest proxies the requests of datasources that get their
+// bearer token server side. The credentials are only sent to endpoints the
+// proxy may reach
+func proxyBearerTokenRequest(c *middleware.Context, ds *m.DataSource, endpoints []string, handle func(*middleware.Context, *m.DataSource, func(http.RoundTripper) http.RoundTripper)) {
+	for _, endpoint := range endpoints {
+		endpointUrl, err := url.Parse(endpoint)
+		if err != nil || endpointUrl.Host == "" {
+			c.JsonApiErr(400, fmt.Sprintf("Invalid datasource endpoint url %q", endpoint), err)
+			return
+		}
+		if !checkProxyTarget(c, ds, endpointUrl) {
+			return
+		}
+	}
+
+	if proxyPath := c.Params("*"); !isProxyPathAllowed(ds, proxyPath) {
+		c.JsonApiErr(403, fmt.Sprintf("Path %s is not allowed on this datasource", proxyPath), nil)
+		return
+	}
+
+	timeout := getProxyTimeout(ds)
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(c.Req.Request.Context(), time.Duration(timeout)*time.Second)
+		defer cancel()
+		c.Req.Request = c.Req.Request.WithContext(ctx)
+	}
+
+	start := time.Now()
+	handle(c, ds, func(transport http.RoundTripper) http.RoundTripper {
+		return &proxyErrorTransport{transport: transport, datasource: ds.Name, dsType: ds.Type, timeout: timeout, showDetails: c.OrgRole == m.ROLE_ADMIN || c.IsGrafanaAdmin}
+	})
+	getProxyTypeTimer(ds.Type, c.Resp.Status()).UpdateSince(start)
+}
+
+// getProxyProtocolSource returns the client address for the PROXY protocol
+// header, the ip is the one Grafana logs for the client. The port is only known
+// when the client connected directly
+func getProxyProtocolSource(c *middleware.Context) *net.TCPAddr {
+	ip := getProxyClientIP(c.Req.Request)
+	if ip == nil {
+		return nil
+	}
+
+	source := &net.TCPAddr{IP: ip}
+	if host, port, err := net.SplitHostPort(c.Req.RemoteAddr); err == nil && ip.Equal(net.ParseIP(host)) {
+		source.Port, _ = strconv.Atoi(port)
+	}
+	return source
+}
+
+// getProxyStickySession returns the session of the request, or the user for
+// requests without a session such as api key requests
+func getProxyStickySession(c *middleware.Context) string {
+	if c.Session != nil {
+		if id := c.Session.ID(); id != "" {
+			return id
+		}
+	}
+	return fmt.Sprintf("%d:%d:%d", c.OrgId, c.UserId, c.ApiKeyId)
+}
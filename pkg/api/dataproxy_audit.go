@@ -0,0 +1,28 @@
+package api
+
+import (
+	"github.com/grafana/grafana/pkg/log"
+	"github.com/grafana/grafana/pkg/middleware"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+// dataproxyAuditLogger has its own name so the audit trail can be filtered
+// and shipped apart from the other proxy logs
+var dataproxyAuditLogger log.Logger = log.New("data-proxy-audit")
+
+// auditProxyRequest logs who sent a request to which datasource and how it
+// ended, ds is nil when the datasource could not be loaded. The query string
+// and headers can carry secrets and are left out
+func auditProxyRequest(c *middleware.Context, dsId int64, ds *m.DataSource) {
+	ctx := []interface{}{"orgId", c.OrgId, "userId", c.UserId, "login", c.Login, "datasourceId", dsId}
+	if ds != nil {
+		ctx = append(ctx, "datasource", ds.Name, "type", ds.Type)
+	}
+	ctx = append(ctx,
+		"method", c.Req.Request.Method,
+		"path", c.Params("*"),
+		"status", c.Resp.Status(),
+		"requestId", c.Resp.Header().Get("X-Request-ID"))
+
+	dataproxyAuditLogger.Info("Datasource proxy request", ctx...)
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/inconshreveable/log15"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func TestDataSourceProxyAuditLog(t *testing.T) {
+	Convey("When auditing proxied requests", t, func() {
+		var logged bytes.Buffer
+		handler := dataproxyAuditLogger.GetHandler()
+		dataproxyAuditLogger.SetHandler(log15.StreamHandler(&logged, log15.LogfmtFormat()))
+		defer dataproxyAuditLogger.SetHandler(handler)
+
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+		}))
+		defer backend.Close()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			if query.Id != 290 {
+				return m.ErrDataSourceNotFound
+			}
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Name: "metrics", Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: simplejson.New()}
+			return nil
+		})
+
+		user := &m.SignedInUser{OrgId: 3, UserId: 7, Login: "auditor", OrgRole: m.ROLE_VIEWER}
+
+		Convey("Should log the user, datasource and status", func() {
+			proxyHandlerRequest(user, "GET", "/api/datasources/proxy/290/api/v1/query?query=up&api_key=secret")
+
+			So(logged.String(), ShouldContainSubstring, "orgId=3 userId=7 login=auditor datasourceId=290 datasource=metrics type=prometheus method=GET path=api/v1/query status=200")
+			So(logged.String(), ShouldNotContainSubstring, "secret")
+		})
+
+		Convey("Should log requests to datasources that do not exist", func() {
+			proxyHandlerRequest(user, "GET", "/api/datasources/proxy/291/api/v1/query")
+
+			So(logged.String(), ShouldContainSubstring, "datasourceId=291 method=GET path=api/v1/query status=404")
+		})
+	})
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"net/http"
+
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+// proxyAuthorizer sets the credentials of a datasource on a proxied request
+type proxyAuthorizer func(req *http.Request) error
+
+// dataProxyAuthScheme is an auth mechanism of proxied requests, used for the
+// datasources it is enabled for. newAuthorizer is called once per datasource
+// round tripper, schemes that act on the response of the backend, like
+// refreshing a rejected token, give a wrap func that replaces the default one
+type dataProxyAuthScheme struct {
+	enabled       func(ds *m.DataSource) bool
+	newAuthorizer func(ds *m.DataSource, dsTransport http.RoundTripper) proxyAuthorizer
+	wrap          func(ds *m.DataSource, transport http.RoundTripper, dsTransport http.RoundTripper) http.RoundTripper
+}
+
+// dataProxyAuthSchemes set the credentials of a proxied request once, above
+// the redirect round tripper that drops them on redirects to other hosts. They
+// are applied in order, later schemes replace the Authorization header set by
+// earlier ones. Keystone tokens belong to the signed in user and are set by
+// ProxyDataSourceRequest
+var dataProxyAuthSchemes = []dataProxyAuthScheme{
+	{enabled: usesInfluxDbCredentials, newAuthorizer: newInfluxDbAuthorizer},
+	{enabled: usesBasicAuth, newAuthorizer: newBasicAuthAuthorizer},
+	{enabled: usesDataSourceAuthHeader, newAuthorizer: newDataSourceAuthHeaderAuthorizer},
+	{enabled: usesOAuthClientCredentials, newAuthorizer: newOAuthAuthorizer, wrap: newOAuthTransport},
+}
+
+// dataProxyHopAuthSchemes are below the redirect round tripper, so every
+// request that reaches a backend is authorized for its own url. The query
+// parameter is added before signing so the signature covers it. Kerberos
+// tickets are issued for a host, a redirect gets a token for its own host
+var dataProxyHopAuthSchemes = []dataProxyAuthScheme{
+	{enabled: usesProxyQueryParam, newAuthorizer: newProxyQueryParamAuthorizer},
+	{enabled: usesSigV4Auth, newAuthorizer: newSigV4Authorizer},
+	{enabled: usesKerberosAuth, newAuthorizer: newKerberosAuthorizer, wrap: newKerberosTransport},
+}
+
+// wrapDataProxyAuth wraps the transport from the last scheme on, so the first
+// scheme is applied first
+func wrapDataProxyAuth(schemes []dataProxyAuthScheme, ds *m.DataSource, transport http.RoundTripper, dsTransport http.RoundTripper) http.RoundTripper {
+	for i := len(schemes) - 1; i >= 0; i-- {
+		scheme := schemes[i]
+		if !scheme.enabled(ds) {
+			continue
+		}
+
+		if scheme.wrap != nil {
+			transport = scheme.wrap(ds, transport, dsTransport)
+		} else {
+			transport = &proxyAuthTransport{transport: transport, authorize: scheme.newAuthorizer(ds, dsTransport)}
+		}
+	}
+
+	return transport
+}
+
+// authorizeDataProxyRequest applies all schemes of the datasource to a request
+// that does not go through the round trippers, like a websocket handshake
+func authorizeDataProxyRequest(ds *m.DataSource, req *http.Request, dsTransport http.RoundTripper) error {
+	for _, schemes := range [][]dataProxyAuthScheme{dataProxyAuthSchemes, dataProxyHopAuthSchemes} {
+		for _, scheme := range schemes {
+			if !scheme.enabled(ds) {
+				continue
+			}
+			if err := scheme.newAuthorizer(ds, dsTransport)(req); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// proxyAuthTransport authorizes a copy of the request, so a retried or
+// redirected request is authorized again from the original
+type proxyAuthTransport struct {
+	transport http.RoundTripper
+	authorize proxyAuthorizer
+}
+
+func (t *proxyAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	outreq := cloneProxyRequest(req)
+	outurl := *req.URL
+	outreq.URL = &outurl
+
+	if err := t.authorize(outreq); err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+
+	return t.transport.RoundTrip(outreq)
+}
+
+// InfluxDB 0.8 gets the credentials of the datasource in the query or, with
+// credentialsInHeader, as basic auth. Later versions get them as basic auth
+// unless the datasource has basic auth of its own
+func usesInfluxDbCredentials(ds *m.DataSource) bool {
+	return ds.Type == m.DS_INFLUXDB_08 || (ds.Type == m.DS_INFLUXDB && !ds.BasicAuth)
+}
+
+func newInfluxDbAuthorizer(ds *m.DataSource, dsTransport http.RoundTripper) proxyAuthorizer {
+	var credentialsInHeader, preserveQueryOrder bool
+	if ds.JsonData != nil {
+		credentialsInHeader = ds.JsonData.Get("credentialsInHeader").MustBool(false)
+		preserveQueryOrder = ds.JsonData.Get("preserveQueryOrder").MustBool(false)
+	}
+	authHeader := util.GetBasicAuthHeader(ds.User, ds.Password)
+
+	return func(req *http.Request) error {
+		if ds.Type == m.DS_INFLUXDB_08 && !credentialsInHeader {
+			if preserveQueryOrder {
+				req.URL.RawQuery = appendQueryParam(req.URL.RawQuery, "u", ds.User)
+				req.URL.RawQuery = appendQueryParam(req.URL.RawQuery, "p", ds.Password)
+			} else {
+				reqQueryVals := req.URL.Query()
+				reqQueryVals.Add("u", ds.User)
+				reqQueryVals.Add("p", ds.Password)
+				req.URL.RawQuery = reqQueryVals.Encode()
+			}
+			return nil
+		}
+
+		req.Header.Set("Authorization", authHeader)
+		return nil
+	}
+}
+
+func usesBasicAuth(ds *m.DataSource) bool {
+	return ds.BasicAuth
+}
+
+func newBasicAuthAuthorizer(ds *m.DataSource, dsTransport http.RoundTripper) proxyAuthorizer {
+	authHeader := util.GetBasicAuthHeader(ds.BasicAuthUser, ds.BasicAuthPassword)
+	return func(req *http.Request) error {
+		req.Header.Set("Authorization", authHeader)
+		return nil
+	}
+}
+
+// the X-DS-Authorization header of the client replaces the credentials of the
+// datasource, for plugins that authenticate their users against the backend
+func usesDataSourceAuthHeader(ds *m.DataSource) bool {
+	return true
+}
+
+func newDataSourceAuthHeaderAuthorizer(ds *m.DataSource, dsTransport http.RoundTripper) proxyAuthorizer {
+	return func(req *http.Request) error {
+		if dsAuth := req.Header.Get("X-DS-Authorization"); len(dsAuth) > 0 {
+			req.Header.Del("X-DS-Authorization")
+			req.Header.Set("Authorization", dsAuth)
+		}
+		return nil
+	}
+}
+
+func usesProxyQueryParam(ds *m.DataSource) bool {
+	return getProxyQueryParamName(ds) != ""
+}
+
+// newProxyQueryParamAuthorizer adds the secret query parameter of backends
+// that authenticate with an api key in the url. It runs after the director so
+// the secret never ends up in the logs, and is only sent to the datasource
+// hosts, not to redirects that leave them
+func newProxyQueryParamAuthorizer(ds *m.DataSource, dsTransport http.RoundTripper) proxyAuthorizer {
+	name := getProxyQueryParamName(ds)
+	value := ds.SecureJsonData.Decrypt()["httpQueryParamValue"]
+	targetHosts := make(map[string]bool)
+	for _, targetUrl := range getProxyFailoverTargets(ds) {
+		targetHosts[targetUrl.Host] = true
+	}
+
+	return func(req *http.Request) error {
+		if targetHosts[req.URL.Host] {
+			req.URL.RawQuery = setQueryParam(req.URL.RawQuery, name, value)
+		}
+		return nil
+	}
+}
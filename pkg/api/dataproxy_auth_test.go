@@ -0,0 +1,48 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+func TestDataSourceProxyAuth(t *testing.T) {
+	Convey("When authorizing proxied requests", t, func() {
+		var authorization, dsAuthorization string
+		backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			authorization = req.Header.Get("Authorization")
+			dsAuthorization = req.Header.Get("X-DS-Authorization")
+			return &http.Response{StatusCode: 200, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		})
+
+		ds := &m.DataSource{Type: m.DS_INFLUXDB, User: "influx", Password: "secret", BasicAuth: true, BasicAuthUser: "user", BasicAuthPassword: "password"}
+		transport := wrapDataProxyAuth(dataProxyAuthSchemes, ds, backend, backend)
+
+		Convey("Should prefer basic auth over the influxdb credentials", func() {
+			req, _ := http.NewRequest("GET", "http://influxdb:8086/query", nil)
+			_, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(authorization, ShouldEqual, util.GetBasicAuthHeader("user", "password"))
+		})
+
+		Convey("Should let the X-DS-Authorization header replace the credentials", func() {
+			req, _ := http.NewRequest("GET", "http://influxdb:8086/query", nil)
+			req.Header.Set("X-DS-Authorization", "Bearer plugin")
+			_, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(authorization, ShouldEqual, "Bearer plugin")
+			So(dsAuthorization, ShouldEqual, "")
+
+			Convey("Should authorize a copy of the request", func() {
+				So(req.Header.Get("Authorization"), ShouldEqual, "")
+				So(req.Header.Get("X-DS-Authorization"), ShouldEqual, "Bearer plugin")
+			})
+		})
+	})
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/metrics"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+var errProxyBreakerOpen = errors.New("Datasource is failing, requests are paused for a while")
+
+// proxyBreaker fails requests to a datasource fast once its backend failed
+// data_proxy_breaker_failures times in a row within the window. After the
+// cooldown a single request is let through, a success closes the breaker and
+// a failure opens it for another cooldown
+type proxyBreaker struct {
+	sync.Mutex
+	failures     int
+	firstFailure time.Time
+	// zero while the breaker is closed
+	opened  time.Time
+	probing bool
+}
+
+var proxyBreakers = struct {
+	sync.Mutex
+	breakers map[int64]*proxyBreaker
+}{breakers: make(map[int64]*proxyBreaker)}
+
+var proxyBreakersOpen = struct {
+	sync.Mutex
+	counts map[string]int64
+	gauges map[string]metrics.Gauge
+}{counts: make(map[string]int64), gauges: make(map[string]metrics.Gauge)}
+
+func getProxyBreaker(dsId int64) *proxyBreaker {
+	proxyBreakers.Lock()
+	defer proxyBreakers.Unlock()
+
+	breaker, exists := proxyBreakers.breakers[dsId]
+	if !exists {
+		breaker = &proxyBreaker{}
+		proxyBreakers.breakers[dsId] = breaker
+	}
+	return breaker
+}
+
+// updateProxyBreakersOpen tracks the open breakers per datasource type
+func updateProxyBreakersOpen(dsType string, delta int64) {
+	proxyBreakersOpen.Lock()
+	defer proxyBreakersOpen.Unlock()
+
+	gauge, exists := proxyBreakersOpen.gauges[dsType]
+	if !exists {
+		gauge = metrics.RegGauge("api.dataproxy.breaker.open", "type", dsType)
+		proxyBreakersOpen.gauges[dsType] = gauge
+	}
+
+	proxyBreakersOpen.counts[dsType] += delta
+	gauge.Update(proxyBreakersOpen.counts[dsType])
+}
+
+// allow reports whether a request may be sent to the backend, probe is true
+// for the single request sent after the cooldown
+func (b *proxyBreaker) allow(now time.Time, cooldown time.Duration) (allowed bool, probe bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.opened.IsZero() {
+		return true, false
+	}
+	if b.probing || now.Sub(b.opened) < cooldown {
+		return false, false
+	}
+
+	b.probing = true
+	return true, true
+}
+
+// record counts the outcome of a request, it returns 1 when the breaker
+// opened, -1 when it closed and 0 otherwise
+func (b *proxyBreaker) record(failed bool, probe bool, now time.Time, maxFailures int, window time.Duration) int64 {
+	b.Lock()
+	defer b.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+
+	if !failed {
+		b.failures = 0
+		if !b.opened.IsZero() {
+			b.opened = time.Time{}
+			return -1
+		}
+		return 0
+	}
+
+	// a failed probe opens the breaker for another cooldown
+	if !b.opened.IsZero() {
+		if probe {
+			b.opened = now
+		}
+		return 0
+	}
+
+	if b.failures == 0 || now.Sub(b.firstFailure) > window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+
+	if b.failures >= maxFailures {
+		b.opened = now
+		return 1
+	}
+	return 0
+}
+
+func (b *proxyBreaker) endProbe() {
+	b.Lock()
+	b.probing = false
+	b.Unlock()
+}
+
+// isProxyBackendFailure reports responses of a backend that is down or
+// overloaded, other errors are caused by the request
+func isProxyBackendFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == 502 || resp.StatusCode == 503 || resp.StatusCode == 504
+}
+
+// proxyBreakerTransport fails requests with errProxyBreakerOpen, a 503 for
+// the client, without contacting the backend while the breaker of the
+// datasource is open. It is above the retries, so a request that fails after
+// all its retries counts as one failure
+type proxyBreakerTransport struct {
+	transport   http.RoundTripper
+	ds          *m.DataSource
+	maxFailures int
+	window      time.Duration
+	cooldown    time.Duration
+}
+
+func newProxyBreakerTransport(ds *m.DataSource, transport http.RoundTripper) *proxyBreakerTransport {
+	cfg := setting.DataProxy()
+	return &proxyBreakerTransport{
+		transport:   transport,
+		ds:          ds,
+		maxFailures: cfg.BreakerFailures,
+		window:      time.Duration(cfg.BreakerWindow) * time.Second,
+		cooldown:    time.Duration(cfg.BreakerCooldown) * time.Second,
+	}
+}
+
+func (t *proxyBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	breaker := getProxyBreaker(t.ds.Id)
+
+	allowed, probe := breaker.allow(time.Now(), t.cooldown)
+	if !allowed {
+		closeRequestBody(req)
+		return nil, errProxyBreakerOpen
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+
+	// requests canceled by the client say nothing about the backend, the next
+	// request probes it instead
+	if err != nil && req.Context().Err() == context.Canceled {
+		if probe {
+			breaker.endProbe()
+		}
+		return resp, err
+	}
+
+	switch breaker.record(isProxyBackendFailure(resp, err), probe, time.Now(), t.maxFailures, t.window) {
+	case 1:
+		dataproxyLogger.Warn("Datasource failing, pausing proxy requests", "datasource", t.ds.Name, "cooldown", t.cooldown)
+		updateProxyBreakersOpen(t.ds.Type, 1)
+	case -1:
+		dataproxyLogger.Info("Datasource recovered, resuming proxy requests", "datasource", t.ds.Name)
+		updateProxyBreakersOpen(t.ds.Type, -1)
+	}
+
+	return resp, err
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestDataSourceProxyBreaker(t *testing.T) {
+	Convey("When a proxied backend keeps failing", t, func() {
+		backendRequests := 0
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendRequests++
+			w.WriteHeader(503)
+		}))
+		defer backend.Close()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: simplejson.New()}
+			return nil
+		})
+
+		failures, window, cooldown := setting.DataProxy().BreakerFailures, setting.DataProxy().BreakerWindow, setting.DataProxy().BreakerCooldown
+		defer func() {
+			setting.DataProxy().BreakerFailures, setting.DataProxy().BreakerWindow, setting.DataProxy().BreakerCooldown = failures, window, cooldown
+		}()
+		setting.DataProxy().BreakerFailures = 2
+		setting.DataProxy().BreakerWindow = 60
+		setting.DataProxy().BreakerCooldown = 3600
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+
+		Convey("Should fail fast once the breaker opened", func() {
+			So(proxyHandlerRequest(user, "GET", "/api/datasources/proxy/310/api/v1/query").Code, ShouldEqual, 503)
+			So(proxyHandlerRequest(user, "GET", "/api/datasources/proxy/310/api/v1/query").Code, ShouldEqual, 503)
+			So(backendRequests, ShouldEqual, 2)
+
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/310/api/v1/query")
+			So(resp.Code, ShouldEqual, 503)
+			So(decodeProxyError(resp), ShouldEqual, errProxyBreakerOpen.Error())
+			So(backendRequests, ShouldEqual, 2)
+		})
+	})
+
+	Convey("When counting backend failures", t, func() {
+		breaker := &proxyBreaker{}
+		start := time.Now()
+		cooldown := 30 * time.Second
+
+		fail := func(at time.Duration) int64 {
+			return breaker.record(true, false, start.Add(at), 3, time.Minute)
+		}
+
+		Convey("Should only open after consecutive failures within the window", func() {
+			fail(0)
+			fail(time.Second)
+			breaker.record(false, false, start.Add(2*time.Second), 3, time.Minute)
+			fail(3 * time.Second)
+			fail(4 * time.Second)
+			So(fail(2*time.Minute), ShouldEqual, 0)
+
+			allowed, _ := breaker.allow(start.Add(2*time.Minute), cooldown)
+			So(allowed, ShouldBeTrue)
+		})
+
+		Convey("Should let a single probe through after the cooldown", func() {
+			fail(0)
+			fail(time.Second)
+			So(fail(2*time.Second), ShouldEqual, 1)
+
+			allowed, _ := breaker.allow(start.Add(10*time.Second), cooldown)
+			So(allowed, ShouldBeFalse)
+
+			allowed, probe := breaker.allow(start.Add(time.Minute), cooldown)
+			So(allowed, ShouldBeTrue)
+			So(probe, ShouldBeTrue)
+
+			allowed, _ = breaker.allow(start.Add(time.Minute), cooldown)
+			So(allowed, ShouldBeFalse)
+
+			Convey("Should close when the probe succeeds", func() {
+				So(breaker.record(false, true, start.Add(time.Minute), 3, time.Minute), ShouldEqual, -1)
+				allowed, probe := breaker.allow(start.Add(time.Minute), cooldown)
+				So(allowed, ShouldBeTrue)
+				So(probe, ShouldBeFalse)
+			})
+
+			Convey("Should open for another cooldown when the probe fails", func() {
+				So(breaker.record(true, true, start.Add(time.Minute), 3, time.Minute), ShouldEqual, 0)
+				allowed, _ := breaker.allow(start.Add(time.Minute+10*time.Second), cooldown)
+				So(allowed, ShouldBeFalse)
+				allowed, _ = breaker.allow(start.Add(2*time.Minute), cooldown)
+				So(allowed, ShouldBeTrue)
+			})
+		})
+	})
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"sync"
+	"time"
+
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+// datasources are cached per org so one org can never be served a
+// datasource belonging to another org with the same id
+type dataSourceCacheKey struct {
+	id    int64
+	orgId int64
+}
+
+type dataSourceCacheItem struct {
+	ds      *m.DataSource
+	expires time.Time
+}
+
+var dataSourceCache = struct {
+	sync.Mutex
+	items map[dataSourceCacheKey]dataSourceCacheItem
+}{items: make(map[dataSourceCacheKey]dataSourceCacheItem)}
+
+func getCachedDataSource(id int64, orgId int64) (*m.DataSource, bool) {
+	dataSourceCache.Lock()
+	defer dataSourceCache.Unlock()
+
+	key := dataSourceCacheKey{id: id, orgId: orgId}
+	item, exists := dataSourceCache.items[key]
+	if !exists {
+		return nil, false
+	}
+
+	if time.Now().After(item.expires) {
+		delete(dataSourceCache.items, key)
+		return nil, false
+	}
+
+	return item.ds, true
+}
+
+func cacheDataSource(ds *m.DataSource, ttl time.Duration) {
+	dataSourceCache.Lock()
+	defer dataSourceCache.Unlock()
+
+	key := dataSourceCacheKey{id: ds.Id, orgId: ds.OrgId}
+	dataSourceCache.items[key] = dataSourceCacheItem{ds: ds, expires: time.Now().Add(ttl)}
+}
+
+// invalidateCachedDataSource should be called when a datasource is updated or deleted
+func invalidateCachedDataSource(id int64, orgId int64) {
+	dataSourceCache.Lock()
+	defer dataSourceCache.Unlock()
+
+	delete(dataSourceCache.items, dataSourceCacheKey{id: id, orgId: orgId})
+}
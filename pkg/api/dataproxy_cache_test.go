@@ -0,0 +1,69 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestDataSourceProxyCache(t *testing.T) {
+	Convey("When getting datasources for the proxy", t, func() {
+		bus.ClearBusHandlers()
+		queries := 0
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			queries++
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Name: "ds"}
+			return nil
+		})
+
+		setting.DataProxy().DataSourceCacheTTL = 5
+		invalidateCachedDataSource(1, 1)
+		invalidateCachedDataSource(1, 2)
+
+		Convey("Should only query once within the ttl", func() {
+			getDatasource(1, 1)
+			ds, err := getDatasource(1, 1)
+			So(err, ShouldBeNil)
+			So(ds.Id, ShouldEqual, 1)
+			So(queries, ShouldEqual, 1)
+		})
+
+		Convey("Should keep orgs apart", func() {
+			getDatasource(1, 1)
+			ds, _ := getDatasource(1, 2)
+			So(ds.OrgId, ShouldEqual, 2)
+			So(queries, ShouldEqual, 2)
+		})
+
+		Convey("Should query again after invalidation", func() {
+			getDatasource(1, 1)
+			invalidateCachedDataSource(1, 1)
+			getDatasource(1, 1)
+			So(queries, ShouldEqual, 2)
+		})
+
+		Convey("Should query again after expiry", func() {
+			cacheDataSource(&m.DataSource{Id: 1, OrgId: 1}, -time.Second)
+			getDatasource(1, 1)
+			So(queries, ShouldEqual, 1)
+		})
+
+		Convey("Should not cache when disabled", func() {
+			setting.DataProxy().DataSourceCacheTTL = 0
+			getDatasource(1, 1)
+			getDatasource(1, 1)
+			So(queries, ShouldEqual, 2)
+		})
+
+		Reset(func() {
+			setting.DataProxy().DataSourceCacheTTL = 5
+			invalidateCachedDataSource(1, 1)
+			invalidateCachedDataSource(1, 2)
+		})
+	})
+}
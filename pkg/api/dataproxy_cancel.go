@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/events"
+)
+
+// proxyDataSourceWatch cancels a proxied request when its datasource is
+// updated or deleted, so it does not keep running with the old credentials
+type proxyDataSourceWatch struct {
+	cancel  context.CancelFunc
+	changed int32
+}
+
+var proxyRequests = struct {
+	sync.Mutex
+	watches map[int64]map[*proxyDataSourceWatch]bool
+}{watches: make(map[int64]map[*proxyDataSourceWatch]bool)}
+
+type proxyDataSourceWatchKey struct{}
+
+// watchProxyDataSource tracks the request as in flight for the datasource
+// until the returned func is called
+func watchProxyDataSource(req *http.Request, dsId int64) (*http.Request, func()) {
+	ctx, cancel := context.WithCancel(req.Context())
+	watch := &proxyDataSourceWatch{cancel: cancel}
+
+	proxyRequests.Lock()
+	if proxyRequests.watches[dsId] == nil {
+		proxyRequests.watches[dsId] = make(map[*proxyDataSourceWatch]bool)
+	}
+	proxyRequests.watches[dsId][watch] = true
+	proxyRequests.Unlock()
+
+	ctx = context.WithValue(ctx, proxyDataSourceWatchKey{}, watch)
+	return req.WithContext(ctx), func() {
+		proxyRequests.Lock()
+		delete(proxyRequests.watches[dsId], watch)
+		if len(proxyRequests.watches[dsId]) == 0 {
+			delete(proxyRequests.watches, dsId)
+		}
+		proxyRequests.Unlock()
+		cancel()
+	}
+}
+
+// cancelProxyRequests cancels the in-flight requests of a datasource
+func cancelProxyRequests(dsId int64) {
+	proxyRequests.Lock()
+	defer proxyRequests.Unlock()
+
+	for watch := range proxyRequests.watches[dsId] {
+		atomic.StoreInt32(&watch.changed, 1)
+		watch.cancel()
+	}
+}
+
+// isProxyDataSourceChanged reports whether req was canceled because its
+// datasource was updated or deleted
+func isProxyDataSourceChanged(req *http.Request) bool {
+	watch, ok := req.Context().Value(proxyDataSourceWatchKey{}).(*proxyDataSourceWatch)
+	return ok && atomic.LoadInt32(&watch.changed) == 1
+}
+
+func onDataSourceUpdated(event *events.DataSourceUpdated) error {
+	invalidateCachedDataSource(event.Id, event.OrgId)
+	cancelProxyRequests(event.Id)
+	return nil
+}
+
+func onDataSourceDeleted(event *events.DataSourceDeleted) error {
+	invalidateCachedDataSource(event.Id, event.OrgId)
+	cancelProxyRequests(event.Id)
+	removeKerberosClient(event.Id)
+	return nil
+}
+
+func registerDataProxyListeners() {
+	bus.AddEventListener(onDataSourceUpdated)
+	bus.AddEventListener(onDataSourceDeleted)
+}
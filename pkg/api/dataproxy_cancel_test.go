@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/events"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func TestDataSourceProxyCancel(t *testing.T) {
+	Convey("When a datasource changes while a request is proxied to it", t, func() {
+		received := make(chan bool, 1)
+		release := make(chan bool)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received <- true
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+		}))
+		defer backend.Close()
+		defer close(release)
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		registerDataProxyListeners()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: simplejson.New()}
+			return nil
+		})
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+		proxied := func(dsId string) chan *httptest.ResponseRecorder {
+			done := make(chan *httptest.ResponseRecorder, 1)
+			go func() {
+				done <- proxyHandlerRequest(user, "GET", "/api/datasources/proxy/"+dsId+"/api/v1/query")
+			}()
+			<-received
+			return done
+		}
+
+		Convey("Should cancel it when the datasource is updated", func() {
+			done := proxied("407")
+			bus.Publish(&events.DataSourceUpdated{Id: 407, OrgId: 1})
+
+			resp := <-done
+			So(resp.Code, ShouldEqual, 503)
+			So(decodeProxyError(resp), ShouldEqual, "Datasource was changed while the request was running")
+		})
+
+		Convey("Should cancel it when the datasource is deleted", func() {
+			done := proxied("408")
+			bus.Publish(&events.DataSourceDeleted{Id: 408, OrgId: 1})
+
+			So((<-done).Code, ShouldEqual, 503)
+		})
+
+		Convey("Should not cancel the requests of other datasources", func() {
+			done := proxied("409")
+			bus.Publish(&events.DataSourceUpdated{Id: 410, OrgId: 1})
+
+			select {
+			case <-done:
+				So("request was canceled", ShouldBeEmpty)
+			case <-time.After(50 * time.Millisecond):
+			}
+			cancelProxyRequests(409)
+			<-done
+		})
+
+		Convey("Should stop tracking finished requests", func() {
+			done := proxied("411")
+			release <- true
+			So((<-done).Code, ShouldEqual, 200)
+
+			proxyRequests.Lock()
+			_, tracked := proxyRequests.watches[411]
+			proxyRequests.Unlock()
+			So(tracked, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+// getProxyAllowedContentTypes returns the allowedContentTypes json data
+// option, media types like application/json or image/* the responses of the
+// datasource may have. Without it all responses are passed on
+func getProxyAllowedContentTypes(ds *m.DataSource) []string {
+	if ds.JsonData == nil {
+		return nil
+	}
+
+	var contentTypes []string
+	for _, contentType := range ds.JsonData.Get("allowedContentTypes").MustStringArray() {
+		if contentType = strings.ToLower(strings.TrimSpace(contentType)); contentType != "" {
+			contentTypes = append(contentTypes, contentType)
+		}
+	}
+	return contentTypes
+}
+
+// proxyContentTypeTransport answers responses of other content types with a
+// 502, so a backend can not have html or scripts rendered in the origin of
+// Grafana. Responses without a body have nothing to check
+type proxyContentTypeTransport struct {
+	transport    http.RoundTripper
+	datasource   string
+	contentTypes []string
+}
+
+func (t *proxyContentTypeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || !hasProxyResponseBody(req, resp) {
+		return resp, err
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if isProxyContentTypeAllowed(contentType, t.contentTypes) {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	dataproxyLogger.Warn("Proxy response content type not allowed", "url", redactUrl(req.URL), "requestId", req.Header.Get("X-Request-ID"), "contentType", contentType)
+	return newProxyJsonResponse(req, 502, util.DynMap{
+		"message":    fmt.Sprintf("Datasource responded with content type %q, which is not in allowedContentTypes", contentType),
+		"datasource": t.datasource,
+	}), nil
+}
+
+func hasProxyResponseBody(req *http.Request, resp *http.Response) bool {
+	if req.Method == "HEAD" || resp.ContentLength == 0 {
+		return false
+	}
+	return resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+}
+
+// isProxyContentTypeAllowed matches the media type of contentType, without
+// its parameters. A missing content type is not allowed, browsers would sniff it
+func isProxyContentTypeAllowed(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range allowed {
+		if pattern == mediaType || pattern == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
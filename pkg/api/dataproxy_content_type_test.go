@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func TestDataSourceProxyContentType(t *testing.T) {
+	Convey("When a datasource restricts the content types of its responses", t, func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/v1/query":
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.Write([]byte(`{"status":"success"}`))
+			case "/graph":
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte("<script>alert(1)</script>"))
+			case "/empty":
+				w.WriteHeader(204)
+			}
+		}))
+		defer backend.Close()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			json := simplejson.New()
+			if query.Id == 440 {
+				json.Set("allowedContentTypes", []interface{}{"application/json", "image/*"})
+			}
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Name: "prometheus", Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: json}
+			return nil
+		})
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+
+		Convey("Should pass allowed responses on", func() {
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/440/api/v1/query")
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldEqual, `{"status":"success"}`)
+		})
+
+		Convey("Should answer other content types with 502", func() {
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/440/graph")
+			So(resp.Code, ShouldEqual, 502)
+			So(resp.Header().Get("Content-Type"), ShouldEqual, "application/json")
+			So(decodeProxyError(resp), ShouldContainSubstring, `"text/html"`)
+			So(resp.Body.String(), ShouldNotContainSubstring, "<script>")
+		})
+
+		Convey("Should pass responses without a body on", func() {
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/440/empty")
+			So(resp.Code, ShouldEqual, 204)
+		})
+
+		Convey("Should allow all content types by default", func() {
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/441/graph")
+			So(resp.Code, ShouldEqual, 200)
+		})
+	})
+
+	Convey("When matching response content types", t, func() {
+		allowed := []string{"application/json", "image/*"}
+		So(isProxyContentTypeAllowed("Application/JSON; charset=utf-8", allowed), ShouldBeTrue)
+		So(isProxyContentTypeAllowed("image/png", allowed), ShouldBeTrue)
+		So(isProxyContentTypeAllowed("text/html", allowed), ShouldBeFalse)
+		So(isProxyContentTypeAllowed("imagex/png", allowed), ShouldBeFalse)
+		So(isProxyContentTypeAllowed("", allowed), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// bodies are logged up to this many bytes
+const proxyDebugBodyLimit = 1024
+
+// headers that carry credentials, their values are never logged
+var proxyDebugRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"X-Auth-Token",
+	"X-DS-Authorization",
+	"X-Amz-Security-Token",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// debug logging needs the server setting and the debugLogging json data option
+// of the datasource, so it is never on by accident
+func usesProxyDebugLogging(ds *m.DataSource) bool {
+	return setting.DataProxy().DebugLogging && ds.JsonData != nil && ds.JsonData.Get("debugLogging").MustBool(false)
+}
+
+// proxyDebugTransport logs the requests sent to the backend and its responses.
+// Bodies are logged once the first proxyDebugBodyLimit bytes have been read,
+// or when they end, so streamed bodies are not held back
+type proxyDebugTransport struct {
+	transport     http.RoundTripper
+	datasource    string
+	secretHeaders map[string]bool
+	secretParams  map[string]bool
+}
+
+func newProxyDebugTransport(ds *m.DataSource, transport http.RoundTripper) *proxyDebugTransport {
+	t := &proxyDebugTransport{
+		transport:     transport,
+		datasource:    ds.Name,
+		secretHeaders: make(map[string]bool),
+		secretParams:  make(map[string]bool),
+	}
+
+	for _, name := range proxyDebugRedactedHeaders {
+		t.secretHeaders[name] = true
+	}
+	// the values of custom headers are stored encrypted
+	for name := range getCustomHeaders(ds.JsonData, ds.SecureJsonData) {
+		t.secretHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+	if name := getProxyQueryParamName(ds); name != "" {
+		t.secretParams[name] = true
+	}
+
+	return t
+}
+
+func (t *proxyDebugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	requestId := req.Header.Get("X-Request-ID")
+	reqUrl := t.redactUrl(req.URL)
+	dataproxyLogger.Debug("Proxy debug request", "datasource", t.datasource, "requestId", requestId,
+		"method", req.Method, "url", reqUrl, "headers", t.redactHeaders(req.Header))
+
+	if req.Body != nil {
+		outreq := cloneProxyRequest(req)
+		outreq.Body = newProxyDebugBody(req.Body, func(body string, truncated bool) {
+			dataproxyLogger.Debug("Proxy debug request body", "datasource", t.datasource, "requestId", requestId,
+				"body", body, "truncated", truncated)
+		})
+		req = outreq
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		dataproxyLogger.Debug("Proxy debug request failed", "datasource", t.datasource, "requestId", requestId, "error", err)
+		return nil, err
+	}
+
+	dataproxyLogger.Debug("Proxy debug response", "datasource", t.datasource, "requestId", requestId,
+		"url", reqUrl, "status", resp.StatusCode, "headers", t.redactHeaders(resp.Header))
+	resp.Body = newProxyDebugBody(resp.Body, func(body string, truncated bool) {
+		dataproxyLogger.Debug("Proxy debug response body", "datasource", t.datasource, "requestId", requestId,
+			"body", body, "truncated", truncated)
+	})
+
+	return resp, nil
+}
+
+func (t *proxyDebugTransport) redactHeaders(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for name, values := range header {
+		if t.secretHeaders[http.CanonicalHeaderKey(name)] {
+			redacted[name] = []string{"-redacted-"}
+		} else {
+			redacted[name] = values
+		}
+	}
+	return redacted
+}
+
+// redactUrl hides the secret query parameter of the datasource as well as the
+// parameters redactUrl always hides
+func (t *proxyDebugTransport) redactUrl(u *url.URL) string {
+	if len(t.secretParams) == 0 || u.RawQuery == "" {
+		return redactUrl(u)
+	}
+
+	redacted := *u
+	var params []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		name := param
+		if i := strings.Index(param, "="); i >= 0 {
+			name = param[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil && t.secretParams[unescaped] {
+			param = name + "=-redacted-"
+		}
+		params = append(params, param)
+	}
+	redacted.RawQuery = strings.Join(params, "&")
+
+	return redactUrl(&redacted)
+}
+
+// proxyDebugBody keeps the start of the body it reads and logs it once, the
+// transport can close the body while another goroutine reads it
+type proxyDebugBody struct {
+	io.ReadCloser
+	log func(body string, truncated bool)
+
+	mu     sync.Mutex
+	prefix bytes.Buffer
+	more   bool
+	logged bool
+}
+
+func newProxyDebugBody(body io.ReadCloser, log func(body string, truncated bool)) *proxyDebugBody {
+	return &proxyDebugBody{ReadCloser: body, log: log}
+}
+
+func (b *proxyDebugBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	if room := proxyDebugBodyLimit - b.prefix.Len(); n > room {
+		b.prefix.Write(p[:room])
+		b.more = true
+	} else {
+		b.prefix.Write(p[:n])
+	}
+	done := b.more || err != nil
+	b.mu.Unlock()
+
+	if done {
+		b.flush()
+	}
+	return n, err
+}
+
+func (b *proxyDebugBody) Close() error {
+	b.flush()
+	return b.ReadCloser.Close()
+}
+
+func (b *proxyDebugBody) flush() {
+	b.mu.Lock()
+	if b.logged {
+		b.mu.Unlock()
+		return
+	}
+	b.logged = true
+	body, truncated := b.prefix.String(), b.more
+	b.mu.Unlock()
+
+	b.log(body, truncated)
+}
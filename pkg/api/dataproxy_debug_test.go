@@ -0,0 +1,82 @@
+package api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/inconshreveable/log15"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/components/securejsondata"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestDataSourceProxyDebugLogging(t *testing.T) {
+	Convey("When debug logging proxied requests", t, func() {
+		setting.SecretKey = "password"
+
+		var logged bytes.Buffer
+		handler := dataproxyLogger.GetHandler()
+		dataproxyLogger.SetHandler(log15.StreamHandler(&logged, log15.LogfmtFormat()))
+		defer dataproxyLogger.SetHandler(handler)
+
+		json := simplejson.New()
+		json.Set("debugLogging", true)
+		json.Set("httpHeaderName1", "X-Api-Key")
+		json.Set("httpQueryParamName", "apiToken")
+		ds := &m.DataSource{
+			Name:           "debugged",
+			JsonData:       json,
+			SecureJsonData: securejsondata.GetEncryptedJsonData(map[string]string{"httpHeaderValue1": "header-secret"}),
+		}
+
+		backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			body := strings.Repeat("x", proxyDebugBodyLimit+10)
+			return &http.Response{StatusCode: 200, Header: http.Header{"Set-Cookie": {"session=secret"}}, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+		})
+
+		send := func() {
+			req, _ := http.NewRequest("POST", "http://backend/api/query?apiToken=param-secret&q=1", strings.NewReader(`{"query":"up"}`))
+			req.Header.Set("Authorization", "Bearer bearer-secret")
+			req.Header.Set("X-Api-Key", "header-secret")
+
+			resp, err := newProxyDebugTransport(ds, backend).RoundTrip(req)
+			So(err, ShouldBeNil)
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		Convey("Should log requests, responses and truncated bodies", func() {
+			send()
+			So(logged.String(), ShouldContainSubstring, "Proxy debug request")
+			So(logged.String(), ShouldContainSubstring, `{\"query\":\"up\"}`)
+			So(logged.String(), ShouldContainSubstring, "status=200")
+			So(logged.String(), ShouldContainSubstring, "truncated=true")
+			So(logged.String(), ShouldNotContainSubstring, strings.Repeat("x", proxyDebugBodyLimit+1))
+		})
+
+		Convey("Should never log secrets", func() {
+			send()
+			So(logged.String(), ShouldNotContainSubstring, "bearer-secret")
+			So(logged.String(), ShouldNotContainSubstring, "header-secret")
+			So(logged.String(), ShouldNotContainSubstring, "param-secret")
+			So(logged.String(), ShouldNotContainSubstring, "session=secret")
+		})
+
+		Convey("Should only be enabled with the server setting", func() {
+			So(usesProxyDebugLogging(ds), ShouldBeFalse)
+
+			setting.DataProxy().DebugLogging = true
+			defer func() { setting.DataProxy().DebugLogging = false }()
+			So(usesProxyDebugLogging(ds), ShouldBeTrue)
+			So(usesProxyDebugLogging(&m.DataSource{JsonData: simplejson.New()}), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+// requests with this header set to true are answered with the request the
+// proxy would send to the datasource, for admins debugging auth and url
+// rewriting
+const proxyDryRunHeader = "X-Grafana-Proxy-Dry-Run"
+
+func isProxyDryRun(req *http.Request) bool {
+	return req.Header.Get(proxyDryRunHeader) == "true"
+}
+
+// proxyDryRunTransport takes the place of the transport of the datasource. The
+// credentials in the request are redacted like in the debug log, the body is
+// not sent back
+type proxyDryRunTransport struct {
+	redactor *proxyDebugTransport
+}
+
+func newProxyDryRunTransport(ds *m.DataSource) *proxyDryRunTransport {
+	return &proxyDryRunTransport{redactor: newProxyDebugTransport(ds, nil)}
+}
+
+func (t *proxyDryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	closeRequestBody(req)
+
+	content := util.DynMap{
+		"method":        req.Method,
+		"url":           t.redactor.redactUrl(req.URL),
+		"headers":       t.redactor.redactHeaders(req.Header),
+		"contentLength": req.ContentLength,
+	}
+	if req.Host != "" && req.Host != req.URL.Host {
+		content["host"] = req.Host
+	}
+
+	return newProxyJsonResponse(req, 200, content), nil
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func TestDataSourceProxyDryRun(t *testing.T) {
+	Convey("When a proxied request is a dry run", t, func() {
+		backendRequests := 0
+		var dryRunHeader string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendRequests++
+			dryRunHeader = r.Header.Get(proxyDryRunHeader)
+		}))
+		defer backend.Close()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{
+				Id:                query.Id,
+				OrgId:             query.OrgId,
+				Type:              m.DS_PROMETHEUS,
+				Url:               backend.URL + "/prometheus",
+				BasicAuth:         true,
+				BasicAuthUser:     "user",
+				BasicAuthPassword: "password",
+				JsonData:          simplejson.NewFromAny(map[string]interface{}{"routePath": "/tenant-1"}),
+			}
+			return nil
+		})
+
+		dryRun := func(user *m.SignedInUser) *httptest.ResponseRecorder {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/datasources/proxy/390/api/v1/query?query=up", nil)
+			req.Header.Set(proxyDryRunHeader, "true")
+			proxyHandler(user).ServeHTTP(resp, req)
+			return resp
+		}
+
+		Convey("Should return the outbound request without sending it", func() {
+			resp := dryRun(&m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_ADMIN})
+			So(resp.Code, ShouldEqual, 200)
+			So(backendRequests, ShouldEqual, 0)
+
+			var outbound struct {
+				Method  string
+				Url     string
+				Headers http.Header
+			}
+			So(json.Unmarshal(resp.Body.Bytes(), &outbound), ShouldBeNil)
+			So(outbound.Method, ShouldEqual, "GET")
+			So(outbound.Url, ShouldEqual, backend.URL+"/prometheus/tenant-1/api/v1/query?query=up")
+			So(outbound.Headers.Get("Authorization"), ShouldEqual, "-redacted-")
+			So(outbound.Headers.Get(proxyDryRunHeader), ShouldEqual, "")
+		})
+
+		Convey("Should deny dry runs of users that are not admins", func() {
+			resp := dryRun(&m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_EDITOR})
+			So(resp.Code, ShouldEqual, 403)
+			So(backendRequests, ShouldEqual, 0)
+		})
+
+		Convey("Should not pass the header on", func() {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/datasources/proxy/391/api/v1/query", nil)
+			req.Header.Set(proxyDryRunHeader, "false")
+			proxyHandler(&m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_ADMIN}).ServeHTTP(resp, req)
+
+			So(resp.Code, ShouldEqual, 200)
+			So(backendRequests, ShouldEqual, 1)
+			So(dryRunHeader, ShouldEqual, "")
+		})
+	})
+}
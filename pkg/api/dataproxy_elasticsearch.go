@@ -0,0 +1,233 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+// getElasticsearchIndexPattern returns the allowedIndexPattern json data
+// option, a regular expression every index queried through the proxy has to
+// match in full. Nil without the option
+func getElasticsearchIndexPattern(ds *m.DataSource) (*regexp.Regexp, error) {
+	if ds.JsonData == nil {
+		return nil, nil
+	}
+	pattern := ds.JsonData.Get("allowedIndexPattern").MustString()
+	if pattern == "" {
+		return nil, nil
+	}
+
+	compiled, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid allowedIndexPattern %q: %v", pattern, err)
+	}
+	return compiled, nil
+}
+
+// the endpoints that name indices in their body as well as in the path
+var elasticsearchBodyEndpoints = map[string]bool{"_msearch": true, "_mget": true, "_mtermvectors": true, "_bulk": true}
+
+// checkElasticsearchIndices checks the indices of a proxied request against
+// pattern. The index is the first segment of the path, the _msearch, _mget,
+// _mtermvectors and _bulk endpoints name indices in their body as well, with
+// the index of the path as the default. Other paths without an index like
+// _search or _cat reach all indices and are rejected
+func checkElasticsearchIndices(req *http.Request, proxyPath string, pattern *regexp.Regexp) error {
+	// the backend resolves dot segments, so they are resolved before checking
+	cleanPath := strings.TrimPrefix(path.Clean("/"+proxyPath), "/")
+	segments := strings.Split(cleanPath, "/")
+
+	endpoint := ""
+	for _, segment := range segments {
+		if elasticsearchBodyEndpoints[segment] {
+			endpoint = segment
+			break
+		}
+	}
+
+	index := segments[0]
+	hasIndex := index != "" && !strings.HasPrefix(index, "_")
+	if hasIndex {
+		if err := checkElasticsearchIndexNames(index, pattern); err != nil {
+			return err
+		}
+	} else if endpoint == "" {
+		return fmt.Errorf("Path %s does not name an index allowed on this datasource", proxyPath)
+	}
+
+	if endpoint == "" {
+		return nil
+	}
+	return checkElasticsearchBody(req, endpoint, hasIndex, pattern)
+}
+
+// checkElasticsearchBody reads the body, at most data_proxy_max_request_body
+// bytes, and puts it back for the backend. The body is checked whatever the
+// method, Elasticsearch reads the body of GET requests as well
+func checkElasticsearchBody(req *http.Request, endpoint string, hasIndex bool, pattern *regexp.Regexp) error {
+	if req.Body == nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	switch endpoint {
+	case "_msearch":
+		return checkElasticsearchMultiSearch(body, hasIndex, pattern)
+	case "_bulk":
+		return checkElasticsearchBulk(body, hasIndex, pattern)
+	default:
+		return checkElasticsearchDocs(body, endpoint, hasIndex, pattern)
+	}
+}
+
+func checkElasticsearchMultiSearch(body []byte, hasIndex bool, pattern *regexp.Regexp) error {
+	// the lines alternate between the header and the body of a search
+	header := true
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if header {
+			if err := checkElasticsearchSearchHeader(line, hasIndex, pattern); err != nil {
+				return err
+			}
+		}
+		header = !header
+	}
+	return nil
+}
+
+// checkElasticsearchSearchHeader checks the index and indices options of a
+// search header, Elasticsearch accepts both
+func checkElasticsearchSearchHeader(line []byte, hasIndex bool, pattern *regexp.Regexp) error {
+	var header struct {
+		Index   interface{} `json:"index"`
+		Indices interface{} `json:"indices"`
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return fmt.Errorf("Invalid search header in _msearch body: %v", err)
+	}
+
+	named := false
+	for _, option := range []interface{}{header.Index, header.Indices} {
+		var names []interface{}
+		switch index := option.(type) {
+		case nil:
+		case string:
+			if index != "" {
+				names = []interface{}{index}
+			}
+		case []interface{}:
+			names = index
+		default:
+			return fmt.Errorf("Invalid index %v in _msearch body", index)
+		}
+
+		for _, name := range names {
+			nameString, ok := name.(string)
+			if !ok {
+				return fmt.Errorf("Invalid index %v in _msearch body", name)
+			}
+			if err := checkElasticsearchIndexNames(nameString, pattern); err != nil {
+				return err
+			}
+			named = true
+		}
+	}
+
+	if !named && !hasIndex {
+		return fmt.Errorf("Searches in _msearch have to name an index allowed on this datasource")
+	}
+	return nil
+}
+
+// checkElasticsearchBulk checks the action lines of a _bulk body, every action
+// but delete is followed by a line with the document
+func checkElasticsearchBulk(body []byte, hasIndex bool, pattern *regexp.Regexp) error {
+	action := true
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if !action {
+			action = true
+			continue
+		}
+
+		var actions map[string]struct {
+			Index *string `json:"_index"`
+		}
+		if err := json.Unmarshal(line, &actions); err != nil || len(actions) != 1 {
+			return fmt.Errorf("Invalid action in _bulk body")
+		}
+		for name, meta := range actions {
+			if err := checkElasticsearchBodyIndex(meta.Index, "_bulk", hasIndex, pattern); err != nil {
+				return err
+			}
+			action = name == "delete"
+		}
+	}
+	return nil
+}
+
+// checkElasticsearchDocs checks the documents of a _mget or _mtermvectors
+// body, the ids option only names documents of the index of the path
+func checkElasticsearchDocs(body []byte, endpoint string, hasIndex bool, pattern *regexp.Regexp) error {
+	var request struct {
+		Docs []struct {
+			Index *string `json:"_index"`
+		} `json:"docs"`
+		Ids []interface{} `json:"ids"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return fmt.Errorf("Invalid %s body: %v", endpoint, err)
+	}
+
+	if len(request.Ids) > 0 && !hasIndex {
+		return fmt.Errorf("Documents in %s have to name an index allowed on this datasource", endpoint)
+	}
+	for _, doc := range request.Docs {
+		if err := checkElasticsearchBodyIndex(doc.Index, endpoint, hasIndex, pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkElasticsearchBodyIndex(index *string, endpoint string, hasIndex bool, pattern *regexp.Regexp) error {
+	if index != nil && *index != "" {
+		return checkElasticsearchIndexNames(*index, pattern)
+	}
+	if !hasIndex {
+		return fmt.Errorf("Documents in %s have to name an index allowed on this datasource", endpoint)
+	}
+	return nil
+}
+
+// checkElasticsearchIndexNames checks a comma separated list of indices
+func checkElasticsearchIndexNames(indices string, pattern *regexp.Regexp) error {
+	for _, index := range strings.Split(indices, ",") {
+		if !pattern.MatchString(index) {
+			return fmt.Errorf("Index %s is not allowed on this datasource", index)
+		}
+	}
+	return nil
+}
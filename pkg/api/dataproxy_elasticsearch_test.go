@@ -0,0 +1,120 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func TestDataSourceProxyElasticsearchIndices(t *testing.T) {
+	Convey("When an Elasticsearch datasource is locked to indices", t, func() {
+		var backendPath, backendBody string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			backendPath, backendBody = r.URL.Path, string(body)
+		}))
+		defer backend.Close()
+
+		pattern := "logstash-[0-9.]+"
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			json := simplejson.NewFromAny(map[string]interface{}{"allowedIndexPattern": pattern})
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_ES, Url: backend.URL, JsonData: json}
+			return nil
+		})
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+		send := func(method string, path string, body string) *httptest.ResponseRecorder {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, "/api/datasources/proxy/380/"+path, strings.NewReader(body))
+			proxyHandler(user).ServeHTTP(resp, req)
+			return resp
+		}
+		msearch := func(body string) *httptest.ResponseRecorder {
+			return send("POST", "_msearch", body)
+		}
+
+		Convey("Should allow the indices matching the pattern", func() {
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/380/logstash-2017.05.01,logstash-2017.05.02/_mapping")
+			So(resp.Code, ShouldEqual, 200)
+			So(backendPath, ShouldEqual, "/logstash-2017.05.01,logstash-2017.05.02/_mapping")
+		})
+
+		Convey("Should deny other indices", func() {
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/380/logstash-2017.05.01,.kibana/_mapping")
+			So(resp.Code, ShouldEqual, 403)
+		})
+
+		Convey("Should deny paths without an index", func() {
+			So(proxyHandlerRequest(user, "GET", "/api/datasources/proxy/380/_search").Code, ShouldEqual, 403)
+			So(proxyHandlerRequest(user, "GET", "/api/datasources/proxy/380/logstash-1/../_cat/indices").Code, ShouldEqual, 403)
+		})
+
+		Convey("Should pass on searches of allowed indices", func() {
+			body := "{\"index\":[\"logstash-2017.05.01\"],\"search_type\":\"query_then_fetch\"}\n{\"size\":0}\n" +
+				"{\"index\":\"logstash-2017.05.02\"}\n{\"size\":0}\n"
+			resp := msearch(body)
+			So(resp.Code, ShouldEqual, 200)
+			So(backendBody, ShouldEqual, body)
+		})
+
+		Convey("Should deny searches of other indices", func() {
+			resp := msearch("{\"index\":\"logstash-2017.05.01\"}\n{}\n{\"index\":\"secrets\"}\n{}\n")
+			So(resp.Code, ShouldEqual, 403)
+			So(backendBody, ShouldEqual, "")
+		})
+
+		Convey("Should deny searches without an index", func() {
+			So(msearch("{\"search_type\":\"query_then_fetch\"}\n{}\n").Code, ShouldEqual, 403)
+		})
+
+		Convey("Should check the searches sent to the _msearch of an index", func() {
+			So(send("POST", "logstash-2017.05.01/_msearch", "{\"index\":\"secrets\"}\n{}\n").Code, ShouldEqual, 403)
+
+			resp := send("GET", "logstash-2017.05.01/_msearch", "{\"index\":\"secrets\"}\n{}\n")
+			So(resp.Code, ShouldEqual, 403)
+			So(backendBody, ShouldEqual, "")
+
+			So(send("GET", "logstash-2017.05.01/_msearch", "{\"indices\":[\"secrets\"]}\n{}\n").Code, ShouldEqual, 403)
+
+			body := "{}\n{}\n{\"index\":\"logstash-2017.05.02\"}\n{}\n"
+			resp = send("GET", "logstash-2017.05.01/_msearch", body)
+			So(resp.Code, ShouldEqual, 200)
+			So(backendBody, ShouldEqual, body)
+		})
+
+		Convey("Should check the documents of _mget", func() {
+			resp := send("GET", "logstash-2017.05.01/_mget", `{"docs":[{"_index":"secrets","_id":"1"}]}`)
+			So(resp.Code, ShouldEqual, 403)
+			So(backendBody, ShouldEqual, "")
+
+			So(send("GET", "_mget", `{"docs":[{"_id":"1"}]}`).Code, ShouldEqual, 403)
+			So(send("GET", "_mget", `{"ids":["1"]}`).Code, ShouldEqual, 403)
+
+			body := `{"docs":[{"_index":"logstash-2017.05.02","_id":"1"},{"_id":"2"}]}`
+			resp = send("GET", "logstash-2017.05.01/_mget", body)
+			So(resp.Code, ShouldEqual, 200)
+			So(backendBody, ShouldEqual, body)
+		})
+
+		Convey("Should check the actions of _bulk", func() {
+			So(send("GET", "logstash-2017.05.01/_bulk", "{\"delete\":{\"_id\":\"1\"}}\n{\"index\":{\"_index\":\"secrets\"}}\n{}\n").Code, ShouldEqual, 403)
+			So(send("GET", "_bulk", "{\"index\":{}}\n{}\n").Code, ShouldEqual, 403)
+			So(send("GET", "_bulk", "{\"index\":{\"_index\":\"logstash-2017.05.01\"}}\n{\"index\":{\"_index\":\"secrets\"}}\n").Code, ShouldEqual, 200)
+		})
+
+		Convey("Should reject an invalid pattern", func() {
+			pattern = "logstash-("
+			So(proxyHandlerRequest(user, "GET", "/api/datasources/proxy/381/logstash-1/_mapping").Code, ShouldEqual, 400)
+		})
+	})
+}
@@ -0,0 +1,323 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+// getProxyBackupUrls returns the urls json data option, the urls tried in
+// order when the datasource url can not be reached. Unix socket datasources
+// have no backup urls
+func getProxyBackupUrls(ds *m.DataSource) ([]*url.URL, error) {
+	if ds.JsonData == nil || ds.UnixSocketPath() != "" {
+		return nil, nil
+	}
+
+	var backupUrls []*url.URL
+	for _, rawUrl := range ds.JsonData.Get("urls").MustStringArray() {
+		if rawUrl == "" || rawUrl == ds.Url {
+			continue
+		}
+		if strings.HasPrefix(rawUrl, m.UnixSocketUrlPrefix) {
+			return nil, fmt.Errorf("Invalid backup url %q: unix sockets can not be backup urls", rawUrl)
+		}
+
+		backupUrl, err := parseDataSourceUrl(rawUrl)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid backup url %q: %v", rawUrl, err)
+		}
+		backupUrls = append(backupUrls, backupUrl)
+	}
+
+	return backupUrls, nil
+}
+
+// getProxyFailoverTargets returns the datasource url followed by its backup
+// urls, invalid urls are rejected by ProxyDataSourceRequest before
+func getProxyFailoverTargets(ds *m.DataSource) []*url.URL {
+	primary, err := parseDataSourceUrl(ds.Url)
+	if err != nil {
+		return nil
+	}
+	backupUrls, err := getProxyBackupUrls(ds)
+	if err != nil {
+		return nil
+	}
+	return append([]*url.URL{primary}, backupUrls...)
+}
+
+// proxyUrlRetryInterval is how long a url that could not be reached is only
+// tried after the other urls of the datasource
+const proxyUrlRetryInterval = 30 * time.Second
+
+// proxyUrlState is the health and the number of requests in flight of one url
+// of a datasource
+type proxyUrlState struct {
+	inFlight  int
+	downUntil time.Time
+}
+
+// proxyBalancerState is kept by datasource id, transports of a datasource are
+// rebuilt when it is updated but its urls keep their state
+type proxyBalancerState struct {
+	// the last url that answered
+	healthy string
+	// the round robin position
+	next int
+	urls map[string]*proxyUrlState
+}
+
+var proxyBalancers = struct {
+	sync.Mutex
+	m map[int64]*proxyBalancerState
+}{m: make(map[int64]*proxyBalancerState)}
+
+// getProxyBalancerState must be called with proxyBalancers locked
+func getProxyBalancerState(dsId int64) *proxyBalancerState {
+	state, ok := proxyBalancers.m[dsId]
+	if !ok {
+		state = &proxyBalancerState{urls: make(map[string]*proxyUrlState)}
+		proxyBalancers.m[dsId] = state
+	}
+	return state
+}
+
+func (state *proxyBalancerState) url(target *url.URL) *proxyUrlState {
+	urlState, ok := state.urls[target.String()]
+	if !ok {
+		urlState = &proxyUrlState{}
+		state.urls[target.String()] = urlState
+	}
+	return urlState
+}
+
+// getProxyLoadBalance returns the loadBalance json data option, how requests
+// are spread over the urls of the datasource: "round-robin" or
+// "least-connections". By default the urls are only failed over to
+func getProxyLoadBalance(ds *m.DataSource) string {
+	if ds.JsonData == nil {
+		return ""
+	}
+	switch strategy := ds.JsonData.Get("loadBalance").MustString(); strategy {
+	case "round-robin", "least-connections":
+		return strategy
+	default:
+		return ""
+	}
+}
+
+// usesProxyStickySessions reports whether the requests of a session stay on the
+// same url while it is healthy, with the loadBalanceSticky json data option.
+// The caches of the backend replicas stay warm for the dashboards of a user
+func usesProxyStickySessions(ds *m.DataSource) bool {
+	return ds.JsonData != nil && ds.JsonData.Get("loadBalanceSticky").MustBool(false)
+}
+
+type proxyStickyKey struct{}
+
+// withProxyStickyKey sets the key requests are kept on the same url of the
+// datasource by
+func withProxyStickyKey(req *http.Request, key string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), proxyStickyKey{}, key))
+}
+
+func getProxyStickyKey(req *http.Request) string {
+	key, _ := req.Context().Value(proxyStickyKey{}).(string)
+	return key
+}
+
+// proxyFailoverTransport sends the request to the next url of the datasource
+// when connecting to a url fails. Only connection errors fail over, the
+// request never reached that backend. It is above the redirect round tripper,
+// which follows redirects on the url that answered
+type proxyFailoverTransport struct {
+	transport http.RoundTripper
+	dsId      int64
+	// the datasource url first, then the backup urls
+	targets []*url.URL
+	// the loadBalance strategy, empty to fail over only
+	loadBalance string
+	sticky      bool
+}
+
+func (t *proxyFailoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	primary := t.targets[0]
+	if req.URL.Scheme != primary.Scheme || req.URL.Host != primary.Host {
+		return t.transport.RoundTrip(req)
+	}
+
+	// the body is kept for the next url, its size is limited by
+	// data_proxy_max_request_body
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var lastErr error
+	for _, target := range t.orderedTargets(req) {
+		outreq := cloneProxyRequest(req)
+		outreq.URL = getFailoverUrl(req.URL, primary, target)
+		if outreq.Host == primary.Host {
+			outreq.Host = target.Host
+		}
+		if body != nil {
+			outreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+			outreq.ContentLength = int64(len(body))
+		}
+
+		t.startRequest(target)
+		resp, err := t.transport.RoundTrip(outreq)
+		if err == nil {
+			t.setHealthy(target)
+			resp.Body = &proxyInFlightBody{ReadCloser: resp.Body, done: func() { t.endRequest(target) }}
+			return resp, nil
+		}
+		t.endRequest(target)
+		if !isProxyConnectError(err) || req.Context().Err() != nil {
+			return nil, err
+		}
+
+		dataproxyLogger.Warn("Datasource url unreachable, trying the next url", "url", redactUrl(target), "error", err)
+		t.setDown(target)
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// orderedTargets returns the urls to try for the request, the one picked by
+// the load balance strategy first. Without a strategy it is the url that
+// answered last. Urls that could not be reached recently come last
+func (t *proxyFailoverTransport) orderedTargets(req *http.Request) []*url.URL {
+	proxyBalancers.Lock()
+	defer proxyBalancers.Unlock()
+	state := getProxyBalancerState(t.dsId)
+
+	now := time.Now()
+	var up, down []*url.URL
+	for _, target := range t.targets {
+		if now.Before(state.url(target).downUntil) {
+			down = append(down, target)
+		} else {
+			up = append(up, target)
+		}
+	}
+	if len(up) == 0 {
+		return down
+	}
+
+	first := 0
+	stickyKey := ""
+	if t.sticky && t.loadBalance != "" {
+		stickyKey = getProxyStickyKey(req)
+	}
+
+	switch {
+	case stickyKey != "":
+		hash := fnv.New32a()
+		hash.Write([]byte(stickyKey))
+		first = int(hash.Sum32() % uint32(len(up)))
+	case t.loadBalance == "round-robin":
+		first = state.next % len(up)
+		state.next = first + 1
+	case t.loadBalance == "least-connections":
+		for i, target := range up {
+			if state.url(target).inFlight < state.url(up[first]).inFlight {
+				first = i
+			}
+		}
+	default:
+		for i, target := range up {
+			if target.String() == state.healthy {
+				first = i
+			}
+		}
+	}
+
+	ordered := make([]*url.URL, 0, len(t.targets))
+	ordered = append(ordered, up[first])
+	ordered = append(ordered, up[:first]...)
+	ordered = append(ordered, up[first+1:]...)
+	return append(ordered, down...)
+}
+
+func (t *proxyFailoverTransport) setHealthy(target *url.URL) {
+	proxyBalancers.Lock()
+	state := getProxyBalancerState(t.dsId)
+	state.healthy = target.String()
+	state.url(target).downUntil = time.Time{}
+	proxyBalancers.Unlock()
+}
+
+func (t *proxyFailoverTransport) setDown(target *url.URL) {
+	proxyBalancers.Lock()
+	getProxyBalancerState(t.dsId).url(target).downUntil = time.Now().Add(proxyUrlRetryInterval)
+	proxyBalancers.Unlock()
+}
+
+func (t *proxyFailoverTransport) startRequest(target *url.URL) {
+	proxyBalancers.Lock()
+	getProxyBalancerState(t.dsId).url(target).inFlight++
+	proxyBalancers.Unlock()
+}
+
+func (t *proxyFailoverTransport) endRequest(target *url.URL) {
+	proxyBalancers.Lock()
+	getProxyBalancerState(t.dsId).url(target).inFlight--
+	proxyBalancers.Unlock()
+}
+
+// proxyInFlightBody counts a request as in flight until its response was read,
+// streamed responses keep the backend busy until then
+type proxyInFlightBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *proxyInFlightBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
+
+// getFailoverUrl moves a url of the datasource url to target, the path of the
+// datasource url is replaced with the one of target
+func getFailoverUrl(reqUrl *url.URL, primary *url.URL, target *url.URL) *url.URL {
+	failoverUrl := *reqUrl
+	failoverUrl.Scheme = target.Scheme
+	failoverUrl.Host = target.Host
+	failoverUrl.RawPath = ""
+
+	prefix := strings.TrimSuffix(primary.Path, "/")
+	if strings.HasPrefix(reqUrl.Path, prefix) {
+		failoverUrl.Path = strings.TrimSuffix(target.Path, "/") + strings.TrimPrefix(reqUrl.Path, prefix)
+	}
+	return &failoverUrl
+}
+
+// isProxyConnectError reports errors of connecting to the backend, before the
+// request was sent
+func isProxyConnectError(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "dial tcp") || strings.Contains(msg, "no such host")
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestDataSourceProxyFailover(t *testing.T) {
+	Convey("When the datasource url can not be reached", t, func() {
+		down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		downUrl := down.URL
+		down.Close()
+
+		var backupPath, backupBody string
+		backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			backupPath, backupBody = r.URL.Path, string(body)
+		}))
+		defer backup.Close()
+
+		urls := []interface{}{backup.URL + "/replica"}
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			json := simplejson.NewFromAny(map[string]interface{}{"urls": urls})
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: downUrl + "/prom", JsonData: json}
+			return nil
+		})
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+
+		Convey("Should send the request to the backup url", func() {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/api/datasources/proxy/360/api/v1/query", strings.NewReader("query=up"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			proxyHandler(user).ServeHTTP(resp, req)
+
+			So(resp.Code, ShouldEqual, 200)
+			So(backupPath, ShouldEqual, "/replica/api/v1/query")
+			So(backupBody, ShouldEqual, "query=up")
+		})
+
+		Convey("Should return 502 when all urls fail", func() {
+			urls = []interface{}{downUrl}
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/361/api/v1/query")
+
+			So(resp.Code, ShouldEqual, 502)
+		})
+
+		Convey("Should check the backup urls against the whitelist", func() {
+			setting.DataProxyWhiteList = map[string]bool{strings.TrimPrefix(downUrl, "http://"): true}
+			defer func() { setting.DataProxyWhiteList = map[string]bool{} }()
+
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/362/api/v1/query")
+			So(resp.Code, ShouldEqual, 403)
+		})
+
+		Convey("Should reject invalid backup urls", func() {
+			urls = []interface{}{"unix:///var/run/prometheus.sock"}
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/363/api/v1/query")
+
+			So(resp.Code, ShouldEqual, 400)
+		})
+	})
+
+	Convey("When ordering the urls of a datasource", t, func() {
+		primary, _ := url.Parse("http://prometheus-a:9090")
+		secondary, _ := url.Parse("http://prometheus-b:9090")
+		third, _ := url.Parse("http://prometheus-c:9090")
+		transport := &proxyFailoverTransport{dsId: 364, targets: []*url.URL{primary, secondary}}
+		req, _ := http.NewRequest("GET", "http://prometheus-a:9090/api/v1/query", nil)
+
+		Convey("Should start with the datasource url", func() {
+			So(transport.orderedTargets(req), ShouldResemble, []*url.URL{primary, secondary})
+		})
+
+		Convey("Should prefer the url that answered last", func() {
+			transport.setHealthy(secondary)
+			So(transport.orderedTargets(req), ShouldResemble, []*url.URL{secondary, primary})
+		})
+
+		Convey("Should try urls that could not be reached last", func() {
+			transport.setDown(primary)
+			So(transport.orderedTargets(req), ShouldResemble, []*url.URL{secondary, primary})
+		})
+
+		Convey("Should take turns with round robin", func() {
+			transport.loadBalance = "round-robin"
+			transport.targets = []*url.URL{primary, secondary, third}
+
+			So(transport.orderedTargets(req)[0], ShouldEqual, primary)
+			So(transport.orderedTargets(req)[0], ShouldEqual, secondary)
+			So(transport.orderedTargets(req)[0], ShouldEqual, third)
+			So(transport.orderedTargets(req)[0], ShouldEqual, primary)
+		})
+
+		Convey("Should pick the url with the fewest requests in flight", func() {
+			transport.loadBalance = "least-connections"
+			transport.startRequest(primary)
+
+			So(transport.orderedTargets(req), ShouldResemble, []*url.URL{secondary, primary})
+			transport.endRequest(primary)
+			So(transport.orderedTargets(req), ShouldResemble, []*url.URL{primary, secondary})
+		})
+
+		Convey("Should keep the requests of a session on the same url", func() {
+			transport.loadBalance = "round-robin"
+			transport.sticky = true
+			transport.targets = []*url.URL{primary, secondary, third}
+			sessionReq := withProxyStickyKey(req, "session-1")
+
+			first := transport.orderedTargets(sessionReq)[0]
+			So(transport.orderedTargets(sessionReq)[0], ShouldEqual, first)
+			So(transport.orderedTargets(sessionReq)[0], ShouldEqual, first)
+
+			Convey("Should move the session when its url is down", func() {
+				transport.setDown(first)
+				So(transport.orderedTargets(sessionReq)[0], ShouldNotEqual, first)
+			})
+		})
+
+		Reset(func() {
+			proxyBalancers.Lock()
+			delete(proxyBalancers.m, 364)
+			proxyBalancers.Unlock()
+		})
+	})
+
+	Convey("When balancing requests over the urls of a datasource", t, func() {
+		hits := map[string]int{}
+		replica := func(name string) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits[name]++
+			}))
+		}
+		a, b := replica("a"), replica("b")
+		defer a.Close()
+		defer b.Close()
+
+		jsonData := map[string]interface{}{"urls": []interface{}{b.URL}, "loadBalance": "round-robin"}
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: a.URL, JsonData: simplejson.NewFromAny(jsonData)}
+			return nil
+		})
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+
+		Convey("Should spread the requests with round robin", func() {
+			handler := proxyHandler(user)
+			for i := 0; i < 4; i++ {
+				resp := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/api/datasources/proxy/365/api/v1/query", nil)
+				handler.ServeHTTP(resp, req)
+				So(resp.Code, ShouldEqual, 200)
+			}
+
+			So(hits["a"], ShouldEqual, 2)
+			So(hits["b"], ShouldEqual, 2)
+		})
+
+		Convey("Should send the requests of a user to one url with sticky sessions", func() {
+			jsonData["loadBalanceSticky"] = true
+			handler := proxyHandler(user)
+			for i := 0; i < 4; i++ {
+				resp := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/api/datasources/proxy/366/api/v1/query", nil)
+				handler.ServeHTTP(resp, req)
+				So(resp.Code, ShouldEqual, 200)
+			}
+
+			So(hits["a"]*hits["b"], ShouldEqual, 0)
+		})
+
+		Convey("Should not count finished requests as in flight", func() {
+			jsonData["loadBalance"] = "least-connections"
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/367/api/v1/query")
+			So(resp.Code, ShouldEqual, 200)
+
+			proxyBalancers.Lock()
+			state := getProxyBalancerState(367)
+			inFlight := state.urls[a.URL].inFlight + state.urls[b.URL].inFlight
+			proxyBalancers.Unlock()
+			So(inFlight, ShouldEqual, 0)
+		})
+	})
+}
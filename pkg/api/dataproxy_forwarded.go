@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// the headers that tell the backend who the client is
+var proxyForwardedHeaders = []string{"X-Forwarded-For", "X-Real-Ip", "Forwarded"}
+
+// usesProxyForwardedFor reports whether the backend learns the ip of the client
+// from X-Forwarded-For and X-Real-IP, with the forwardClientIp json data
+// option. Without it the headers are removed, some backends trust them for
+// access control
+func usesProxyForwardedFor(ds *m.DataSource) bool {
+	return ds.JsonData != nil && ds.JsonData.Get("forwardClientIp").MustBool(false)
+}
+
+// getProxyClientIP returns the ip Grafana logs for the client of req, the
+// address the client connected from. The X-Real-IP header or else the
+// X-Forwarded-For chain name the client only when that address is one of
+// data_proxy_trusted_proxies, clients can set the headers themselves
+func getProxyClientIP(req *http.Request) net.IP {
+	remote := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	ip := parseProxyClientIP(remote)
+	if ip == nil || !isTrustedProxy(ip) {
+		return ip
+	}
+
+	if realIp := parseProxyClientIP(req.Header.Get("X-Real-IP")); realIp != nil {
+		return realIp
+	}
+
+	// X-Forwarded-For lists the proxies after the client, the client is the
+	// last entry that was not added by a trusted proxy
+	var chain []string
+	for _, value := range req.Header["X-Forwarded-For"] {
+		chain = append(chain, strings.Split(value, ",")...)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		forwarded := parseProxyClientIP(chain[i])
+		if forwarded == nil {
+			break
+		}
+		ip = forwarded
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func parseProxyClientIP(value string) net.IP {
+	return net.ParseIP(strings.Trim(strings.TrimSpace(value), "[]"))
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range setting.DataProxy().TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setProxyForwardedHeaders is called by the director before the headers of
+// the client are filtered. The reverse proxy adds the address the client
+// connected from to the X-Forwarded-For chain of the client afterwards
+func setProxyForwardedHeaders(req *http.Request, forward bool) {
+	if !forward {
+		removeProxyForwardedHeaders(req.Header)
+		return
+	}
+
+	if ip := getProxyClientIP(req); ip != nil {
+		req.Header.Set("X-Real-IP", ip.String())
+	}
+}
+
+func removeProxyForwardedHeaders(header http.Header) {
+	for _, name := range proxyForwardedHeaders {
+		header.Del(name)
+	}
+}
+
+// proxyForwardedForTransport removes the X-Forwarded-For header the reverse
+// proxy adds after the director, for datasources without forwardClientIp
+type proxyForwardedForTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *proxyForwardedForTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("X-Forwarded-For") != "" {
+		req = cloneProxyRequest(req)
+		removeProxyForwardedHeaders(req.Header)
+	}
+	return t.transport.RoundTrip(req)
+}
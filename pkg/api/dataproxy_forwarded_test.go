@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestDataSourceProxyForwardedFor(t *testing.T) {
+	Convey("When proxying the requests of a client behind a proxy", t, func() {
+		var forwardedFor, realIp, forwarded string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			forwardedFor, realIp, forwarded = r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Real-IP"), r.Header.Get("Forwarded")
+		}))
+		defer backend.Close()
+
+		jsonData := map[string]interface{}{}
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: simplejson.NewFromAny(jsonData)}
+			return nil
+		})
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+		request := func(dsId string) int {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/datasources/proxy/"+dsId+"/api/v1/query", nil)
+			req.RemoteAddr = "192.0.2.10:41234"
+			req.Header.Set("X-Forwarded-For", "198.51.100.1")
+			req.Header.Set("Forwarded", "for=198.51.100.1")
+			proxyHandler(user).ServeHTTP(resp, req)
+			return resp.Code
+		}
+
+		Convey("Should remove the forwarding headers by default", func() {
+			So(request("404"), ShouldEqual, 200)
+			So(forwardedFor, ShouldEqual, "")
+			So(realIp, ShouldEqual, "")
+			So(forwarded, ShouldEqual, "")
+		})
+
+		Convey("Should append the client to the chain with forwardClientIp", func() {
+			jsonData["forwardClientIp"] = true
+			So(request("405"), ShouldEqual, 200)
+			So(forwardedFor, ShouldEqual, "198.51.100.1, 192.0.2.10")
+			So(realIp, ShouldEqual, "192.0.2.10")
+		})
+
+		Convey("Should keep the forwarding headers when the headers are filtered", func() {
+			jsonData["forwardClientIp"] = true
+			jsonData["forwardHeaders"] = []interface{}{"X-Dashboard-Id"}
+			So(request("406"), ShouldEqual, 200)
+			So(forwardedFor, ShouldEqual, "198.51.100.1, 192.0.2.10")
+			So(realIp, ShouldEqual, "192.0.2.10")
+		})
+
+		Convey("Should take the client from the headers of a trusted proxy", func() {
+			_, trusted, _ := net.ParseCIDR("192.0.2.0/24")
+			setting.DataProxy().TrustedProxies = []*net.IPNet{trusted}
+			defer func() { setting.DataProxy().TrustedProxies = nil }()
+
+			jsonData["forwardClientIp"] = true
+			So(request("407"), ShouldEqual, 200)
+			So(realIp, ShouldEqual, "198.51.100.1")
+		})
+	})
+
+	Convey("When getting the ip of a client", t, func() {
+		_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+		setting.DataProxy().TrustedProxies = []*net.IPNet{trusted}
+		defer func() { setting.DataProxy().TrustedProxies = nil }()
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("X-Forwarded-For", "203.0.113.1, 198.51.100.1")
+		req.Header.Add("X-Forwarded-For", "10.0.0.2")
+
+		Convey("Should skip the trusted proxies of the chain", func() {
+			req.RemoteAddr = "10.0.0.1:41234"
+			So(getProxyClientIP(req).String(), ShouldEqual, "198.51.100.1")
+		})
+
+		Convey("Should ignore the headers of other clients", func() {
+			req.RemoteAddr = "198.51.100.9:41234"
+			req.Header.Set("X-Real-IP", "10.0.0.3")
+			So(getProxyClientIP(req).String(), ShouldEqual, "198.51.100.9")
+		})
+	})
+}
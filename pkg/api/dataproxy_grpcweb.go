@@ -0,0 +1,26 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// headers of the gRPC-Web protocol, they are passed on with forwardHeaders too
+var grpcWebHeaders = map[string]bool{
+	"X-Grpc-Web":           true,
+	"X-User-Agent":         true,
+	"Grpc-Timeout":         true,
+	"Grpc-Encoding":        true,
+	"Grpc-Accept-Encoding": true,
+}
+
+// isGrpcWebRequest reports requests of gRPC-Web clients, application/grpc-web
+// and its +proto and -text variants. Their responses stream the messages of a
+// call and are flushed to the client as they arrive
+func isGrpcWebRequest(req *http.Request) bool {
+	return isGrpcWebContentType(req.Header.Get("Content-Type"))
+}
+
+func isGrpcWebContentType(contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(contentType), "application/grpc-web")
+}
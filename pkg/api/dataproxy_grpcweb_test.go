@@ -0,0 +1,70 @@
+package api
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func TestDataSourceProxyGrpcWeb(t *testing.T) {
+	Convey("When proxying gRPC-Web requests", t, func() {
+		release := make(chan bool)
+		var grpcHeader string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			grpcHeader = r.Header.Get("X-Grpc-Web")
+			w.Header().Set("Content-Type", "application/grpc-web+proto")
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.WriteHeader(200)
+			w.Write([]byte("message 1\n"))
+			w.(http.Flusher).Flush()
+			<-release
+			w.Write([]byte("message 2\n"))
+			w.Header().Set("Grpc-Status", "0")
+		}))
+		defer backend.Close()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			json := simplejson.NewFromAny(map[string]interface{}{"forwardHeaders": []interface{}{"X-Custom"}})
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: "grpc", Url: backend.URL, JsonData: json}
+			return nil
+		})
+
+		server := httptest.NewServer(proxyHandler(&m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}))
+		defer server.Close()
+
+		Convey("Should stream the messages and pass the trailers on", func() {
+			req, _ := http.NewRequest("POST", server.URL+"/api/datasources/proxy/395/grpc.Service/Stream", strings.NewReader("request"))
+			req.Header.Set("Content-Type", "application/grpc-web+proto")
+			req.Header.Set("X-Grpc-Web", "1")
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "application/grpc-web+proto")
+			So(grpcHeader, ShouldEqual, "1")
+
+			reader := bufio.NewReader(resp.Body)
+			line, err := reader.ReadString('\n')
+			So(err, ShouldBeNil)
+			So(line, ShouldEqual, "message 1\n")
+
+			close(release)
+			rest, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(string(rest), ShouldEqual, "message 2\n")
+			So(resp.Trailer.Get("Grpc-Status"), ShouldEqual, "0")
+		})
+	})
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// usesBackendCompression reports whether responses are always requested gzip
+// encoded, to save bandwidth between the backend and Grafana
+func usesBackendCompression(ds *m.DataSource) bool {
+	return ds.JsonData != nil && ds.JsonData.Get("compressBackendResponses").MustBool(false)
+}
+
+func acceptsGzip(header http.Header) bool {
+	return acceptsEncoding(header, "gzip")
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header names coding
+// without q=0. Wildcards are not trusted with encodings the proxy can not
+// decode
+func acceptsEncoding(header http.Header, coding string) bool {
+	for _, value := range header[http.CanonicalHeaderKey("Accept-Encoding")] {
+		for _, part := range strings.Split(value, ",") {
+			params := strings.Split(part, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), coding) {
+				continue
+			}
+
+			accepted := true
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+					accepted = err == nil && q > 0
+				}
+			}
+			return accepted
+		}
+	}
+	return false
+}
+
+// passesBrotli reports whether brotli encoded responses can be passed on to
+// the client, Grafana can not decode them. The gzip middleware would encode
+// them a second time
+func passesBrotli(header http.Header) bool {
+	return !setting.EnableGzip && acceptsEncoding(header, "br")
+}
+
+// getProxyAcceptEncoding returns the Accept-Encoding sent to the backend, the
+// encodings of the client that can be passed on to it unchanged
+func getProxyAcceptEncoding(header http.Header) string {
+	if setting.EnableGzip {
+		return "identity"
+	}
+
+	var encodings []string
+	if passesBrotli(header) {
+		encodings = append(encodings, "br")
+	}
+	if acceptsGzip(header) {
+		encodings = append(encodings, "gzip")
+	}
+	if len(encodings) == 0 {
+		return "identity"
+	}
+	return strings.Join(encodings, ", ")
+}
+
+// proxyGzipTransport asks the backend for gzip encoded responses. They are
+// passed on compressed to clients that accept gzip and decompressed for other
+// clients, or when the gzip middleware compresses responses itself
+type proxyGzipTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *proxyGzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	decompress := setting.EnableGzip || !acceptsGzip(req.Header)
+
+	outreq := cloneProxyRequest(req)
+	outreq.Header.Set("Accept-Encoding", "gzip")
+	if passesBrotli(req.Header) {
+		outreq.Header.Set("Accept-Encoding", "br, gzip")
+	}
+
+	resp, err := t.transport.RoundTrip(outreq)
+	if err != nil || !decompress || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp, err
+	}
+
+	// the length of the decompressed body is unknown, it is sent chunked. The
+	// header can be shared with the response cache, which stores the
+	// compressed body
+	resp.Body = &gzipResponseBody{body: resp.Body}
+	resp.Header = cloneProxyHeader(resp.Header)
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	return resp, nil
+}
+
+// gzipResponseBody decompresses the body on the first read, so a backend that
+// is slow to send the gzip header does not hold up the response headers
+type gzipResponseBody struct {
+	body   io.ReadCloser
+	reader *gzip.Reader
+	err    error
+}
+
+func (b *gzipResponseBody) Read(p []byte) (int, error) {
+	if b.reader == nil && b.err == nil {
+		b.reader, b.err = gzip.NewReader(b.body)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.reader.Read(p)
+}
+
+func (b *gzipResponseBody) Close() error {
+	return b.body.Close()
+}
+
+var errProxyBrotliUnsupported = errors.New("Datasource sent a brotli encoded response the client can not decode")
+
+// proxyBrotliTransport handles backends that answer with brotli although it
+// was not asked for, which the client or the gzip middleware could not
+// decode. Requests without a body are sent again without brotli, other
+// requests fail
+type proxyBrotliTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *proxyBrotliTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || !isBrotliEncoded(resp) || passesBrotli(req.Header) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	if (req.Method != "GET" && req.Method != "HEAD") || (req.Body != nil && req.ContentLength != 0) {
+		return nil, errProxyBrotliUnsupported
+	}
+
+	outreq := cloneProxyRequest(req)
+	outreq.Header.Set("Accept-Encoding", "identity")
+	if acceptsGzip(req.Header) {
+		outreq.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	resp, err = t.transport.RoundTrip(outreq)
+	if err != nil || !isBrotliEncoded(resp) {
+		return resp, err
+	}
+	resp.Body.Close()
+	return nil, errProxyBrotliUnsupported
+}
+
+func isBrotliEncoded(resp *http.Response) bool {
+	return strings.EqualFold(strings.TrimSpace(resp.Header.Get("Content-Encoding")), "br")
+}
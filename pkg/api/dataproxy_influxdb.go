@@ -0,0 +1,100 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+// usesInfluxDBReadOnly reports whether only read queries are proxied to the
+// InfluxDB datasource, with the readOnly json data option
+func usesInfluxDBReadOnly(ds *m.DataSource) bool {
+	return ds.JsonData != nil && ds.JsonData.Get("readOnly").MustBool(false)
+}
+
+var (
+	influxReadStatement = regexp.MustCompile(`(?i)^(SELECT|SHOW|EXPLAIN)\b`)
+	influxIntoClause    = regexp.MustCompile(`(?i)\bINTO\b`)
+)
+
+// readInfluxDBParams returns the parameters InfluxDB reads, those of a form
+// body first and then those of the query string. The body is put back for the
+// backend
+func readInfluxDBParams(req *http.Request) (url.Values, error) {
+	params := make(url.Values)
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if req.Body != nil && mediaType == "application/x-www-form-urlencoded" {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+
+		params, err = url.ParseQuery(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid form body: %v", err)
+		}
+	}
+
+	for name, values := range req.URL.Query() {
+		params[name] = append(params[name], values...)
+	}
+	return params, nil
+}
+
+// checkInfluxDBReadOnly allows /ping and /query with statements that only
+// read. /write, /debug and the other endpoints are rejected
+func checkInfluxDBReadOnly(req *http.Request, proxyPath string, params url.Values) error {
+	// the backend resolves dot segments, so they are resolved before checking
+	cleanPath := strings.Trim(path.Clean("/"+proxyPath), "/")
+	switch cleanPath {
+	case "ping":
+		return nil
+	case "query":
+	default:
+		return fmt.Errorf("Path %s is not allowed on a read only InfluxDB datasource", proxyPath)
+	}
+
+	// InfluxDB also reads queries from multipart forms, they are not parsed here
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		return errors.New("Multipart queries are not allowed on a read only InfluxDB datasource")
+	}
+
+	for _, query := range params["q"] {
+		if !isInfluxDBReadQuery(query) {
+			return errors.New("Only SELECT, SHOW and EXPLAIN statements are allowed on a read only InfluxDB datasource")
+		}
+	}
+	return nil
+}
+
+// isInfluxDBReadQuery reports whether every statement of the query reads. The
+// query is split at every semicolon, also those in strings and regular
+// expressions, so each statement InfluxDB runs starts one of the parts. Queries
+// with a semicolon or INTO in a string are rejected too, that is the price of
+// not parsing InfluxQL
+func isInfluxDBReadQuery(query string) bool {
+	if influxIntoClause.MatchString(query) {
+		return false
+	}
+
+	for _, statement := range strings.Split(query, ";") {
+		statement = strings.TrimSpace(statement)
+		if statement != "" && !influxReadStatement.MatchString(statement) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func TestDataSourceProxyInfluxDBReadOnly(t *testing.T) {
+	Convey("When an InfluxDB datasource is read only", t, func() {
+		backendRequests := 0
+		var backendQuery string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendRequests++
+			backendQuery = r.FormValue("q")
+		}))
+		defer backend.Close()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			json := simplejson.NewFromAny(map[string]interface{}{"readOnly": true})
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_INFLUXDB, Url: backend.URL, Database: "site", JsonData: json}
+			return nil
+		})
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+		query := func(q string) *httptest.ResponseRecorder {
+			return proxyHandlerRequest(user, "GET", "/api/datasources/proxy/400/query?db=site&q="+url.QueryEscape(q))
+		}
+		post := func(path string, body string) *httptest.ResponseRecorder {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/api/datasources/proxy/400/"+path+"?db=site", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			proxyHandler(user).ServeHTTP(resp, req)
+			return resp
+		}
+
+		Convey("Should allow read queries", func() {
+			So(query("SELECT mean(value) FROM cpu WHERE time > now() - 1h GROUP BY time(1m)").Code, ShouldEqual, 200)
+			So(query("SHOW MEASUREMENTS LIMIT 1; show tag keys").Code, ShouldEqual, 200)
+			So(post("query", "q="+url.QueryEscape("SELECT * FROM cpu")).Code, ShouldEqual, 200)
+			So(backendQuery, ShouldEqual, "SELECT * FROM cpu")
+			So(backendRequests, ShouldEqual, 3)
+		})
+
+		Convey("Should deny statements that write", func() {
+			So(query("DROP DATABASE site").Code, ShouldEqual, 403)
+			So(query("SELECT * FROM cpu; DROP MEASUREMENT cpu").Code, ShouldEqual, 403)
+			So(query("SELECT * INTO cpu_copy FROM cpu").Code, ShouldEqual, 403)
+			So(query("SELECT * FROM cpu WHERE host =~ /'/; DROP DATABASE site; SELECT '").Code, ShouldEqual, 403)
+			So(post("query", "q="+url.QueryEscape("CREATE USER admin WITH PASSWORD 'x' WITH ALL PRIVILEGES")).Code, ShouldEqual, 403)
+			So(backendRequests, ShouldEqual, 0)
+		})
+
+		Convey("Should deny writes and other endpoints", func() {
+			So(post("write", "cpu value=1").Code, ShouldEqual, 403)
+			So(proxyHandlerRequest(user, "GET", "/api/datasources/proxy/400/debug/vars?db=site").Code, ShouldEqual, 403)
+			So(proxyHandlerRequest(user, "GET", "/api/datasources/proxy/400/query/../write?db=site").Code, ShouldEqual, 403)
+			So(backendRequests, ShouldEqual, 0)
+		})
+
+		Convey("Should deny another database in the body", func() {
+			So(post("query", "db=_internal&q="+url.QueryEscape("SELECT * FROM cpu")).Code, ShouldEqual, 403)
+		})
+
+		Convey("Should allow ping", func() {
+			So(proxyHandlerRequest(user, "GET", "/api/datasources/proxy/400/ping?db=site").Code, ShouldEqual, 200)
+		})
+	})
+}
@@ -0,0 +1,266 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	krbclient "github.com/jcmturner/gokrb5/v8/client"
+	krbconfig "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// usesKerberosAuth reports whether proxied requests are authenticated with
+// SPNEGO, with the kerberosAuth json data option. The keys of kerberosPrincipal
+// are read from the kerberosKeytab file on the Grafana server
+func usesKerberosAuth(ds *m.DataSource) bool {
+	return ds.JsonData != nil && ds.JsonData.Get("kerberosAuth").MustBool(false)
+}
+
+// kerberosNegotiator builds the Negotiate tokens of a datasource
+type kerberosNegotiator interface {
+	NegotiateToken(ctx context.Context, service string) ([]byte, error)
+	RejectTicket(service string)
+}
+
+type cachedKerberosClient struct {
+	updated time.Time
+	// size and modification time of the keytab the client was built with
+	keytab string
+	client *kerberosClient
+}
+
+// the clients are kept by datasource so their tickets are reused, a client is
+// built again when the datasource is saved or its keytab file changes, after
+// the keys were rotated
+var kerberosClients = struct {
+	sync.Mutex
+	m map[int64]cachedKerberosClient
+}{m: make(map[int64]cachedKerberosClient)}
+
+// resolveKerberosKeytab returns the path of the kerberosKeytab json data
+// option in data_proxy_kerberos_keytabs_path
+func resolveKerberosKeytab(name string) (string, error) {
+	return m.ResolveDataSourceFile(setting.DataProxy().KerberosKeytabsPath, "data_proxy_kerberos_keytabs_path", name)
+}
+
+func getKerberosClient(ds *m.DataSource) (kerberosNegotiator, error) {
+	name := ds.JsonData.Get("kerberosKeytab").MustString()
+	if name == "" {
+		return nil, errors.New("Kerberos keytab is not configured")
+	}
+	path, err := resolveKerberosKeytab(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the Kerberos keytab: %v", err)
+	}
+	version := fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+
+	kerberosClients.Lock()
+	defer kerberosClients.Unlock()
+
+	cached, ok := kerberosClients.m[ds.Id]
+	if ok && cached.updated.Equal(ds.Updated) && cached.keytab == version {
+		return cached.client, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the Kerberos keytab: %v", err)
+	}
+	client, err := newKerberosClient(ds.JsonData.Get("kerberosPrincipal").MustString(), ds.JsonData.Get("kerberosKdc").MustString(), data)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		cached.client.destroy()
+	}
+	kerberosClients.m[ds.Id] = cachedKerberosClient{updated: ds.Updated, keytab: version, client: client}
+	return client, nil
+}
+
+func removeKerberosClient(dsId int64) {
+	kerberosClients.Lock()
+	if cached, ok := kerberosClients.m[dsId]; ok {
+		cached.client.destroy()
+		delete(kerberosClients.m, dsId)
+	}
+	kerberosClients.Unlock()
+}
+
+// kerberosClient gets the tickets of one principal with gokrb5, the ticket
+// granting ticket is renewed by gokrb5 until the client is destroyed
+type kerberosClient struct {
+	mu        sync.Mutex
+	client    *krbclient.Client
+	newClient func() *krbclient.Client
+}
+
+// newKerberosClient returns a client of principal, user@REALM or
+// service/host@REALM. kdc is the host of the KDC, port 88 is used when it has none
+func newKerberosClient(principal string, kdc string, keytabData []byte) (*kerberosClient, error) {
+	at := strings.LastIndex(principal, "@")
+	if at <= 0 || at == len(principal)-1 {
+		return nil, fmt.Errorf("Invalid Kerberos principal %q, expected user@REALM", principal)
+	}
+	if kdc == "" {
+		return nil, errors.New("Kerberos KDC is not configured")
+	}
+	if _, _, err := net.SplitHostPort(kdc); err != nil {
+		kdc = net.JoinHostPort(strings.Trim(kdc, "[]"), "88")
+	}
+
+	kt := keytab.New()
+	if err := kt.Unmarshal(keytabData); err != nil {
+		return nil, fmt.Errorf("Invalid Kerberos keytab: %v", err)
+	}
+
+	user, realm := principal[:at], principal[at+1:]
+	cfg := krbconfig.New()
+	cfg.LibDefaults.DefaultRealm = realm
+	cfg.LibDefaults.DNSLookupKDC = false
+	cfg.Realms = []krbconfig.Realm{{Realm: realm, KDC: []string{kdc}}}
+
+	newClient := func() *krbclient.Client {
+		return krbclient.NewWithKeytab(user, realm, kt, cfg, krbclient.DisablePAFXFAST(true))
+	}
+	return &kerberosClient{client: newClient(), newClient: newClient}, nil
+}
+
+// NegotiateToken returns the SPNEGO token of an Authorization: Negotiate
+// header for the service principal, like HTTP/hadoop.example.com
+func (c *kerberosClient) NegotiateToken(ctx context.Context, service string) ([]byte, error) {
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+
+	token, err := spnego.SPNEGOClient(client, service).InitSecContext()
+	if err != nil {
+		return nil, err
+	}
+	return token.Marshal()
+}
+
+// RejectTicket is called after the service rejected a token. gokrb5 can not
+// drop the ticket of one service, the next token is requested by a new client
+// that logs in again
+func (c *kerberosClient) RejectTicket(service string) {
+	c.mu.Lock()
+	rejected := c.client
+	c.client = c.newClient()
+	c.mu.Unlock()
+	rejected.Destroy()
+}
+
+func (c *kerberosClient) destroy() {
+	c.mu.Lock()
+	c.client.Destroy()
+	c.mu.Unlock()
+}
+
+// getKerberosService returns the kerberosServicePrincipal json data option,
+// by default HTTP/ followed by the host the request is sent to
+func getKerberosService(ds *m.DataSource, req *http.Request) string {
+	if service := ds.JsonData.Get("kerberosServicePrincipal").MustString(); service != "" {
+		return service
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return "HTTP/" + strings.ToLower(host)
+}
+
+// kerberosTransport authenticates every request with a SPNEGO token for the
+// host it is sent to. The token is sent with the first request instead of
+// waiting for the challenge of the backend, a challenge in answer to a token
+// means the ticket was rejected, like after the keys of the service changed.
+// The request is then sent once more with a new ticket
+type kerberosTransport struct {
+	transport     http.RoundTripper
+	ds            *m.DataSource
+	getNegotiator func(ds *m.DataSource) (kerberosNegotiator, error)
+}
+
+func newKerberosTransport(ds *m.DataSource, transport http.RoundTripper, dsTransport http.RoundTripper) http.RoundTripper {
+	return &kerberosTransport{transport: transport, ds: ds, getNegotiator: getKerberosClient}
+}
+
+func (t *kerberosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	negotiator, err := t.getNegotiator(t.ds)
+	if err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+	service := getKerberosService(t.ds, req)
+
+	outreq := cloneProxyRequest(req)
+	if err := setNegotiateToken(outreq, negotiator, service); err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+
+	resp, err := t.transport.RoundTrip(outreq)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.Body != nil || !isNegotiateChallenge(resp) {
+		return resp, err
+	}
+
+	resp.Body.Close()
+	negotiator.RejectTicket(service)
+
+	outreq = cloneProxyRequest(req)
+	if err := setNegotiateToken(outreq, negotiator, service); err != nil {
+		return nil, err
+	}
+	return t.transport.RoundTrip(outreq)
+}
+
+// newKerberosAuthorizer sets a token for requests that can not be retried
+// with a new ticket
+func newKerberosAuthorizer(ds *m.DataSource, dsTransport http.RoundTripper) proxyAuthorizer {
+	return func(req *http.Request) error {
+		negotiator, err := getKerberosClient(ds)
+		if err != nil {
+			return err
+		}
+		return setNegotiateToken(req, negotiator, getKerberosService(ds, req))
+	}
+}
+
+func setNegotiateToken(req *http.Request, negotiator kerberosNegotiator, service string) error {
+	token, err := negotiator.NegotiateToken(req.Context(), service)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(token))
+	return nil
+}
+
+func isNegotiateChallenge(resp *http.Response) bool {
+	for _, value := range resp.Header["Www-Authenticate"] {
+		if strings.HasPrefix(strings.ToLower(value), "negotiate") {
+			return true
+		}
+	}
+	return false
+}
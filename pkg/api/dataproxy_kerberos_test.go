@@ -0,0 +1,160 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+type fakeKerberosNegotiator struct {
+	services []string
+	rejected []string
+	tickets  int
+}
+
+func (n *fakeKerberosNegotiator) NegotiateToken(ctx context.Context, service string) ([]byte, error) {
+	n.services = append(n.services, service)
+	if len(n.rejected) > 0 {
+		return []byte("renewed"), nil
+	}
+	return []byte("token"), nil
+}
+
+func (n *fakeKerberosNegotiator) RejectTicket(service string) {
+	n.rejected = append(n.rejected, service)
+}
+
+func TestDataSourceProxyKerberos(t *testing.T) {
+	Convey("When proxying to a backend that requires Kerberos", t, func() {
+		var authorizations []string
+		acceptRenewed := false
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorizations = append(authorizations, r.Header.Get("Authorization"))
+			if acceptRenewed && r.Header.Get("Authorization") != "Negotiate cmVuZXdlZA==" {
+				w.Header().Set("WWW-Authenticate", "Negotiate")
+				w.WriteHeader(401)
+				return
+			}
+			w.WriteHeader(200)
+		}))
+		defer backend.Close()
+
+		json := simplejson.New()
+		json.Set("kerberosAuth", true)
+		ds := &m.DataSource{Id: 420, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: json}
+
+		negotiator := &fakeKerberosNegotiator{}
+		transport := &kerberosTransport{
+			transport: http.DefaultTransport,
+			ds:        ds,
+			getNegotiator: func(ds *m.DataSource) (kerberosNegotiator, error) {
+				return negotiator, nil
+			},
+		}
+
+		Convey("Should send a token for the host of the backend", func() {
+			req, _ := http.NewRequest("GET", backend.URL+"/api/v1/query", nil)
+			req.Host = "Prometheus.example.com:9090"
+			resp, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(authorizations, ShouldResemble, []string{"Negotiate dG9rZW4="})
+			So(negotiator.services, ShouldResemble, []string{"HTTP/prometheus.example.com"})
+			So(req.Header.Get("Authorization"), ShouldEqual, "")
+		})
+
+		Convey("Should use the configured service principal", func() {
+			json.Set("kerberosServicePrincipal", "HTTP/lb.example.com@EXAMPLE.COM")
+			req, _ := http.NewRequest("GET", backend.URL+"/api/v1/query", nil)
+			resp, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			So(negotiator.services, ShouldResemble, []string{"HTTP/lb.example.com@EXAMPLE.COM"})
+		})
+
+		Convey("Should retry with a new ticket when the token is rejected", func() {
+			acceptRenewed = true
+			req, _ := http.NewRequest("GET", backend.URL+"/api/v1/query", nil)
+			resp, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(authorizations, ShouldResemble, []string{"Negotiate dG9rZW4=", "Negotiate cmVuZXdlZA=="})
+			So(negotiator.rejected, ShouldResemble, []string{"HTTP/127.0.0.1"})
+		})
+
+		Convey("Should not retry requests with a body", func() {
+			acceptRenewed = true
+			req, _ := http.NewRequest("POST", backend.URL+"/api/v1/query", strings.NewReader("up"))
+			resp, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			So(resp.StatusCode, ShouldEqual, 401)
+			So(len(authorizations), ShouldEqual, 1)
+			So(negotiator.rejected, ShouldBeEmpty)
+		})
+	})
+
+	Convey("When the keytab of a Kerberos datasource is missing", t, func() {
+		json := simplejson.New()
+		json.Set("kerberosAuth", true)
+		ds := &m.DataSource{Id: 421, JsonData: json}
+
+		_, err := getKerberosClient(ds)
+		So(err.Error(), ShouldEqual, "Kerberos keytab is not configured")
+
+		dir, err := ioutil.TempDir("", "grafana-keytabs")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		setting.DataProxy().KerberosKeytabsPath = dir
+		defer func() { setting.DataProxy().KerberosKeytabsPath = "" }()
+
+		json.Set("kerberosKeytab", "missing.keytab")
+		_, err = getKerberosClient(ds)
+		So(err.Error(), ShouldStartWith, "Failed to read the Kerberos keytab")
+
+		Convey("Should only read keytabs in data_proxy_kerberos_keytabs_path", func() {
+			json.Set("kerberosKeytab", "../grafana.keytab")
+			_, err := getKerberosClient(ds)
+			So(err.Error(), ShouldContainSubstring, "is not in data_proxy_kerberos_keytabs_path")
+			So(validateDataSourceFiles(json), ShouldNotBeNil)
+
+			json.Set("kerberosKeytab", filepath.Join(dir, "grafana.keytab"))
+			So(validateDataSourceFiles(json), ShouldBeNil)
+		})
+
+		Convey("Should not read keytabs when data_proxy_kerberos_keytabs_path is not set", func() {
+			setting.DataProxy().KerberosKeytabsPath = ""
+			_, err := getKerberosClient(ds)
+			So(err, ShouldNotBeNil)
+			So(validateDataSourceFiles(json), ShouldNotBeNil)
+		})
+	})
+
+	Convey("When building a Kerberos client", t, func() {
+		_, err := newKerberosClient("grafana", "kdc.example.com", nil)
+		So(err.Error(), ShouldContainSubstring, "expected user@REALM")
+
+		_, err = newKerberosClient("grafana@EXAMPLE.COM", "", nil)
+		So(err.Error(), ShouldEqual, "Kerberos KDC is not configured")
+
+		_, err = newKerberosClient("grafana@EXAMPLE.COM", "kdc.example.com", []byte("not a keytab"))
+		So(err.Error(), ShouldStartWith, "Invalid Kerberos keytab")
+	})
+}
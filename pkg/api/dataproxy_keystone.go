@@ -0,0 +1,29 @@
+package api
+
+import "net/http"
+
+// keystoneTransport fetches a new Keystone token once when the backend rejects
+// the token of the user, a token can expire or be revoked before the expiry
+// it was issued with
+type keystoneTransport struct {
+	transport http.RoundTripper
+	refresh   func() (string, error)
+}
+
+func (t *keystoneTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.Body != nil {
+		return resp, err
+	}
+
+	token, refreshErr := t.refresh()
+	if refreshErr != nil {
+		dataproxyLogger.Warn("Failed to refresh keystone token", "error", refreshErr)
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	outreq := cloneProxyRequest(req)
+	outreq.Header["X-Auth-Token"] = []string{token}
+	return t.transport.RoundTrip(outreq)
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDataSourceProxyKeystone(t *testing.T) {
+	Convey("When the backend rejects the keystone token", t, func() {
+		var tokens []string
+		backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			tokens = append(tokens, req.Header.Get("X-Auth-Token"))
+			status := 401
+			if req.Header.Get("X-Auth-Token") == "fresh" {
+				status = 200
+			}
+			return &http.Response{StatusCode: status, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		})
+
+		refreshes := 0
+		transport := &keystoneTransport{transport: backend, refresh: func() (string, error) {
+			refreshes++
+			return "fresh", nil
+		}}
+
+		req, _ := http.NewRequest("GET", "http://keystone.example/api", nil)
+		req.Header["X-Auth-Token"] = []string{"expired"}
+
+		Convey("Should retry once with a new token", func() {
+			resp, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(refreshes, ShouldEqual, 1)
+			So(tokens, ShouldResemble, []string{"expired", "fresh"})
+			So(req.Header.Get("X-Auth-Token"), ShouldEqual, "expired")
+		})
+
+		Convey("Should not retry again when the new token is rejected", func() {
+			transport.refresh = func() (string, error) {
+				refreshes++
+				return "revoked", nil
+			}
+			resp, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, 401)
+			So(refreshes, ShouldEqual, 1)
+			So(tokens, ShouldResemble, []string{"expired", "revoked"})
+		})
+
+		Convey("Should pass on the 401 when refreshing fails", func() {
+			transport.refresh = func() (string, error) { return "", errors.New("keystone down") }
+			resp, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, 401)
+			So(tokens, ShouldResemble, []string{"expired"})
+		})
+
+		Convey("Should not retry requests with a body", func() {
+			req, _ := http.NewRequest("POST", "http://keystone.example/api", strings.NewReader("query"))
+			resp, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, 401)
+			So(refreshes, ShouldEqual, 0)
+		})
+	})
+}
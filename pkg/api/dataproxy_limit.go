@@ -0,0 +1,113 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/grafana/grafana/pkg/metrics"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+var proxyLimiters = struct {
+	sync.Mutex
+	semaphores map[int64]chan struct{}
+}{semaphores: make(map[int64]chan struct{})}
+
+// acquireProxySlot limits the concurrent proxied requests of a datasource to
+// maxConcurrentRequests in json data. It returns false when the limit is
+// reached, otherwise the returned func must be called to release the slot
+func acquireProxySlot(ds *m.DataSource) (func(), bool) {
+	if ds.JsonData == nil {
+		return func() {}, true
+	}
+
+	limit := ds.JsonData.Get("maxConcurrentRequests").MustInt(0)
+	if limit <= 0 {
+		return func() {}, true
+	}
+
+	proxyLimiters.Lock()
+	semaphore, exists := proxyLimiters.semaphores[ds.Id]
+	// a changed limit starts a new semaphore, requests holding a slot in the
+	// old one release it there
+	if !exists || cap(semaphore) != limit {
+		semaphore = make(chan struct{}, limit)
+		proxyLimiters.semaphores[ds.Id] = semaphore
+	}
+	proxyLimiters.Unlock()
+
+	select {
+	case semaphore <- struct{}{}:
+		return func() { <-semaphore }, true
+	default:
+		return nil, false
+	}
+}
+
+var proxyServerLimiter = struct {
+	sync.Mutex
+	semaphore chan struct{}
+}{}
+
+// acquireServerProxySlot limits the concurrent proxied requests of all
+// datasources to data_proxy_max_concurrent. It returns false when the limit is
+// reached, otherwise the returned func must be called to release the slot
+func acquireServerProxySlot() (func(), bool) {
+	limit := setting.DataProxy().MaxConcurrent
+	if limit <= 0 {
+		return func() {}, true
+	}
+
+	proxyServerLimiter.Lock()
+	semaphore := proxyServerLimiter.semaphore
+	// a reloaded limit starts a new semaphore like the datasource limits
+	if semaphore == nil || cap(semaphore) != limit {
+		semaphore = make(chan struct{}, limit)
+		proxyServerLimiter.semaphore = semaphore
+	}
+	proxyServerLimiter.Unlock()
+
+	select {
+	case semaphore <- struct{}{}:
+		updateProxyUtilization(semaphore)
+		return func() {
+			<-semaphore
+			updateProxyUtilization(semaphore)
+		}, true
+	default:
+		return nil, false
+	}
+}
+
+// updateProxyUtilization reports the share of data_proxy_max_concurrent in
+// use, in percent
+func updateProxyUtilization(semaphore chan struct{}) {
+	metrics.M_DataSource_ProxyReq_Utilization.Update(int64(len(semaphore) * 100 / cap(semaphore)))
+}
+
+// getProxyMaxHeaderBytes returns the limit of the total size of the request
+// headers, maxRequestHeaderBytes in json data or else
+// data_proxy_max_request_header_bytes. 0 means no limit
+func getProxyMaxHeaderBytes(ds *m.DataSource) int {
+	if ds.JsonData == nil {
+		return setting.DataProxy().MaxRequestHeaderBytes
+	}
+	return ds.JsonData.Get("maxRequestHeaderBytes").MustInt(setting.DataProxy().MaxRequestHeaderBytes)
+}
+
+// getProxyHeaderBytes returns the size of the headers as they are written in
+// the request, "Name: value\r\n" per value. Cookie is left out, it is removed
+// by the director
+func getProxyHeaderBytes(header http.Header) int {
+	size := 0
+	for name, values := range header {
+		if name == "Cookie" {
+			continue
+		}
+		for _, value := range values {
+			size += len(name) + len(value) + 4
+		}
+	}
+	return size
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestDataSourceProxyLimit(t *testing.T) {
+	Convey("When limiting concurrent proxy requests", t, func() {
+		json := simplejson.New()
+		json.Set("maxConcurrentRequests", 1)
+		ds := &m.DataSource{Id: 1, JsonData: json}
+
+		release, acquired := acquireProxySlot(ds)
+		So(acquired, ShouldBeTrue)
+
+		Convey("Should reject requests over the limit", func() {
+			_, acquired := acquireProxySlot(ds)
+			So(acquired, ShouldBeFalse)
+		})
+
+		Convey("Should accept requests once a slot is released", func() {
+			release()
+			release, acquired = acquireProxySlot(ds)
+			So(acquired, ShouldBeTrue)
+		})
+
+		Convey("Should keep datasources apart", func() {
+			other := &m.DataSource{Id: 2, JsonData: json}
+			releaseOther, acquired := acquireProxySlot(other)
+			So(acquired, ShouldBeTrue)
+			releaseOther()
+		})
+
+		Convey("Should not limit datasources without maxConcurrentRequests", func() {
+			unlimited := &m.DataSource{Id: 3, JsonData: simplejson.New()}
+			for i := 0; i < 10; i++ {
+				_, acquired := acquireProxySlot(unlimited)
+				So(acquired, ShouldBeTrue)
+			}
+		})
+
+		Reset(func() {
+			release()
+		})
+	})
+}
+
+func TestDataSourceProxyServerLimit(t *testing.T) {
+	Convey("When limiting the concurrent proxy requests of the server", t, func() {
+		setting.DataProxy().MaxConcurrent = 2
+		defer func() { setting.DataProxy().MaxConcurrent = 0 }()
+
+		release, acquired := acquireServerProxySlot()
+		So(acquired, ShouldBeTrue)
+
+		Convey("Should reject requests over the limit with 503", func() {
+			releaseOther, acquired := acquireServerProxySlot()
+			So(acquired, ShouldBeTrue)
+			defer releaseOther()
+
+			loaded := false
+			bus.ClearBusHandlers()
+			defer bus.ClearBusHandlers()
+			bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+				loaded = true
+				query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: "http://prometheus:9090", JsonData: simplejson.New()}
+				return nil
+			})
+
+			resp := proxyHandlerRequest(&m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}, "GET", "/api/datasources/proxy/401/api/v1/query")
+
+			So(resp.Code, ShouldEqual, 503)
+			So(resp.Header().Get("Retry-After"), ShouldEqual, "1")
+			So(loaded, ShouldBeFalse)
+		})
+
+		Convey("Should accept requests once a slot is released", func() {
+			release()
+			release, acquired = acquireServerProxySlot()
+			So(acquired, ShouldBeTrue)
+		})
+
+		Reset(func() {
+			release()
+		})
+	})
+}
+
+func TestDataSourceProxyHeaderLimit(t *testing.T) {
+	Convey("When limiting the size of request headers", t, func() {
+		called := false
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+		defer backend.Close()
+
+		setting.DataProxy().MaxRequestHeaderBytes = 1024
+		defer func() { setting.DataProxy().MaxRequestHeaderBytes = 0 }()
+
+		jsonData := map[string]interface{}{}
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: simplejson.NewFromAny(jsonData)}
+			return nil
+		})
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+		request := func(dsId string, header http.Header) int {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/datasources/proxy/"+dsId+"/api/v1/query", nil)
+			req.Header = header
+			proxyHandler(user).ServeHTTP(resp, req)
+			return resp.Code
+		}
+
+		Convey("Should reject oversized headers with 431 before the backend is called", func() {
+			So(request("412", http.Header{"X-Bloat": []string{strings.Repeat("a", 2048)}}), ShouldEqual, 431)
+			So(called, ShouldBeFalse)
+		})
+
+		Convey("Should not count cookies, they are not forwarded", func() {
+			So(request("413", http.Header{"Cookie": []string{"grafana_sess=" + strings.Repeat("a", 2048)}}), ShouldEqual, 200)
+			So(called, ShouldBeTrue)
+		})
+
+		Convey("Should use the limit of the datasource", func() {
+			jsonData["maxRequestHeaderBytes"] = 4096
+			So(request("414", http.Header{"X-Bloat": []string{strings.Repeat("a", 2048)}}), ShouldEqual, 200)
+		})
+	})
+}
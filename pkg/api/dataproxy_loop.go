@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+// proxyViaToken identifies this server in the Via header of proxied requests,
+// a request that already passed through this server is a proxy loop
+var proxyViaToken = "grafana-" + util.GetRandomString(10)
+
+func addProxyVia(header http.Header) {
+	header.Add("Via", "1.1 "+proxyViaToken)
+}
+
+func isProxyLoop(req *http.Request) bool {
+	for _, value := range req.Header["Via"] {
+		for _, hop := range strings.Split(value, ",") {
+			fields := strings.Fields(hop)
+			if len(fields) >= 2 && fields[1] == proxyViaToken {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isGrafanaAddress returns true when the url points at the address this
+// server listens on, or at its root_url
+func isGrafanaAddress(targetUrl *url.URL) bool {
+	if appUrl, err := url.Parse(setting.AppUrl); err == nil && appUrl.Host != "" {
+		// other paths on the host of a sub path install are different services
+		appPath := strings.TrimSuffix(appUrl.Path, "/") + "/"
+		targetPath := strings.TrimSuffix(targetUrl.Path, "/") + "/"
+		if hostWithDefaultPort(appUrl) == hostWithDefaultPort(targetUrl) && strings.HasPrefix(targetPath, appPath) {
+			return true
+		}
+	}
+
+	_, port, _ := net.SplitHostPort(hostWithDefaultPort(targetUrl))
+	if port != setting.HttpPort {
+		return false
+	}
+
+	listenIp := net.ParseIP(setting.HttpAddr)
+	listensOnAll := setting.HttpAddr == "" || (listenIp != nil && listenIp.IsUnspecified())
+
+	for _, ip := range resolveHost(hostWithoutPort(targetUrl.Host)) {
+		if listenIp != nil && listenIp.Equal(ip) {
+			return true
+		}
+		if listensOnAll && (ip.IsLoopback() || ip.IsUnspecified() || isLocalIp(ip)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hostWithDefaultPort(u *url.URL) string {
+	if _, _, err := net.SplitHostPort(u.Host); err == nil {
+		return strings.ToLower(u.Host)
+	}
+
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return strings.ToLower(net.JoinHostPort(strings.Trim(u.Host, "[]"), port))
+}
+
+func isLocalIp(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
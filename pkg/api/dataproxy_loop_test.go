@@ -0,0 +1,123 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestDataSourceProxyLoops(t *testing.T) {
+	Convey("When detecting proxy loops", t, func() {
+		Convey("Should detect requests that passed through this server", func() {
+			req, _ := http.NewRequest("GET", "http://grafana.com/api/datasources/proxy/1/render", nil)
+			req.Header.Set("Via", "1.1 lb")
+			So(isProxyLoop(req), ShouldBeFalse)
+
+			addProxyVia(req.Header)
+			So(isProxyLoop(req), ShouldBeTrue)
+		})
+
+		Convey("Should return 508 for looping requests", func() {
+			bus.ClearBusHandlers()
+			defer bus.ClearBusHandlers()
+			bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+				query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_GRAPHITE, Url: "http://graphite:8080", JsonData: simplejson.New()}
+				return nil
+			})
+
+			req, _ := http.NewRequest("GET", "/api/datasources/proxy/190/render", nil)
+			addProxyVia(req.Header)
+			resp := httptest.NewRecorder()
+			proxyHandler(&m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}).ServeHTTP(resp, req)
+			So(resp.Code, ShouldEqual, 508)
+		})
+	})
+
+	Convey("When checking for the address of grafana", t, func() {
+		oldAppUrl, oldAddr, oldPort := setting.AppUrl, setting.HttpAddr, setting.HttpPort
+		setting.AppUrl = "https://grafana.example.com/"
+		setting.HttpAddr = "0.0.0.0"
+		setting.HttpPort = "3000"
+		defer func() { setting.AppUrl, setting.HttpAddr, setting.HttpPort = oldAppUrl, oldAddr, oldPort }()
+
+		isGrafana := func(rawUrl string) bool {
+			u, _ := url.Parse(rawUrl)
+			return isGrafanaAddress(u)
+		}
+
+		Convey("Should match the root url", func() {
+			So(isGrafana("https://grafana.example.com:443"), ShouldBeTrue)
+			So(isGrafana("https://grafana.example.com"), ShouldBeTrue)
+		})
+
+		Convey("Should allow other paths on the host of a sub path install", func() {
+			setting.AppUrl = "https://example.com/grafana/"
+			So(isGrafana("https://example.com/grafana"), ShouldBeTrue)
+			So(isGrafana("https://example.com/prometheus"), ShouldBeFalse)
+		})
+
+		Convey("Should match local addresses on the http port", func() {
+			So(isGrafana("http://127.0.0.1:3000"), ShouldBeTrue)
+			So(isGrafana("http://[::1]:3000"), ShouldBeTrue)
+		})
+
+		Convey("Should not match other ports or hosts", func() {
+			So(isGrafana("http://127.0.0.1:9090"), ShouldBeFalse)
+			So(isGrafana("http://10.255.255.1:3000"), ShouldBeFalse)
+		})
+	})
+
+	Convey("When blocking internal addresses", t, func() {
+		setting.DataProxy().BlockInternalIps = true
+		defer func() { setting.DataProxy().BlockInternalIps = false }()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_GRAPHITE, Url: "http://169.254.169.254/latest/meta-data", JsonData: simplejson.New()}
+			return nil
+		})
+
+		Convey("Should return 403 for datasources on blocked addresses", func() {
+			resp := proxyHandlerRequest(&m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}, "GET", "/api/datasources/proxy/200/")
+			So(resp.Code, ShouldEqual, 403)
+		})
+
+		Convey("Should block IPv6 literal addresses", func() {
+			isBlocked := func(rawUrl string) bool {
+				targetUrl, _ := url.Parse(rawUrl)
+				return resolvesToBlockedAddress(targetUrl)
+			}
+
+			So(isBlocked("http://[::1]:9090/"), ShouldBeTrue)
+			So(isBlocked("http://[fe80::1]/"), ShouldBeTrue)
+			So(isBlocked("http://[fd00:ec2::254]/latest/meta-data"), ShouldBeTrue)
+			So(isBlocked("http://[2001:4860:4860::8888]/"), ShouldBeFalse)
+		})
+
+		Convey("Should return 403 when the connection is blocked", func() {
+			transport := &proxyErrorTransport{transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				return nil, m.ErrDataSourceAddressBlocked
+			})}
+
+			req, _ := http.NewRequest("GET", "http://rebinding.example.com/", nil)
+			resp, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, 403)
+		})
+	})
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
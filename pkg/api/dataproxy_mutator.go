@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+// ProxyRequestMutator changes the requests proxied to the datasources of the
+// type it is registered for, like signing them or adding tenant headers.
+// MutateProxyRequest is called for every request sent to the backend,
+// including redirects and retries, after the credentials of the datasource
+// are set. An error fails the proxied request
+type ProxyRequestMutator interface {
+	MutateProxyRequest(ds *m.DataSource, req *http.Request) error
+}
+
+var proxyRequestMutators = make(map[string][]ProxyRequestMutator)
+
+// RegisterProxyRequestMutator adds a mutator for datasources of dsType, the
+// mutators of a type are called in the order they were registered. Plugins
+// register them from an init func, before requests are proxied
+func RegisterProxyRequestMutator(dsType string, mutator ProxyRequestMutator) {
+	proxyRequestMutators[dsType] = append(proxyRequestMutators[dsType], mutator)
+}
+
+// mutateProxyRequest applies the mutators of the datasource type to a request
+// that does not go through the round trippers, like a websocket handshake
+func mutateProxyRequest(ds *m.DataSource, req *http.Request) error {
+	for _, mutator := range proxyRequestMutators[ds.Type] {
+		if err := mutator.MutateProxyRequest(ds, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// proxyMutatorTransport is below the auth round trippers, so mutators see the
+// request as it is sent and can sign it. Like proxyAuthTransport it changes a
+// copy of the request
+type proxyMutatorTransport struct {
+	transport http.RoundTripper
+	ds        *m.DataSource
+}
+
+func (t *proxyMutatorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	outreq := cloneProxyRequest(req)
+	outurl := *req.URL
+	outreq.URL = &outurl
+
+	if err := mutateProxyRequest(t.ds, outreq); err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+
+	return t.transport.RoundTrip(outreq)
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+type proxyRequestMutatorFunc func(ds *m.DataSource, req *http.Request) error
+
+func (f proxyRequestMutatorFunc) MutateProxyRequest(ds *m.DataSource, req *http.Request) error {
+	return f(ds, req)
+}
+
+func TestDataSourceProxyMutators(t *testing.T) {
+	Convey("When mutators are registered for a datasource type", t, func() {
+		var tenant, signature, authorization string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant = r.Header.Get("X-Scope-OrgID")
+			signature = r.Header.Get("X-Signature")
+			authorization = r.Header.Get("Authorization")
+		}))
+		defer backend.Close()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{
+				Id:                query.Id,
+				OrgId:             query.OrgId,
+				Type:              "mutated",
+				Url:               backend.URL,
+				BasicAuth:         true,
+				BasicAuthUser:     "user",
+				BasicAuthPassword: "password",
+				JsonData:          simplejson.New(),
+			}
+			return nil
+		})
+
+		defer delete(proxyRequestMutators, "mutated")
+		RegisterProxyRequestMutator("mutated", proxyRequestMutatorFunc(func(ds *m.DataSource, req *http.Request) error {
+			req.Header.Set("X-Scope-OrgID", "tenant-1")
+			return nil
+		}))
+		RegisterProxyRequestMutator("mutated", proxyRequestMutatorFunc(func(ds *m.DataSource, req *http.Request) error {
+			req.Header.Set("X-Signature", req.Header.Get("X-Scope-OrgID")+":"+req.Header.Get("Authorization"))
+			return nil
+		}))
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+
+		Convey("Should call them in order after the credentials are set", func() {
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/320/api/v1/query")
+
+			So(resp.Code, ShouldEqual, 200)
+			So(tenant, ShouldEqual, "tenant-1")
+			So(authorization, ShouldNotBeEmpty)
+			So(signature, ShouldEqual, "tenant-1:"+authorization)
+		})
+
+		Convey("Should fail the request when a mutator fails", func() {
+			RegisterProxyRequestMutator("mutated", proxyRequestMutatorFunc(func(ds *m.DataSource, req *http.Request) error {
+				return errors.New("signing key expired")
+			}))
+
+			resp := proxyHandlerRequest(&m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_ADMIN}, "GET", "/api/datasources/proxy/321/api/v1/query")
+
+			So(resp.Code, ShouldEqual, 502)
+			So(tenant, ShouldEqual, "")
+		})
+	})
+}
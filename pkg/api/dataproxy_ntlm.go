@@ -0,0 +1,168 @@
+package api
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Azure/go-ntlmssp"
+
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+var errNTLMConnectionClosed = errors.New("Backend closed the connection during the NTLM handshake")
+
+func usesNTLMAuth(ds *m.DataSource) bool {
+	return ds.JsonData != nil && ds.JsonData.Get("ntlmAuth").MustBool(false)
+}
+
+// ntlmTransport authenticates every request with the NTLM handshake. NTLM
+// authenticates the connection instead of the request, so each request gets
+// a connection of its own that is used for the whole handshake and closed
+// with the response. Backends are expected to require NTLM, a response other
+// than the challenge is passed on as is
+type ntlmTransport struct {
+	transport *http.Transport
+	user      string
+	password  string
+}
+
+func newNTLMTransport(ds *m.DataSource, transport *http.Transport) *ntlmTransport {
+	return &ntlmTransport{
+		transport: transport,
+		user:      ds.JsonData.Get("ntlmUser").MustString(),
+		password:  ds.SecureJsonData.Decrypt()["ntlmPassword"],
+	}
+}
+
+func (t *ntlmTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	conn, err := dialBackendConn(req, t.transport)
+	if err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+
+	pinned := &ntlmConn{Conn: conn, reader: bufio.NewReader(conn), done: make(chan struct{})}
+	go func() {
+		select {
+		case <-req.Context().Done():
+			pinned.Close()
+		case <-pinned.done:
+		}
+	}()
+
+	resp, err := t.handshake(pinned, req)
+	if err != nil {
+		pinned.Close()
+		return nil, err
+	}
+
+	resp.Body = &ntlmResponseBody{ReadCloser: resp.Body, conn: pinned}
+	return resp, nil
+}
+
+func (t *ntlmTransport) handshake(conn *ntlmConn, req *http.Request) (*http.Response, error) {
+	// the body is only sent once the connection is authenticated
+	negotiate := cloneProxyRequest(req)
+	negotiate.Body = nil
+	negotiate.ContentLength = 0
+	negotiateMessage, err := ntlmssp.NewNegotiateMessage("", "")
+	if err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+	negotiate.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(negotiateMessage))
+
+	resp, err := conn.roundTrip(negotiate)
+	if err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+
+	challenge, ok := getNTLMChallenge(resp)
+	if !ok {
+		closeRequestBody(req)
+		return resp, nil
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.Close {
+		closeRequestBody(req)
+		return nil, errNTLMConnectionClosed
+	}
+
+	// the domain can be named as DOMAIN\user
+	authenticate, err := ntlmssp.NewAuthenticateMessage(challenge, t.user, t.password, nil)
+	if err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+
+	outreq := cloneProxyRequest(req)
+	outreq.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(authenticate))
+	return conn.roundTrip(outreq)
+}
+
+func getNTLMChallenge(resp *http.Response) ([]byte, bool) {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil, false
+	}
+
+	for _, value := range resp.Header["Www-Authenticate"] {
+		if strings.HasPrefix(value, "NTLM ") {
+			challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[5:]))
+			return challenge, err == nil
+		}
+	}
+
+	return nil, false
+}
+
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// ntlmConn sends the requests of one handshake, it is closed when the request
+// is canceled or its response is done
+type ntlmConn struct {
+	net.Conn
+	reader *bufio.Reader
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (c *ntlmConn) roundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Write(c.Conn); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(c.reader, req)
+}
+
+func (c *ntlmConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.done)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+type ntlmResponseBody struct {
+	io.ReadCloser
+	conn *ntlmConn
+}
+
+func (b *ntlmResponseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/components/securejsondata"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func TestDataSourceProxyNTLM(t *testing.T) {
+	Convey("When proxying to a backend that requires NTLM", t, func() {
+		challenge := make([]byte, 48)
+		copy(challenge, "NTLMSSP\x00")
+		binary.LittleEndian.PutUint32(challenge[8:], 2)
+		// unicode and ntlm
+		binary.LittleEndian.PutUint32(challenge[20:], 0x00000201)
+		binary.LittleEndian.PutUint32(challenge[44:], 48)
+
+		var challengedConn, authenticatedConn, body, domain, user string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			msg, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.Header.Get("Authorization"), "NTLM "))
+			if len(msg) < 12 {
+				w.Header().Set("WWW-Authenticate", "NTLM")
+				w.WriteHeader(401)
+				return
+			}
+
+			switch binary.LittleEndian.Uint32(msg[8:]) {
+			case 1:
+				challengedConn = r.RemoteAddr
+				w.Header().Set("WWW-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(challenge))
+				w.WriteHeader(401)
+				w.Write([]byte("challenge"))
+			case 3:
+				authenticatedConn = r.RemoteAddr
+				domain, user = ntlmField(msg, 28), ntlmField(msg, 36)
+				data, _ := ioutil.ReadAll(r.Body)
+				body = string(data)
+				w.WriteHeader(200)
+			}
+		}))
+		defer backend.Close()
+
+		json := simplejson.New()
+		json.Set("ntlmAuth", true)
+		json.Set("ntlmUser", `CORP\grafana`)
+
+		ds := &m.DataSource{
+			Id:             230,
+			Type:           m.DS_PROMETHEUS,
+			Url:            backend.URL,
+			JsonData:       json,
+			SecureJsonData: securejsondata.GetEncryptedJsonData(map[string]string{"ntlmPassword": "secret"}),
+		}
+
+		transport, err := ds.GetHttpTransport()
+		So(err, ShouldBeNil)
+
+		req, _ := http.NewRequest("POST", backend.URL+"/query", strings.NewReader("select 1"))
+		resp, err := newDataProxyTransport(ds, transport, false).RoundTrip(req)
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+
+		Convey("Should authenticate on the connection that got the challenge", func() {
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(challengedConn, ShouldNotEqual, "")
+			So(authenticatedConn, ShouldEqual, challengedConn)
+		})
+
+		Convey("Should authenticate the user of the domain", func() {
+			So(domain, ShouldEqual, "CORP")
+			So(user, ShouldEqual, "grafana")
+		})
+
+		Convey("Should only send the body once authenticated", func() {
+			So(body, ShouldEqual, "select 1")
+		})
+	})
+}
+
+// ntlmField decodes the unicode string of the field of an NTLM message at offset
+func ntlmField(msg []byte, offset int) string {
+	length := int(binary.LittleEndian.Uint16(msg[offset:]))
+	start := int(binary.LittleEndian.Uint32(msg[offset+4:]))
+	chars := make([]uint16, length/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(msg[start+2*i:])
+	}
+	return string(utf16.Decode(chars))
+}
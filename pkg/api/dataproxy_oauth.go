@@ -0,0 +1,206 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/middleware"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+// tokens are refreshed this long before the expiry reported by the token endpoint
+const oauthTokenExpiryDelta = 10 * time.Second
+
+type oauthToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	expires     time.Time
+}
+
+func (t *oauthToken) valid() bool {
+	return t.AccessToken != "" && (t.expires.IsZero() || time.Now().Before(t.expires))
+}
+
+type oauthTokenCacheKey struct {
+	id      int64
+	updated time.Time
+}
+
+// oauthTokenCacheEntry is locked while its token is fetched, so a slow token
+// endpoint only holds up requests to its own datasource
+type oauthTokenCacheEntry struct {
+	sync.Mutex
+	token *oauthToken
+}
+
+var oauthTokenCache = struct {
+	sync.Mutex
+	tokens map[oauthTokenCacheKey]*oauthTokenCacheEntry
+}{tokens: make(map[oauthTokenCacheKey]*oauthTokenCacheEntry)}
+
+func usesOAuthClientCredentials(ds *m.DataSource) bool {
+	return ds.JsonData != nil && ds.JsonData.Get("oauthClientCredentials").MustBool(false)
+}
+
+// usesOAuthPassThru reports whether the OAuth access token the signed in user
+// logged in with is sent to the backend, for apis secured by the same provider
+func usesOAuthPassThru(ds *m.DataSource) bool {
+	return ds.JsonData != nil && ds.JsonData.Get("oauthPassThru").MustBool(false)
+}
+
+// getOAuthPassThruToken returns the access token of the OAuth login stored in
+// the session, false when the user did not log in with OAuth or the token
+// expired
+func getOAuthPassThruToken(c *middleware.Context) (string, bool) {
+	token, _ := c.Session.Get(middleware.SESS_KEY_OAUTH_ACCESS_TOKEN).(string)
+	if token == "" {
+		return "", false
+	}
+
+	if expiry, _ := c.Session.Get(middleware.SESS_KEY_OAUTH_EXPIRY).(int64); expiry > 0 && time.Now().Unix() >= expiry {
+		return "", false
+	}
+
+	return token, true
+}
+
+// oauthTransport sets a bearer token obtained with the OAuth2 client credentials
+// grant on proxied requests and fetches a new token once when the backend
+// rejects the current one
+type oauthTransport struct {
+	transport http.RoundTripper
+	// token requests use the plain datasource transport, the proxied chain would
+	// sign them or add the api key of the datasource to them
+	tokenTransport http.RoundTripper
+	ds             *m.DataSource
+}
+
+func (t *oauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.getToken(req, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.transport.RoundTrip(withBearerToken(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.Body != nil {
+		return resp, err
+	}
+
+	resp.Body.Close()
+	if token, err = t.getToken(req, token); err != nil {
+		return nil, err
+	}
+
+	return t.transport.RoundTrip(withBearerToken(req, token))
+}
+
+func newOAuthTransport(ds *m.DataSource, transport http.RoundTripper, dsTransport http.RoundTripper) http.RoundTripper {
+	return &oauthTransport{transport: transport, tokenTransport: dsTransport, ds: ds}
+}
+
+// newOAuthAuthorizer sets the cached token, for requests that can not be
+// retried with a new one
+func newOAuthAuthorizer(ds *m.DataSource, dsTransport http.RoundTripper) proxyAuthorizer {
+	t := &oauthTransport{tokenTransport: dsTransport, ds: ds}
+	return func(req *http.Request) error {
+		token, err := t.getToken(req, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+		return nil
+	}
+}
+
+func withBearerToken(req *http.Request, token *oauthToken) *http.Request {
+	outreq := cloneProxyRequest(req)
+	outreq.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	return outreq
+}
+
+// getToken returns the cached token of the datasource, a rejected token is
+// only replaced when no other request replaced it in the meantime
+func (t *oauthTransport) getToken(req *http.Request, rejected *oauthToken) (*oauthToken, error) {
+	key := oauthTokenCacheKey{id: t.ds.Id, updated: t.ds.Updated}
+
+	oauthTokenCache.Lock()
+	entry, exists := oauthTokenCache.tokens[key]
+	if !exists {
+		entry = &oauthTokenCacheEntry{}
+		oauthTokenCache.tokens[key] = entry
+	}
+	oauthTokenCache.Unlock()
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if entry.token != nil && entry.token != rejected && entry.token.valid() {
+		return entry.token, nil
+	}
+
+	token, err := t.fetchToken(req)
+	if err != nil {
+		entry.token = nil
+		return nil, err
+	}
+
+	entry.token = token
+	return token, nil
+}
+
+// fetchToken requests a new token, bound to the context of the proxied request
+func (t *oauthTransport) fetchToken(proxyReq *http.Request) (*oauthToken, error) {
+	jsonData := t.ds.JsonData
+	tokenUrl := jsonData.Get("oauthTokenUrl").MustString()
+	if tokenUrl == "" {
+		return nil, fmt.Errorf("OAuth token url is not configured")
+	}
+
+	params := url.Values{}
+	params.Set("grant_type", "client_credentials")
+	if scopes := jsonData.Get("oauthScopes").MustString(); scopes != "" {
+		params.Set("scope", scopes)
+	}
+
+	req, err := http.NewRequest("POST", tokenUrl, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(proxyReq.Context())
+
+	clientSecret := t.ds.SecureJsonData.Decrypt()["oauthClientSecret"]
+	req.SetBasicAuth(jsonData.Get("oauthClientId").MustString(), clientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := t.tokenTransport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("OAuth token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OAuth token request failed with status %d", resp.StatusCode)
+	}
+
+	token := &oauthToken{}
+	if err := json.NewDecoder(resp.Body).Decode(token); err != nil {
+		return nil, fmt.Errorf("Failed to parse OAuth token response: %v", err)
+	}
+
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("OAuth token response did not contain an access_token")
+	}
+
+	if token.ExpiresIn > 0 {
+		token.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - oauthTokenExpiryDelta)
+	}
+
+	return token, nil
+}
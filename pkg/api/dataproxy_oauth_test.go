@@ -0,0 +1,242 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/securejsondata"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/middleware"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func TestDataSourceProxyOAuth(t *testing.T) {
+	Convey("When passing the OAuth token of the user on", t, func() {
+		var backendAuth string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendAuth = r.Header.Get("Authorization")
+		}))
+		defer backend.Close()
+
+		json := simplejson.New()
+		json.Set("oauthPassThru", true)
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: json}
+			return nil
+		})
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+		session := testSessionStore{}
+		request := func() *httptest.ResponseRecorder {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/datasources/proxy/300/api/v1/query", nil)
+			req.Header.Set("X-DS-Authorization", "Bearer from-client")
+			proxyHandlerWithSession(user, session).ServeHTTP(resp, req)
+			return resp
+		}
+
+		Convey("Should send the token as bearer token", func() {
+			session.Set(middleware.SESS_KEY_OAUTH_ACCESS_TOKEN, "user-token")
+			session.Set(middleware.SESS_KEY_OAUTH_EXPIRY, time.Now().Add(time.Hour).Unix())
+
+			So(request().Code, ShouldEqual, 200)
+			So(backendAuth, ShouldEqual, "Bearer user-token")
+		})
+
+		Convey("Should reply 401 without a token", func() {
+			So(request().Code, ShouldEqual, 401)
+		})
+
+		Convey("Should reply 401 when the token expired", func() {
+			session.Set(middleware.SESS_KEY_OAUTH_ACCESS_TOKEN, "user-token")
+			session.Set(middleware.SESS_KEY_OAUTH_EXPIRY, time.Now().Add(-time.Minute).Unix())
+
+			So(request().Code, ShouldEqual, 401)
+		})
+	})
+
+	Convey("When proxying with OAuth client credentials", t, func() {
+		tokenRequests := 0
+		var grantType, clientId, clientSecret string
+		tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenRequests++
+			r.ParseForm()
+			grantType = r.PostForm.Get("grant_type")
+			clientId, clientSecret, _ = r.BasicAuth()
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"token%d","token_type":"bearer","expires_in":3600}`, tokenRequests)
+		}))
+		defer tokenServer.Close()
+
+		// the first token is rejected to test refreshing on 401
+		validToken := "Bearer token1"
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != validToken {
+				w.WriteHeader(401)
+				return
+			}
+			w.WriteHeader(200)
+		}))
+		defer backend.Close()
+
+		json := simplejson.New()
+		json.Set("oauthClientCredentials", true)
+		json.Set("oauthTokenUrl", tokenServer.URL)
+		json.Set("oauthClientId", "grafana")
+
+		ds := &m.DataSource{
+			Id:             20,
+			Type:           m.DS_PROMETHEUS,
+			Url:            backend.URL,
+			JsonData:       json,
+			SecureJsonData: securejsondata.GetEncryptedJsonData(map[string]string{"oauthClientSecret": "secret"}),
+		}
+		targetUrl, _ := url.Parse(ds.Url)
+
+		request := func() int {
+			transport, err := ds.GetHttpTransport()
+			So(err, ShouldBeNil)
+
+			proxy := NewReverseProxy(ds, "/api/v1/query", targetUrl)
+			proxy.Transport = newDataProxyTransport(ds, transport, false)
+
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://grafana.com/api/datasources/proxy/20/api/v1/query", nil)
+			proxy.ServeHTTP(resp, req)
+			return resp.Code
+		}
+
+		Convey("Should fetch a token with the client credentials and reuse it", func() {
+			So(request(), ShouldEqual, 200)
+			So(request(), ShouldEqual, 200)
+			So(tokenRequests, ShouldEqual, 1)
+			So(grantType, ShouldEqual, "client_credentials")
+			So(clientId, ShouldEqual, "grafana")
+			So(clientSecret, ShouldEqual, "secret")
+		})
+
+		Convey("Should fetch a new token when the backend rejects it", func() {
+			So(request(), ShouldEqual, 200)
+			validToken = "Bearer token2"
+			So(request(), ShouldEqual, 200)
+			So(tokenRequests, ShouldEqual, 2)
+		})
+
+		Convey("Should not add the api key of the datasource to token requests", func() {
+			var tokenQuery, backendQuery string
+			keyTokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tokenQuery = r.URL.RawQuery
+				fmt.Fprint(w, `{"access_token":"token1"}`)
+			}))
+			defer keyTokenServer.Close()
+
+			json.Set("oauthTokenUrl", keyTokenServer.URL)
+			json.Set("httpQueryParamName", "api_key")
+			ds.SecureJsonData = securejsondata.GetEncryptedJsonData(map[string]string{"oauthClientSecret": "secret", "httpQueryParamValue": "apisecret"})
+
+			transport, _ := ds.GetHttpTransport()
+			req, _ := http.NewRequest("GET", backend.URL+"/api/v1/query", nil)
+			resp, err := newDataProxyTransport(ds, &queryRecordingTransport{transport, &backendQuery}, false).RoundTrip(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			So(tokenQuery, ShouldEqual, "")
+			So(backendQuery, ShouldEqual, "api_key=apisecret")
+		})
+
+		Convey("Should not hold up other datasources while fetching a token", func() {
+			tokenRequested := make(chan bool, 1)
+			releaseToken := make(chan bool)
+			slowTokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tokenRequested <- true
+				<-releaseToken
+				fmt.Fprint(w, `{"access_token":"slow"}`)
+			}))
+			defer slowTokenServer.Close()
+			defer close(releaseToken)
+
+			slowJson := simplejson.New()
+			slowJson.Set("oauthClientCredentials", true)
+			slowJson.Set("oauthTokenUrl", slowTokenServer.URL)
+			slowDs := &m.DataSource{Id: 21, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: slowJson}
+
+			go func() {
+				transport, _ := slowDs.GetHttpTransport()
+				proxyTransport := newDataProxyTransport(slowDs, transport, false)
+				req, _ := http.NewRequest("GET", backend.URL+"/api/v1/query", nil)
+				if resp, err := proxyTransport.RoundTrip(req); err == nil {
+					resp.Body.Close()
+				}
+			}()
+
+			<-tokenRequested
+
+			transport, _ := ds.GetHttpTransport()
+			proxyTransport := newDataProxyTransport(ds, transport, false)
+			done := make(chan int)
+			go func() {
+				req, _ := http.NewRequest("GET", backend.URL+"/api/v1/query", nil)
+				resp, err := proxyTransport.RoundTrip(req)
+				if err != nil {
+					done <- 0
+					return
+				}
+				resp.Body.Close()
+				done <- resp.StatusCode
+			}()
+
+			select {
+			case status := <-done:
+				So(status, ShouldEqual, 200)
+			case <-time.After(5 * time.Second):
+				t.Fatal("token fetch of another datasource blocked the request")
+			}
+		})
+
+		Reset(func() {
+			oauthTokenCache.Lock()
+			oauthTokenCache.tokens = make(map[oauthTokenCacheKey]*oauthTokenCacheEntry)
+			oauthTokenCache.Unlock()
+		})
+	})
+}
+
+// queryRecordingTransport records the query of the last request to the backend
+type queryRecordingTransport struct {
+	transport http.RoundTripper
+	query     *string
+}
+
+func (t *queryRecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "GET" {
+		*t.query = req.URL.RawQuery
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// testSessionStore is an in memory session of a signed in user
+type testSessionStore map[interface{}]interface{}
+
+func (s testSessionStore) Set(key interface{}, value interface{}) error {
+	s[key] = value
+	return nil
+}
+
+func (s testSessionStore) Get(key interface{}) interface{} {
+	return s[key]
+}
+
+func (s testSessionStore) ID() string                          { return "test" }
+func (s testSessionStore) Release() error                      { return nil }
+func (s testSessionStore) Destory(c *middleware.Context) error { return nil }
+func (s testSessionStore) Start(c *middleware.Context) error   { return nil }
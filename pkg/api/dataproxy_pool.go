@@ -0,0 +1,151 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+
+	"github.com/grafana/grafana/pkg/metrics"
+)
+
+// proxyPool follows the connections of the datasource transports by host. The
+// transports count the connections they open and close, requests count the
+// connections they use and wait for, the rest of the open connections are idle
+type proxyPool struct {
+	open    int64
+	active  int64
+	waiting int64
+
+	idleGauge    metrics.Gauge
+	activeGauge  metrics.Gauge
+	waitingGauge metrics.Gauge
+}
+
+var proxyPools = struct {
+	sync.Mutex
+	hosts map[string]*proxyPool
+}{hosts: make(map[string]*proxyPool)}
+
+// graphite splits metric names on dots
+var proxyPoolHostReplacer = strings.NewReplacer(".", "_", ":", "_")
+
+func updateProxyPool(host string, open int64, active int64, waiting int64) {
+	proxyPools.Lock()
+	defer proxyPools.Unlock()
+
+	pool, exists := proxyPools.hosts[host]
+	if !exists {
+		tag := proxyPoolHostReplacer.Replace(host)
+		pool = &proxyPool{
+			idleGauge:    metrics.RegGauge("api.dataproxy.pool.idle", "host", tag),
+			activeGauge:  metrics.RegGauge("api.dataproxy.pool.active", "host", tag),
+			waitingGauge: metrics.RegGauge("api.dataproxy.pool.waiting", "host", tag),
+		}
+		proxyPools.hosts[host] = pool
+	}
+
+	pool.open += open
+	pool.active += active
+	pool.waiting += waiting
+
+	// http2 connections are used by several requests at once
+	idle := pool.open - pool.active
+	if idle < 0 {
+		idle = 0
+	}
+	pool.idleGauge.Update(idle)
+	pool.activeGauge.Update(pool.active)
+	pool.waitingGauge.Update(pool.waiting)
+}
+
+func updateProxyPoolConns(addr string, delta int64) {
+	updateProxyPool(addr, delta, 0, 0)
+}
+
+// proxyPoolTransport counts a request as waiting from the time it asks the
+// transport for a connection until it got one, the connection is active until
+// the response was read
+type proxyPoolTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *proxyPoolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &proxyPoolTrace{host: canonicalProxyAddr(req)}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GetConn: trace.getConn,
+		GotConn: trace.gotConn,
+	}))
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		trace.done()
+		return nil, err
+	}
+
+	resp.Body = &proxyInFlightBody{ReadCloser: resp.Body, done: trace.done}
+	return resp, nil
+}
+
+type proxyPoolTrace struct {
+	mu      sync.Mutex
+	host    string
+	waiting bool
+	active  bool
+}
+
+// getConn gets the first hop of the request, the one the dialed connections
+// are counted for
+func (p *proxyPoolTrace) getConn(hostPort string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.release()
+	p.host = hostPort
+	p.waiting = true
+	updateProxyPool(p.host, 0, 0, 1)
+}
+
+func (p *proxyPoolTrace) gotConn(info httptrace.GotConnInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.waiting {
+		p.waiting = false
+		updateProxyPool(p.host, 0, 0, -1)
+	}
+	if !p.active {
+		p.active = true
+		updateProxyPool(p.host, 0, 1, 0)
+	}
+}
+
+func (p *proxyPoolTrace) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.release()
+}
+
+func (p *proxyPoolTrace) release() {
+	if p.waiting {
+		p.waiting = false
+		updateProxyPool(p.host, 0, 0, -1)
+	}
+	if p.active {
+		p.active = false
+		updateProxyPool(p.host, 0, -1, 0)
+	}
+}
+
+// canonicalProxyAddr is the host:port of the request url, for transports
+// that report connections without asking for them
+func canonicalProxyAddr(req *http.Request) string {
+	if _, _, err := net.SplitHostPort(req.URL.Host); err == nil {
+		return req.URL.Host
+	}
+	if req.URL.Scheme == "https" {
+		return req.URL.Host + ":443"
+	}
+	return req.URL.Host + ":80"
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/metrics"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func getProxyPoolGauges(host string) (idle int64, active int64, waiting int64) {
+	proxyPools.Lock()
+	defer proxyPools.Unlock()
+
+	pool := proxyPools.hosts[host]
+	return pool.idleGauge.Value(), pool.activeGauge.Value(), pool.waitingGauge.Value()
+}
+
+func TestDataSourceProxyPool(t *testing.T) {
+	Convey("When following the connection pools of datasources", t, func() {
+		// metrics are disabled in tests, the gauges are registered on first use
+		// so they are real gauges for the hosts of this test
+		useNilMetrics := metrics.UseNilMetrics
+		metrics.UseNilMetrics = false
+		defer func() { metrics.UseNilMetrics = useNilMetrics }()
+
+		onConn := m.OnDataSourceConn
+		m.OnDataSourceConn = updateProxyPoolConns
+		defer func() { m.OnDataSourceConn = onConn }()
+
+		Convey("Should count the connections of requests as active until their response was read", func() {
+			release := make(chan bool)
+			var host string
+			var idle, active int64
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				idle, active, _ = getProxyPoolGauges(host)
+				<-release
+				w.Write([]byte("ok"))
+			}))
+			defer backend.Close()
+			host = backend.Listener.Addr().String()
+
+			ds := &m.DataSource{Id: 425, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: simplejson.New()}
+			transport, err := ds.GetHttpTransport()
+			So(err, ShouldBeNil)
+
+			go func() { release <- true }()
+			req, _ := http.NewRequest("GET", backend.URL+"/api/v1/query", nil)
+			resp, err := newDataProxyTransport(ds, transport, false).RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(idle, ShouldEqual, 0)
+			So(active, ShouldEqual, 1)
+
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			idle, active, _ = getProxyPoolGauges(host)
+			So(active, ShouldEqual, 0)
+			So(idle, ShouldEqual, 1)
+		})
+
+		Convey("Should count requests that wait for a connection", func() {
+			trace := &proxyPoolTrace{host: "pool.example.com:80"}
+			trace.getConn("pool.example.com:80")
+			_, active, waiting := getProxyPoolGauges("pool.example.com:80")
+			So(active, ShouldEqual, 0)
+			So(waiting, ShouldEqual, 1)
+
+			trace.gotConn(httptrace.GotConnInfo{})
+			_, active, waiting = getProxyPoolGauges("pool.example.com:80")
+			So(active, ShouldEqual, 1)
+			So(waiting, ShouldEqual, 0)
+
+			trace.done()
+			trace.done()
+			_, active, waiting = getProxyPoolGauges("pool.example.com:80")
+			So(active, ShouldEqual, 0)
+			So(waiting, ShouldEqual, 0)
+		})
+
+		Convey("Should name the hosts of the gauges without dots", func() {
+			updateProxyPool("prometheus.example.com:9090", 0, 0, 0)
+			proxyPools.Lock()
+			defer proxyPools.Unlock()
+			So(proxyPools.hosts["prometheus.example.com:9090"].idleGauge.StringifyTags(), ShouldEqual, ".host_prometheus_example_com_9090")
+		})
+	})
+}
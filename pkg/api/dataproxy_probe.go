@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana/pkg/api/keystone"
+	"github.com/grafana/grafana/pkg/middleware"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+const defaultProbeTimeout = 30 * time.Second
+
+// the request sent to test a datasource, types without one request the root
+var proxyProbes = map[string]string{
+	m.DS_PROMETHEUS:  "api/v1/query?query=1",
+	m.DS_GRAPHITE:    "metrics/find?query=*",
+	m.DS_INFLUXDB:    "ping",
+	m.DS_INFLUXDB_08: "ping",
+	m.DS_OPENTSDB:    "api/version",
+	m.DS_KAIROSDB:    "api/v1/version",
+}
+
+// ProxyDataSourceTest sends a probe request to the datasource through the data
+// proxy, with the same whitelist, auth and tls settings as proxied queries
+func ProxyDataSourceTest(c *middleware.Context) Response {
+	if setting.DataProxy().DisabledOrgs[c.OrgId] {
+		return ApiError(403, "The data proxy is disabled for this organization", nil)
+	}
+
+	ds, err := getDatasource(c.ParamsInt64(":id"), c.OrgId)
+	if err != nil {
+		if err == m.ErrDataSourceNotFound {
+			return ApiError(404, "Data source not found", nil)
+		}
+		return ApiError(500, "Unable to load datasource meta data", err)
+	}
+
+	if ds.Access != m.DS_ACCESS_PROXY {
+		return ApiError(400, "Only datasources with proxy access can be tested through the proxy", nil)
+	}
+
+	if ds.Type == m.DS_CLOUDWATCH || ds.Type == m.DS_AZURE_MONITOR || ds.Type == m.DS_STACKDRIVER {
+		return ApiError(400, fmt.Sprintf("Testing %s datasources through the proxy is not supported", ds.Type), nil)
+	}
+
+	if !isProxyTypeAllowed(ds) {
+		return ApiError(403, fmt.Sprintf("Datasources of type %s can not be reached through the proxy", ds.Type), nil)
+	}
+
+	targetUrl, err := parseDataSourceUrl(ds.Url)
+	if err != nil {
+		return ApiError(400, fmt.Sprintf("Invalid datasource url %q", ds.Url), err)
+	}
+
+	if socket := ds.UnixSocketPath(); socket != "" {
+		if len(setting.DataProxyWhiteList) > 0 && !isSocketInDataProxyWhiteList(socket) {
+			return ApiError(403, fmt.Sprintf("Data proxy socket %s is not included in whitelist", socket), nil)
+		}
+
+		if isBlockedSocket() {
+			return ApiError(403, fmt.Sprintf("Data proxy socket %s is blocked", socket), nil)
+		}
+	} else {
+		if len(setting.DataProxyWhiteList) > 0 && !isInDataProxyWhiteList(targetUrl) {
+			return ApiError(403, fmt.Sprintf("Data proxy host %s is not included in whitelist", targetUrl.Host), nil)
+		}
+
+		if resolvesToBlockedAddress(targetUrl) {
+			return ApiError(403, fmt.Sprintf("Data proxy host %s resolves to a blocked address", targetUrl.Host), nil)
+		}
+
+		if isGrafanaAddress(targetUrl) {
+			return ApiError(400, "Datasource url points at Grafana itself", nil)
+		}
+	}
+
+	probe := proxyProbes[ds.Type]
+	proxyPath, rawQuery := probe, ""
+	if i := strings.Index(probe, "?"); i >= 0 {
+		proxyPath, rawQuery = probe[:i], probe[i+1:]
+	}
+
+	req, err := http.NewRequest("GET", "/api/datasources/proxy/"+util.JoinUrlFragments(fmt.Sprint(ds.Id), proxyPath), nil)
+	if err != nil {
+		return ApiError(500, "Failed to create probe request", err)
+	}
+	req.URL.RawQuery = rawQuery
+	req.Header.Set("X-Request-ID", util.GetRandomString(32))
+
+	if usesKeystoneAuth(ds) {
+		token, err := keystone.GetToken(c, getKeystoneScope(ds))
+		if err != nil {
+			return ApiError(500, "Failed to get keystone token", err)
+		}
+		req.Header.Set("X-Auth-Token", token)
+	}
+
+	// the probe gives up even when proxied requests have no timeout
+	timeout := defaultProbeTimeout
+	if dsTimeout := getProxyTimeout(ds); dsTimeout > 0 {
+		timeout = time.Duration(dsTimeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(c.Req.Request.Context(), timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	transport, err := getProxyTransport(ds, c.SignedInUser)
+	if err != nil {
+		return ApiError(500, err.Error(), err)
+	}
+
+	proxy := NewReverseProxy(ds, proxyPath, targetUrl)
+	proxy.Transport = newDataProxyProbeTransport(ds, transport)
+
+	start := time.Now()
+	resp := httptest.NewRecorder()
+	proxy.ServeHTTP(resp, req)
+	latency := time.Since(start) / time.Millisecond
+
+	result := util.DynMap{
+		"status":        "success",
+		"message":       "Data source is working",
+		"backendStatus": resp.Code,
+		"latency":       int64(latency),
+	}
+
+	if resp.Code >= 400 {
+		result["status"] = "error"
+		result["message"] = fmt.Sprintf("Data source returned %d %s", resp.Code, http.StatusText(resp.Code))
+
+		// failed connections are described by the error response of the proxy
+		var proxyError struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(resp.Body.Bytes(), &proxyError) == nil && proxyError.Error != "" {
+			result["error"] = proxyError.Error
+		}
+	}
+
+	return Json(200, result)
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/log"
+	"github.com/grafana/grafana/pkg/middleware"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestDataSourceProxyProbe(t *testing.T) {
+	Convey("When testing a datasource through the proxy", t, func() {
+		var probePath, probeQuery string
+		backendStatus, backendHits := 200, 0
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendHits++
+			probePath = r.URL.Path
+			probeQuery = r.URL.RawQuery
+			w.WriteHeader(backendStatus)
+		}))
+		defer backend.Close()
+
+		dsUrl := backend.URL
+		bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Access: m.DS_ACCESS_PROXY, Url: dsUrl, JsonData: simplejson.New()}
+			return nil
+		})
+
+		probeRequest := func() *httptest.ResponseRecorder {
+			dataSourceCache.Lock()
+			dataSourceCache.items = make(map[dataSourceCacheKey]dataSourceCacheItem)
+			dataSourceCache.Unlock()
+
+			mac := macaron.New()
+			mac.Use(func(c *macaron.Context) {
+				c.Map(&middleware.Context{
+					Context:      c,
+					SignedInUser: &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_ADMIN},
+					IsSignedIn:   true,
+					Logger:       log.New("test"),
+				})
+			})
+			mac.Get("/api/datasources/:id/proxy-test", wrap(ProxyDataSourceTest))
+
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/datasources/160/proxy-test", nil)
+			mac.ServeHTTP(resp, req)
+			return resp
+		}
+
+		probe := func() map[string]interface{} {
+			resp := probeRequest()
+			So(resp.Code, ShouldEqual, 200)
+
+			var result map[string]interface{}
+			So(json.Unmarshal(resp.Body.Bytes(), &result), ShouldBeNil)
+			return result
+		}
+
+		Convey("Should send the probe query of the datasource type", func() {
+			result := probe()
+			So(result["status"], ShouldEqual, "success")
+			So(result["backendStatus"], ShouldEqual, 200)
+			So(probePath, ShouldEqual, "/api/v1/query")
+			So(probeQuery, ShouldEqual, "query=1")
+		})
+
+		Convey("Should report backend errors", func() {
+			backendStatus = 401
+			result := probe()
+			So(result["status"], ShouldEqual, "error")
+			So(result["backendStatus"], ShouldEqual, 401)
+		})
+
+		Convey("Should report connection errors", func() {
+			dsUrl = "http://127.0.0.1:1"
+			result := probe()
+			So(result["status"], ShouldEqual, "error")
+			So(result["backendStatus"], ShouldEqual, 502)
+			So(result["error"], ShouldNotBeEmpty)
+		})
+
+		Convey("Should not report cached or retried responses", func() {
+			oldTTL, oldRetries := setting.DataProxy().ResponseCacheTTL, setting.DataProxy().MaxRetries
+			setting.DataProxy().ResponseCacheTTL, setting.DataProxy().MaxRetries = 60, 2
+			defer func() { setting.DataProxy().ResponseCacheTTL, setting.DataProxy().MaxRetries = oldTTL, oldRetries }()
+
+			So(probe()["status"], ShouldEqual, "success")
+
+			backendStatus = 503
+			result := probe()
+			So(result["status"], ShouldEqual, "error")
+			So(result["backendStatus"], ShouldEqual, 503)
+			So(backendHits, ShouldEqual, 2)
+		})
+
+		Convey("Should apply the whitelist", func() {
+			oldWhiteList := setting.DataProxyWhiteList
+			setting.DataProxyWhiteList = map[string]bool{"prometheus:9090": true}
+			defer func() { setting.DataProxyWhiteList = oldWhiteList }()
+
+			So(probeRequest().Code, ShouldEqual, 403)
+		})
+
+		Reset(func() {
+			bus.ClearBusHandlers()
+		})
+	})
+}
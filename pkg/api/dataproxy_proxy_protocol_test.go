@@ -0,0 +1,105 @@
+package api
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// proxyProtocolListener reads the PROXY protocol header off the connections
+// it accepts, like a load balancer in front of the datasource
+type proxyProtocolListener struct {
+	net.Listener
+	mu      sync.Mutex
+	headers []string
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	header, _ := reader.ReadString('\n')
+	l.mu.Lock()
+	l.headers = append(l.headers, header)
+	l.mu.Unlock()
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+func TestDataSourceProxyProtocol(t *testing.T) {
+	Convey("When a datasource is behind a load balancer with the PROXY protocol", t, func() {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		listener := &proxyProtocolListener{Listener: inner}
+		go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer listener.Close()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			json := simplejson.NewFromAny(map[string]interface{}{"proxyProtocol": true})
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: "http://" + inner.Addr().String(), JsonData: json}
+			return nil
+		})
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+		request := func(remoteAddr string) int {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/datasources/proxy/402/api/v1/query", nil)
+			req.RemoteAddr = remoteAddr
+			req.Header.Set("X-Real-IP", "203.0.113.7")
+			proxyHandler(user).ServeHTTP(resp, req)
+			return resp.Code
+		}
+		_, port, _ := net.SplitHostPort(inner.Addr().String())
+		headers := func() []string {
+			listener.mu.Lock()
+			defer listener.mu.Unlock()
+			return listener.headers
+		}
+
+		Convey("Should send the address the client connected from", func() {
+			So(request("198.51.100.20:5000"), ShouldEqual, 200)
+			So(headers(), ShouldResemble, []string{"PROXY TCP4 198.51.100.20 127.0.0.1 5000 " + port + "\r\n"})
+		})
+
+		Convey("Should not reuse the connection of another client", func() {
+			So(request("198.51.100.20:5000"), ShouldEqual, 200)
+			So(request("198.51.100.21:5001"), ShouldEqual, 200)
+			So(headers(), ShouldResemble, []string{
+				"PROXY TCP4 198.51.100.20 127.0.0.1 5000 " + port + "\r\n",
+				"PROXY TCP4 198.51.100.21 127.0.0.1 5001 " + port + "\r\n",
+			})
+		})
+
+		Convey("Should send the client named by a trusted proxy", func() {
+			_, trusted, _ := net.ParseCIDR("192.0.2.0/24")
+			setting.DataProxy().TrustedProxies = []*net.IPNet{trusted}
+			defer func() { setting.DataProxy().TrustedProxies = nil }()
+
+			So(request("192.0.2.10:41234"), ShouldEqual, 200)
+			So(headers(), ShouldResemble, []string{"PROXY TCP4 203.0.113.7 127.0.0.1 0 " + port + "\r\n"})
+		})
+	})
+}
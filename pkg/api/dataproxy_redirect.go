@@ -0,0 +1,112 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+// headers that carry datasource credentials, they are only sent on redirects
+// to the host of the original request
+var proxyCredentialHeaders = []string{"Authorization", "X-Auth-Token", "Cookie"}
+
+// getProxyMaxRedirects returns the followRedirects json data option, the number
+// of backend redirects followed by the proxy. 0 passes redirects to the client
+func getProxyMaxRedirects(ds *m.DataSource) int {
+	if ds.JsonData == nil {
+		return 0
+	}
+	return ds.JsonData.Get("followRedirects").MustInt(0)
+}
+
+// proxyRedirectTransport follows backend redirects on the server, for backends
+// that redirect to locations the browser can not reach
+type proxyRedirectTransport struct {
+	transport    http.RoundTripper
+	maxRedirects int
+	// the requests of unix socket datasources are sent to the socket whatever
+	// their host, it was checked against the whitelist already
+	socket bool
+}
+
+func (t *proxyRedirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	visited := map[string]bool{req.URL.String(): true}
+	outreq := req
+
+	for redirects := 0; ; redirects++ {
+		resp, err := t.transport.RoundTrip(outreq)
+		if err != nil || !isProxyRedirect(resp) {
+			return resp, err
+		}
+
+		location, err := resp.Location()
+		if err != nil {
+			// no usable location, the redirect is passed on as it is
+			return resp, nil
+		}
+
+		nextreq, ok := newProxyRedirectRequest(outreq, resp.StatusCode, location.String())
+		if !ok {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		if visited[nextreq.URL.String()] || redirects >= t.maxRedirects {
+			dataproxyLogger.Warn("Proxy redirect loop", "url", redactUrl(req.URL), "requestId", req.Header.Get("X-Request-ID"), "redirects", redirects)
+			return newProxyJsonResponse(req, 508, util.DynMap{
+				"message": fmt.Sprintf("Datasource redirected more than %d times or in a loop", t.maxRedirects),
+			}), nil
+		}
+
+		if len(setting.DataProxyWhiteList) > 0 && !t.socket && !isInDataProxyWhiteList(nextreq.URL) {
+			return newProxyJsonResponse(req, 403, util.DynMap{
+				"message": fmt.Sprintf("Data proxy host %s is not included in whitelist", nextreq.URL.Host),
+			}), nil
+		}
+
+		visited[nextreq.URL.String()] = true
+		outreq = nextreq
+	}
+}
+
+func isProxyRedirect(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case 301, 302, 303, 307, 308:
+		return true
+	}
+	return false
+}
+
+// newProxyRedirectRequest builds the request for a redirect the way browsers
+// do, it returns false for redirects that would have to replay a request body
+func newProxyRedirectRequest(req *http.Request, status int, location string) (*http.Request, bool) {
+	target, err := req.URL.Parse(location)
+	if err != nil {
+		return nil, false
+	}
+
+	outreq := cloneProxyRequest(req)
+	outreq.URL = target
+	outreq.Host = target.Host
+
+	if status == 303 || ((status == 301 || status == 302) && req.Method == "POST") {
+		outreq.Method = "GET"
+		outreq.Body = nil
+		outreq.ContentLength = 0
+		outreq.Header.Del("Content-Type")
+		outreq.Header.Del("Content-Length")
+	} else if req.Body != nil {
+		return nil, false
+	}
+
+	if target.Host != req.URL.Host {
+		for _, name := range proxyCredentialHeaders {
+			outreq.Header.Del(name)
+		}
+	}
+
+	return outreq, true
+}
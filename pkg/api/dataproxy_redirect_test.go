@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func TestDataSourceProxyRedirects(t *testing.T) {
+	Convey("When the backend redirects", t, func() {
+		var otherHostAuth string
+		otherHost := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			otherHostAuth = r.Header.Get("Authorization")
+			w.Write([]byte("rendered"))
+		}))
+		defer otherHost.Close()
+
+		var finalAuth string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/render":
+				http.Redirect(w, r, "/render/signed", 302)
+			case "/render/signed":
+				finalAuth = r.Header.Get("Authorization")
+				w.Write([]byte("rendered"))
+			case "/external":
+				http.Redirect(w, r, otherHost.URL+"/image", 302)
+			case "/loop":
+				http.Redirect(w, r, "/loop2", 302)
+			case "/loop2":
+				http.Redirect(w, r, "/loop", 302)
+			}
+		}))
+		defer backend.Close()
+
+		json := simplejson.New()
+		json.Set("followRedirects", 3)
+
+		ds := &m.DataSource{
+			Id:                110,
+			Type:              m.DS_GRAPHITE,
+			Url:               backend.URL,
+			BasicAuth:         true,
+			BasicAuthUser:     "user",
+			BasicAuthPassword: "password",
+			JsonData:          json,
+		}
+		targetUrl, _ := url.Parse(ds.Url)
+
+		request := func(path string) *httptest.ResponseRecorder {
+			transport, err := ds.GetHttpTransport()
+			So(err, ShouldBeNil)
+
+			proxy := NewReverseProxy(ds, path, targetUrl)
+			proxy.Transport = newDataProxyTransport(ds, transport, false)
+
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://grafana.com/api/datasources/proxy/110/"+path, nil)
+			proxy.ServeHTTP(resp, req)
+			return resp
+		}
+
+		Convey("Should return the final response with the auth header", func() {
+			resp := request("render")
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldEqual, "rendered")
+			So(finalAuth, ShouldNotBeEmpty)
+		})
+
+		Convey("Should not send the auth header to other hosts", func() {
+			resp := request("external")
+			So(resp.Code, ShouldEqual, 200)
+			So(otherHostAuth, ShouldBeEmpty)
+		})
+
+		Convey("Should return 508 on a redirect loop", func() {
+			So(request("loop").Code, ShouldEqual, 508)
+		})
+
+		Convey("Should pass the redirect on when following is disabled", func() {
+			json.Set("followRedirects", 0)
+			resp := request("render")
+			So(resp.Code, ShouldEqual, 302)
+			So(resp.Header().Get("Location"), ShouldEqual, "/render/signed")
+		})
+	})
+}
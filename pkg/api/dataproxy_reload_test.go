@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// run with -race, the settings are reloaded while requests read them
+func TestDataSourceProxyReload(t *testing.T) {
+	Convey("When the data proxy settings are reloaded while requests are proxied", t, func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"status":"success"}`))
+		}))
+		defer backend.Close()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: simplejson.New()}
+			return nil
+		})
+
+		homePath := setting.HomePath
+		settings := *setting.DataProxy()
+		setting.HomePath = "../../"
+		defer func() {
+			setting.HomePath = homePath
+			*setting.DataProxy() = settings
+		}()
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+		var wg sync.WaitGroup
+		codes := make(chan int, 200)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					codes <- proxyHandlerRequest(user, "GET", "/api/datasources/proxy/450/api/v1/query").Code
+				}
+			}()
+		}
+
+		var reloadErr error
+		for i := 0; i < 20 && reloadErr == nil; i++ {
+			reloadErr = setting.ReloadDataProxySettings(&setting.CommandLineArgs{HomePath: "../../"})
+			m.CloseDataSourceTransports()
+		}
+		wg.Wait()
+		close(codes)
+
+		So(reloadErr, ShouldBeNil)
+		for code := range codes {
+			So(code, ShouldEqual, 200)
+		}
+	})
+}
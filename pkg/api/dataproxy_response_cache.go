@@ -0,0 +1,377 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+// responses larger than this are passed on without being cached
+const maxCachedProxyResponseSize = 1 << 20
+
+// limits of the whole cache, the entries closest to expiring are evicted first
+const (
+	maxProxyResponseCacheItems = 1000
+	maxProxyResponseCacheBytes = 64 << 20
+)
+
+// request headers that change the response or identify the user, requests
+// that differ in any of them never share a cache entry
+var proxyCacheKeyHeaders = []string{"Accept", "Accept-Encoding", "Authorization", "X-DS-Authorization", "X-Auth-Token", "X-Grafana-User", "Cookie"}
+
+// the client address is passed on with forwardClientIp, the backend can answer
+// depending on it so clients at different addresses never share cache entries
+var proxyCacheForwardedHeaders = []string{"X-Real-IP", "X-Forwarded-For"}
+
+// proxyNoCacheParam forces a refresh like a Cache-Control: no-cache request
+// header, for clients that can not set headers. It is not sent to the backend
+const proxyNoCacheParam = "_grafana_no_cache"
+
+type proxyNoCacheKey struct{}
+
+// withProxyNoCache removes the _grafana_no_cache parameter from the request,
+// cached responses are not used for requests with it or with a no-cache
+// Cache-Control header. Their response is cached again for the next requests
+func withProxyNoCache(req *http.Request) *http.Request {
+	noCache := false
+	if values, ok := req.URL.Query()[proxyNoCacheParam]; ok {
+		noCache = values[0] != "0" && values[0] != "false"
+		req.URL.RawQuery = removeQueryParam(req.URL.RawQuery, proxyNoCacheParam)
+	}
+	for _, directive := range strings.Split(req.Header.Get("Cache-Control"), ",") {
+		if strings.ToLower(strings.TrimSpace(directive)) == "no-cache" {
+			noCache = true
+		}
+	}
+
+	if !noCache {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), proxyNoCacheKey{}, true))
+}
+
+func isProxyNoCache(req *http.Request) bool {
+	noCache, _ := req.Context().Value(proxyNoCacheKey{}).(bool)
+	return noCache
+}
+
+type proxyResponseCacheItem struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+	// set with data_proxy_response_cache_etag, expired responses with an ETag
+	// are revalidated with If-None-Match instead of being fetched again
+	etag string
+}
+
+var proxyResponseCache = struct {
+	sync.Mutex
+	items map[string]*proxyResponseCacheItem
+	bytes int
+}{items: make(map[string]*proxyResponseCacheItem)}
+
+// proxyResponseCacheTransport caches successful GET responses for up to
+// maxTTL, or shorter when the backend sends a Cache-Control max-age
+type proxyResponseCacheTransport struct {
+	transport  http.RoundTripper
+	ds         *m.DataSource
+	maxTTL     time.Duration
+	revalidate bool
+	// fingerprint of the tls client certificate the backend is reached with,
+	// users with their own certificate never share cached responses
+	clientCert string
+}
+
+func (t *proxyResponseCacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// event streams do not end, they are passed on as they arrive
+	if req.Method != "GET" || req.Header.Get("Range") != "" || isEventStreamRequest(req) {
+		return t.transport.RoundTrip(req)
+	}
+
+	key := getProxyCacheKey(t.ds, t.clientCert, req)
+	item, fresh := getCachedProxyResponse(key)
+	if fresh && !isProxyNoCache(req) {
+		return item.response(req, "hit"), nil
+	}
+	// a forced refresh still revalidates with the ETag, the backend decides
+	// whether the cached response is current
+	if item != nil && item.etag == "" {
+		item = nil
+	}
+
+	// a client that revalidates its own copy gets the answer of the backend
+	outreq := req
+	if item != nil && req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" {
+		outreq = cloneProxyRequest(req)
+		outreq.Header.Set("If-None-Match", item.etag)
+	}
+
+	resp, err := t.transport.RoundTrip(outreq)
+	if err != nil {
+		return resp, err
+	}
+	if outreq != req && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return t.revalidated(key, item, resp.Header).response(req, "revalidated"), nil
+	}
+	if resp.StatusCode != 200 || isEventStreamResponse(resp.Header) {
+		return resp, nil
+	}
+
+	ttl, cacheable := getProxyResponseTTL(resp.Header, t.maxTTL)
+	etag := ""
+	if t.revalidate {
+		etag = resp.Header.Get("ETag")
+	}
+	if !cacheable || (ttl <= 0 && etag == "") || resp.ContentLength > maxCachedProxyResponseSize {
+		return resp, nil
+	}
+
+	// the round trippers above change the headers of the response they pass
+	// on, the cached ones are those of the stored body
+	header := cloneProxyHeader(resp.Header)
+	resp.Body = &cachingProxyBody{
+		ReadCloser: resp.Body,
+		store: func(body []byte) {
+			cacheProxyResponse(key, &proxyResponseCacheItem{
+				status:  resp.StatusCode,
+				header:  header,
+				body:    body,
+				expires: time.Now().Add(ttl),
+				etag:    etag,
+			})
+		},
+	}
+
+	return resp, nil
+}
+
+// revalidated caches the response again with the headers of the 304 response
+// of the backend, which replace the stored ones
+func (t *proxyResponseCacheTransport) revalidated(key string, item *proxyResponseCacheItem, notModified http.Header) *proxyResponseCacheItem {
+	header := cloneProxyHeader(item.header)
+	for name, values := range notModified {
+		if name != "Content-Length" {
+			header[name] = values
+		}
+	}
+
+	updated := &proxyResponseCacheItem{status: item.status, header: header, body: item.body, etag: item.etag}
+	if etag := header.Get("ETag"); etag != "" {
+		updated.etag = etag
+	}
+
+	ttl, cacheable := getProxyResponseTTL(header, t.maxTTL)
+	if !cacheable {
+		proxyResponseCache.Lock()
+		removeCachedProxyResponse(key)
+		proxyResponseCache.Unlock()
+		return updated
+	}
+
+	updated.expires = time.Now().Add(ttl)
+	cacheProxyResponse(key, updated)
+	return updated
+}
+
+func getProxyCacheKey(ds *m.DataSource, clientCert string, req *http.Request) string {
+	parts := []string{strconv.FormatInt(ds.OrgId, 10), strconv.FormatInt(ds.Id, 10), ds.Updated.String(), clientCert, req.Method, req.URL.String()}
+	for _, name := range proxyCacheKeyHeaders {
+		parts = append(parts, req.Header.Get(name))
+	}
+	if usesProxyForwardedFor(ds) {
+		for _, name := range proxyCacheForwardedHeaders {
+			parts = append(parts, strings.Join(req.Header[name], ", "))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func isEventStreamResponse(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// getProxyResponseTTL honors the Cache-Control of the backend, without one the
+// response is cached for maxTTL. A no-cache response is only stored to be
+// revalidated
+func getProxyResponseTTL(header http.Header, maxTTL time.Duration) (time.Duration, bool) {
+	if header.Get("Set-Cookie") != "" || header.Get("Vary") == "*" {
+		return 0, false
+	}
+
+	ttl := maxTTL
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "private":
+			return 0, false
+		case directive == "no-cache":
+			ttl = 0
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			if maxAge := time.Duration(seconds) * time.Second; maxAge < ttl {
+				ttl = maxAge
+			}
+		}
+	}
+
+	return ttl, true
+}
+
+// getCachedProxyResponse returns the cached response and whether it is still
+// fresh, expired responses are only kept when they can be revalidated
+func getCachedProxyResponse(key string) (item *proxyResponseCacheItem, fresh bool) {
+	proxyResponseCache.Lock()
+	defer proxyResponseCache.Unlock()
+
+	item, exists := proxyResponseCache.items[key]
+	if !exists {
+		return nil, false
+	}
+
+	if time.Now().After(item.expires) {
+		if item.etag == "" {
+			removeCachedProxyResponse(key)
+			return nil, false
+		}
+		return item, false
+	}
+
+	return item, true
+}
+
+func cacheProxyResponse(key string, item *proxyResponseCacheItem) {
+	proxyResponseCache.Lock()
+	defer proxyResponseCache.Unlock()
+
+	removeCachedProxyResponse(key)
+
+	// expired entries of queries that are not repeated are only removed here
+	if proxyResponseCacheFull(len(item.body)) {
+		now := time.Now()
+		for k, cached := range proxyResponseCache.items {
+			if now.After(cached.expires) {
+				removeCachedProxyResponse(k)
+			}
+		}
+	}
+
+	for len(proxyResponseCache.items) > 0 && proxyResponseCacheFull(len(item.body)) {
+		removeCachedProxyResponse(firstExpiringProxyResponse())
+	}
+
+	proxyResponseCache.items[key] = item
+	proxyResponseCache.bytes += len(item.body)
+}
+
+// proxyResponseCacheFull must be called with the cache locked
+func proxyResponseCacheFull(size int) bool {
+	return len(proxyResponseCache.items) >= maxProxyResponseCacheItems || proxyResponseCache.bytes+size > maxProxyResponseCacheBytes
+}
+
+// removeCachedProxyResponse must be called with the cache locked
+func removeCachedProxyResponse(key string) {
+	if item, exists := proxyResponseCache.items[key]; exists {
+		proxyResponseCache.bytes -= len(item.body)
+		delete(proxyResponseCache.items, key)
+	}
+}
+
+// firstExpiringProxyResponse must be called with the cache locked
+func firstExpiringProxyResponse() string {
+	var first string
+	var expires time.Time
+	for key, item := range proxyResponseCache.items {
+		if first == "" || item.expires.Before(expires) {
+			first, expires = key, item.expires
+		}
+	}
+	return first
+}
+
+// response answers from the cache, cacheStatus is the X-Grafana-Proxy-Cache
+// header that tells the client whether the backend was asked
+func (item *proxyResponseCacheItem) response(req *http.Request, cacheStatus string) *http.Response {
+	header := cloneProxyHeader(item.header)
+	header.Set("X-Grafana-Proxy-Cache", cacheStatus)
+
+	return &http.Response{
+		StatusCode:    item.status,
+		Status:        strconv.Itoa(item.status) + " " + http.StatusText(item.status),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(item.body)),
+		ContentLength: int64(len(item.body)),
+		Request:       req,
+	}
+}
+
+func cloneProxyHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header)+1)
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// cachingProxyBody keeps a copy of the body while it is streamed to the
+// client and stores it once it has been read completely
+type cachingProxyBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	store    func([]byte)
+	tooLarge bool
+}
+
+func (b *cachingProxyBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.tooLarge {
+		if b.buf.Len()+n > maxCachedProxyResponseSize {
+			b.tooLarge = true
+			b.buf.Reset()
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF && !b.tooLarge && b.store != nil {
+		b.store(b.buf.Bytes())
+		b.store = nil
+	}
+
+	return n, err
+}
+
+// getClientCertFingerprint returns the sha256 of the tls client certificate of
+// the transport, empty without one
+func getClientCertFingerprint(transport http.RoundTripper) string {
+	httpTransport, ok := transport.(*http.Transport)
+	if !ok || httpTransport.TLSClientConfig == nil {
+		return ""
+	}
+
+	certs := httpTransport.TLSClientConfig.Certificates
+	if len(certs) == 0 || len(certs[0].Certificate) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(certs[0].Certificate[0]))
+}
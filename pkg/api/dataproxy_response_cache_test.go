@@ -0,0 +1,407 @@
+package api
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestDataSourceProxyResponseCache(t *testing.T) {
+	Convey("When caching proxied responses", t, func() {
+		setting.DataProxy().ResponseCacheTTL = 10
+
+		backendRequests := 0
+		cacheControl := ""
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendRequests++
+			if cacheControl != "" {
+				w.Header().Set("Cache-Control", cacheControl)
+			}
+			if r.URL.Path == "/api/v1/events" {
+				w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+			}
+			if r.URL.Path == "/api/v1/missing" {
+				w.WriteHeader(404)
+				return
+			}
+			fmt.Fprintf(w, "response %d", backendRequests)
+		}))
+		defer backend.Close()
+
+		ds := &m.DataSource{Id: 140, OrgId: 1, Type: m.DS_PROMETHEUS, Url: backend.URL}
+		targetUrl, _ := url.Parse(ds.Url)
+
+		request := func(ds *m.DataSource, method string, path string) *httptest.ResponseRecorder {
+			transport, err := ds.GetHttpTransport()
+			So(err, ShouldBeNil)
+
+			proxy := NewReverseProxy(ds, path, targetUrl)
+			proxy.Transport = newDataProxyTransport(ds, transport, false)
+
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, "http://grafana.com/api/datasources/proxy/140/"+path+"?query=up", nil)
+			proxy.ServeHTTP(resp, req)
+			return resp
+		}
+
+		Convey("Should answer identical GET queries from the cache", func() {
+			So(request(ds, "GET", "api/v1/query").Body.String(), ShouldEqual, "response 1")
+			resp := request(ds, "GET", "api/v1/query")
+			So(resp.Body.String(), ShouldEqual, "response 1")
+			So(resp.Header().Get("X-Grafana-Proxy-Cache"), ShouldEqual, "hit")
+			So(backendRequests, ShouldEqual, 1)
+		})
+
+		Convey("Should not share entries between orgs", func() {
+			request(ds, "GET", "api/v1/query")
+			otherOrg := &m.DataSource{Id: 140, OrgId: 2, Type: m.DS_PROMETHEUS, Url: backend.URL}
+			So(request(otherOrg, "GET", "api/v1/query").Body.String(), ShouldEqual, "response 2")
+		})
+
+		Convey("Should not share entries between users with their own client certificate", func() {
+			GetUserClientCertificate = func(ds *m.DataSource, user *m.SignedInUser) (*tls.Certificate, error) {
+				return &tls.Certificate{Certificate: [][]byte{[]byte(fmt.Sprint("user", user.UserId))}}, nil
+			}
+			defer func() { GetUserClientCertificate = nil }()
+
+			userRequest := func(user *m.SignedInUser) string {
+				transport, err := getProxyTransport(ds, user)
+				So(err, ShouldBeNil)
+
+				proxy := NewReverseProxy(ds, "api/v1/query", targetUrl)
+				proxy.Transport = newDataProxyTransport(ds, transport, false)
+
+				resp := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "http://grafana.com/api/datasources/proxy/140/api/v1/query?query=up", nil)
+				proxy.ServeHTTP(resp, req)
+				return resp.Body.String()
+			}
+
+			So(userRequest(&m.SignedInUser{OrgId: 1, UserId: 1}), ShouldEqual, "response 1")
+			So(userRequest(&m.SignedInUser{OrgId: 1, UserId: 1}), ShouldEqual, "response 1")
+			So(userRequest(&m.SignedInUser{OrgId: 1, UserId: 2}), ShouldEqual, "response 2")
+		})
+
+		Convey("Should not share entries between clients with forwardClientIp", func() {
+			forwarding := &m.DataSource{Id: 141, OrgId: 1, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: simplejson.NewFromAny(map[string]interface{}{"forwardClientIp": true})}
+			clientRequest := func(remoteAddr string) string {
+				transport, err := forwarding.GetHttpTransport()
+				So(err, ShouldBeNil)
+
+				proxy := NewReverseProxy(forwarding, "api/v1/query", targetUrl)
+				proxy.Transport = newDataProxyTransport(forwarding, transport, false)
+
+				resp := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "http://grafana.com/api/datasources/proxy/141/api/v1/query?query=up", nil)
+				req.RemoteAddr = remoteAddr
+				proxy.ServeHTTP(resp, req)
+				return resp.Body.String()
+			}
+
+			So(clientRequest("192.0.2.10:41234"), ShouldEqual, "response 1")
+			So(clientRequest("192.0.2.10:41235"), ShouldEqual, "response 1")
+			So(clientRequest("192.0.2.11:41234"), ShouldEqual, "response 2")
+		})
+
+		Convey("Should not cache event streams", func() {
+			eventStream := func(accept string) *httptest.ResponseRecorder {
+				transport, err := ds.GetHttpTransport()
+				So(err, ShouldBeNil)
+
+				proxy := NewReverseProxy(ds, "api/v1/events", targetUrl)
+				proxy.Transport = newDataProxyTransport(ds, transport, false)
+
+				resp := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "http://grafana.com/api/datasources/proxy/140/api/v1/events", nil)
+				req.Header.Set("Accept", accept)
+				proxy.ServeHTTP(resp, req)
+				return resp
+			}
+
+			eventStream("text/event-stream")
+			So(eventStream("text/event-stream").Header().Get("X-Grafana-Proxy-Cache"), ShouldEqual, "")
+			eventStream("*/*")
+			So(eventStream("*/*").Header().Get("X-Grafana-Proxy-Cache"), ShouldEqual, "")
+			So(backendRequests, ShouldEqual, 4)
+		})
+
+		Convey("Should only cache GET requests with a 200 response", func() {
+			request(ds, "POST", "api/v1/query")
+			request(ds, "POST", "api/v1/query")
+			request(ds, "GET", "api/v1/missing")
+			request(ds, "GET", "api/v1/missing")
+			So(backendRequests, ShouldEqual, 4)
+		})
+
+		Convey("Should honor no-store from the backend", func() {
+			cacheControl = "no-store"
+			request(ds, "GET", "api/v1/query")
+			request(ds, "GET", "api/v1/query")
+			So(backendRequests, ShouldEqual, 2)
+		})
+
+		Convey("Should use a shorter max-age of the backend", func() {
+			ttl, cacheable := getProxyResponseTTL(http.Header{"Cache-Control": []string{"public, max-age=5"}}, 10*time.Second)
+			So(cacheable, ShouldBeTrue)
+			So(ttl, ShouldEqual, 5*time.Second)
+
+			ttl, _ = getProxyResponseTTL(http.Header{"Cache-Control": []string{"max-age=60"}}, 10*time.Second)
+			So(ttl, ShouldEqual, 10*time.Second)
+		})
+
+		Convey("Should evict the entries closest to expiring when the cache is full", func() {
+			now := time.Now()
+			for i := 0; i < maxProxyResponseCacheItems; i++ {
+				cacheProxyResponse(fmt.Sprint(i), &proxyResponseCacheItem{status: 200, body: []byte("x"), expires: now.Add(time.Duration(i+1) * time.Minute)})
+			}
+			cacheProxyResponse("new", &proxyResponseCacheItem{status: 200, body: []byte("x"), expires: now.Add(time.Hour)})
+
+			So(len(proxyResponseCache.items), ShouldEqual, maxProxyResponseCacheItems)
+			_, exists := getCachedProxyResponse("0")
+			So(exists, ShouldBeFalse)
+			_, exists = getCachedProxyResponse("new")
+			So(exists, ShouldBeTrue)
+		})
+
+		Convey("Should limit the size of the cached bodies", func() {
+			body := make([]byte, maxCachedProxyResponseSize)
+			for i := 0; i < maxProxyResponseCacheBytes/maxCachedProxyResponseSize+5; i++ {
+				cacheProxyResponse(fmt.Sprint(i), &proxyResponseCacheItem{status: 200, body: body, expires: time.Now().Add(time.Minute)})
+			}
+
+			So(proxyResponseCache.bytes, ShouldBeLessThanOrEqualTo, maxProxyResponseCacheBytes)
+			So(len(proxyResponseCache.items), ShouldEqual, maxProxyResponseCacheBytes/maxCachedProxyResponseSize)
+		})
+
+		Reset(func() {
+			setting.DataProxy().ResponseCacheTTL = 0
+			setting.DataProxy().ResponseCacheETag = false
+			proxyResponseCache.Lock()
+			proxyResponseCache.items = make(map[string]*proxyResponseCacheItem)
+			proxyResponseCache.bytes = 0
+			proxyResponseCache.Unlock()
+		})
+	})
+
+	Convey("When forcing a refresh of cached responses", t, func() {
+		setting.DataProxy().ResponseCacheTTL = 10
+
+		var backendQueries []string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendQueries = append(backendQueries, r.URL.RawQuery)
+			fmt.Fprintf(w, "response %d", len(backendQueries))
+		}))
+		defer backend.Close()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: simplejson.New()}
+			return nil
+		})
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+		request := func(query string, header http.Header) *httptest.ResponseRecorder {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/datasources/proxy/415/api/v1/query?"+query, nil)
+			for name, values := range header {
+				req.Header[name] = values
+			}
+			proxyHandler(user).ServeHTTP(resp, req)
+			return resp
+		}
+
+		Convey("Should ask the backend with _grafana_no_cache and cache its response", func() {
+			request("query=up", nil)
+			So(request("query=up&_grafana_no_cache=1", nil).Body.String(), ShouldEqual, "response 2")
+			So(backendQueries, ShouldResemble, []string{"query=up", "query=up"})
+
+			resp := request("query=up", nil)
+			So(resp.Body.String(), ShouldEqual, "response 2")
+			So(resp.Header().Get("X-Grafana-Proxy-Cache"), ShouldEqual, "hit")
+		})
+
+		Convey("Should ask the backend with a no-cache request header", func() {
+			request("query=up", nil)
+			So(request("query=up", http.Header{"Cache-Control": []string{"no-cache"}}).Body.String(), ShouldEqual, "response 2")
+		})
+
+		Convey("Should use the cache when the parameter is 0", func() {
+			request("query=up", nil)
+			So(request("query=up&_grafana_no_cache=0", nil).Body.String(), ShouldEqual, "response 1")
+			So(backendQueries, ShouldResemble, []string{"query=up"})
+		})
+
+		Reset(func() {
+			setting.DataProxy().ResponseCacheTTL = 0
+			proxyResponseCache.Lock()
+			proxyResponseCache.items = make(map[string]*proxyResponseCacheItem)
+			proxyResponseCache.bytes = 0
+			proxyResponseCache.Unlock()
+		})
+	})
+
+	Convey("When caching compressed backend responses", t, func() {
+		setting.DataProxy().ResponseCacheTTL = 10
+
+		backendRequests := 0
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendRequests++
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte("compressed"))
+			gz.Close()
+		}))
+		defer backend.Close()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			json := simplejson.New()
+			json.Set("compressBackendResponses", true)
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: json}
+			return nil
+		})
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+		request := func(acceptEncoding string) *httptest.ResponseRecorder {
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/datasources/proxy/445/api/v1/query?query=up", nil)
+			if acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", acceptEncoding)
+			}
+			proxyHandler(user).ServeHTTP(resp, req)
+			return resp
+		}
+
+		Convey("Should decompress cached responses for clients that do not accept gzip", func() {
+			So(request("").Body.String(), ShouldEqual, "compressed")
+
+			resp := request("")
+			So(resp.Header().Get("X-Grafana-Proxy-Cache"), ShouldEqual, "hit")
+			So(resp.Header().Get("Content-Encoding"), ShouldEqual, "")
+			So(resp.Body.String(), ShouldEqual, "compressed")
+			So(backendRequests, ShouldEqual, 1)
+		})
+
+		Convey("Should pass cached responses on compressed to clients that accept gzip", func() {
+			request("")
+
+			resp := request("gzip")
+			So(resp.Header().Get("X-Grafana-Proxy-Cache"), ShouldEqual, "hit")
+			So(resp.Header().Get("Content-Encoding"), ShouldEqual, "gzip")
+			zr, err := gzip.NewReader(resp.Body)
+			So(err, ShouldBeNil)
+			body, _ := ioutil.ReadAll(zr)
+			So(string(body), ShouldEqual, "compressed")
+		})
+
+		Reset(func() {
+			setting.DataProxy().ResponseCacheTTL = 0
+			proxyResponseCache.Lock()
+			proxyResponseCache.items = make(map[string]*proxyResponseCacheItem)
+			proxyResponseCache.bytes = 0
+			proxyResponseCache.Unlock()
+		})
+	})
+
+	Convey("When revalidating cached responses with ETags", t, func() {
+		setting.DataProxy().ResponseCacheETag = true
+
+		backendRequests := 0
+		var ifNoneMatch []string
+		etag := `"v1"`
+		cacheControl := ""
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendRequests++
+			ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+			if cacheControl != "" {
+				w.Header().Set("Cache-Control", cacheControl)
+			}
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(304)
+				return
+			}
+			fmt.Fprintf(w, "labels %d", backendRequests)
+		}))
+		defer backend.Close()
+
+		targetUrl, _ := url.Parse(backend.URL)
+		request := func(orgId int64, header http.Header) *httptest.ResponseRecorder {
+			ds := &m.DataSource{Id: 330, OrgId: orgId, Type: m.DS_PROMETHEUS, Url: backend.URL}
+			transport, err := ds.GetHttpTransport()
+			So(err, ShouldBeNil)
+
+			proxy := NewReverseProxy(ds, "api/v1/label/job/values", targetUrl)
+			proxy.Transport = newDataProxyTransport(ds, transport, false)
+
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://grafana.com/api/datasources/proxy/330/api/v1/label/job/values", nil)
+			for name, values := range header {
+				req.Header[name] = values
+			}
+			proxy.ServeHTTP(resp, req)
+			return resp
+		}
+
+		Convey("Should answer a 304 of the backend with the cached body", func() {
+			So(request(1, nil).Body.String(), ShouldEqual, "labels 1")
+
+			resp := request(1, nil)
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldEqual, "labels 1")
+			So(resp.Header().Get("X-Grafana-Proxy-Cache"), ShouldEqual, "revalidated")
+			So(ifNoneMatch, ShouldResemble, []string{"", `"v1"`})
+		})
+
+		Convey("Should fetch the response again when it changed", func() {
+			request(1, nil)
+			etag = `"v2"`
+			So(request(1, nil).Body.String(), ShouldEqual, "labels 2")
+			So(request(1, nil).Header().Get("X-Grafana-Proxy-Cache"), ShouldEqual, "revalidated")
+			So(ifNoneMatch, ShouldResemble, []string{"", `"v1"`, `"v2"`})
+		})
+
+		Convey("Should not send the ETag of another org", func() {
+			request(1, nil)
+			So(request(2, nil).Body.String(), ShouldEqual, "labels 2")
+			So(ifNoneMatch, ShouldResemble, []string{"", ""})
+		})
+
+		Convey("Should pass on the conditional request of the client", func() {
+			request(1, nil)
+			resp := request(1, http.Header{"If-None-Match": []string{`"v1"`}})
+			So(resp.Code, ShouldEqual, 304)
+			So(resp.Header().Get("X-Grafana-Proxy-Cache"), ShouldEqual, "")
+		})
+
+		Convey("Should honor no-store from the backend", func() {
+			cacheControl = "no-store"
+			request(1, nil)
+			request(1, nil)
+			So(ifNoneMatch, ShouldResemble, []string{"", ""})
+		})
+
+		Reset(func() {
+			setting.DataProxy().ResponseCacheETag = false
+			proxyResponseCache.Lock()
+			proxyResponseCache.items = make(map[string]*proxyResponseCacheItem)
+			proxyResponseCache.bytes = 0
+			proxyResponseCache.Unlock()
+		})
+	})
+}
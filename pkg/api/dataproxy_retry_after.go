@@ -0,0 +1,102 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+// proxyRetryAfterError fails requests to a datasource that asked to be left
+// alone with a Retry-After header, the client gets a 429 with the time left
+type proxyRetryAfterError struct {
+	until time.Time
+}
+
+func (err *proxyRetryAfterError) Error() string {
+	return "Datasource is rate limiting requests, try again later"
+}
+
+// seconds returns the time left rounded up, for the Retry-After header of the
+// response
+func (err *proxyRetryAfterError) seconds(now time.Time) int {
+	left := err.until.Sub(now)
+	seconds := int(left / time.Second)
+	if left%time.Second > 0 || seconds < 1 {
+		seconds++
+	}
+	return seconds
+}
+
+// the time until which requests are not sent to a datasource, by datasource id
+var proxyRetryAfter = struct {
+	sync.Mutex
+	until map[int64]time.Time
+}{until: make(map[int64]time.Time)}
+
+// proxyRetryAfterTransport pauses the requests to a datasource that answered
+// 429 or 503 with a Retry-After header, until the time it asked for and for at
+// most data_proxy_retry_after_max seconds. It is above the breaker, a paused
+// datasource does not count as failing
+type proxyRetryAfterTransport struct {
+	transport http.RoundTripper
+	ds        *m.DataSource
+	max       time.Duration
+}
+
+func (t *proxyRetryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	now := time.Now()
+
+	proxyRetryAfter.Lock()
+	until := proxyRetryAfter.until[t.ds.Id]
+	proxyRetryAfter.Unlock()
+
+	if now.Before(until) {
+		closeRequestBody(req)
+		return nil, &proxyRetryAfterError{until: until}
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || (resp.StatusCode != 429 && resp.StatusCode != 503) {
+		return resp, err
+	}
+
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok || wait <= 0 {
+		return resp, nil
+	}
+	if wait > t.max {
+		wait = t.max
+	}
+
+	dataproxyLogger.Warn("Datasource asked to retry later, pausing proxy requests", "datasource", t.ds.Name, "status", resp.StatusCode, "wait", wait)
+	proxyRetryAfter.Lock()
+	proxyRetryAfter.until[t.ds.Id] = now.Add(wait)
+	proxyRetryAfter.Unlock()
+
+	return resp, nil
+}
+
+// parseRetryAfter returns the wait of a Retry-After header, in seconds or as
+// an http date
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return date.Sub(now), true
+	}
+	return 0, false
+}
+
+func isProxyRetryAfterError(err error) bool {
+	_, ok := err.(*proxyRetryAfterError)
+	return ok
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestDataSourceProxyRetryAfter(t *testing.T) {
+	Convey("When a proxied backend answers with Retry-After", t, func() {
+		backendRequests := 0
+		status, retryAfter := 429, "120"
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendRequests++
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(status)
+		}))
+		defer backend.Close()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: simplejson.New()}
+			return nil
+		})
+
+		setting.DataProxy().RetryAfterMax = 60
+		defer func() { setting.DataProxy().RetryAfterMax = 0 }()
+
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+
+		Convey("Should answer with 429 without contacting the backend", func() {
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/370/api/v1/query")
+			So(resp.Code, ShouldEqual, 429)
+			So(resp.Header().Get("Retry-After"), ShouldEqual, "120")
+
+			resp = proxyHandlerRequest(user, "GET", "/api/datasources/proxy/370/api/v1/query")
+			So(resp.Code, ShouldEqual, 429)
+			So(decodeProxyError(resp), ShouldEqual, "Datasource is rate limiting requests, try again later")
+			So(resp.Header().Get("Retry-After"), ShouldEqual, "60")
+			So(backendRequests, ShouldEqual, 1)
+		})
+
+		Convey("Should not retry a 503 with Retry-After", func() {
+			status = 503
+			setting.DataProxy().MaxRetries = 2
+			defer func() { setting.DataProxy().MaxRetries = 0 }()
+
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/371/api/v1/query")
+			So(resp.Code, ShouldEqual, 503)
+			So(backendRequests, ShouldEqual, 1)
+		})
+
+		Convey("Should contact the backend again once the time passed", func() {
+			retryAfter = "0"
+			proxyHandlerRequest(user, "GET", "/api/datasources/proxy/372/api/v1/query")
+			proxyHandlerRequest(user, "GET", "/api/datasources/proxy/372/api/v1/query")
+
+			So(backendRequests, ShouldEqual, 2)
+		})
+
+		Reset(func() {
+			proxyRetryAfter.Lock()
+			proxyRetryAfter.until = make(map[int64]time.Time)
+			proxyRetryAfter.Unlock()
+		})
+	})
+
+	Convey("When parsing Retry-After", t, func() {
+		now := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+
+		Convey("Should read seconds", func() {
+			wait, ok := parseRetryAfter("30", now)
+			So(ok, ShouldBeTrue)
+			So(wait, ShouldEqual, 30*time.Second)
+		})
+
+		Convey("Should read http dates", func() {
+			wait, ok := parseRetryAfter("Mon, 01 May 2017 12:02:00 GMT", now)
+			So(ok, ShouldBeTrue)
+			So(wait, ShouldEqual, 2*time.Minute)
+		})
+
+		Convey("Should ignore invalid values", func() {
+			_, ok := parseRetryAfter("soon", now)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
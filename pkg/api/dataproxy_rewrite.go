@@ -0,0 +1,96 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+// proxyHeaderRewrite replaces from with to in the values of a response header
+type proxyHeaderRewrite struct {
+	header string
+	from   string
+	to     string
+}
+
+// getProxyHeaderRewrites reads the responseHeaderRewrites json data option, a
+// list of {"header": "Location", "from": "http://backend.internal:8080", "to":
+// "https://grafana.example.com"} rules. Rules without a header or from are
+// skipped
+func getProxyHeaderRewrites(ds *m.DataSource) []proxyHeaderRewrite {
+	if ds.JsonData == nil {
+		return nil
+	}
+
+	var rewrites []proxyHeaderRewrite
+	for _, rule := range ds.JsonData.Get("responseHeaderRewrites").MustArray() {
+		fields, ok := rule.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		header, _ := fields["header"].(string)
+		from, _ := fields["from"].(string)
+		to, _ := fields["to"].(string)
+		if header == "" || from == "" {
+			dataproxyLogger.Warn("Invalid responseHeaderRewrites rule", "datasource", ds.Name, "rule", rule)
+			continue
+		}
+
+		rewrites = append(rewrites, proxyHeaderRewrite{header: http.CanonicalHeaderKey(header), from: from, to: to})
+	}
+
+	return rewrites
+}
+
+// proxyHeaderRewriteTransport rewrites the response headers of the backend,
+// like a Location header that names an internal host. It is above the
+// redirect round tripper, which follows the original locations
+type proxyHeaderRewriteTransport struct {
+	transport http.RoundTripper
+	rewrites  []proxyHeaderRewrite
+}
+
+func (t *proxyHeaderRewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// the header can be shared with the response cache, so it is copied
+	header := make(http.Header, len(resp.Header))
+	for name, values := range resp.Header {
+		header[name] = append([]string(nil), values...)
+	}
+
+	for _, rewrite := range t.rewrites {
+		values := header[rewrite.header]
+		for i, value := range values {
+			values[i] = strings.Replace(value, rewrite.from, rewrite.to, -1)
+		}
+	}
+
+	resp.Header = header
+	return resp, nil
+}
+
+// proxyStripHeaderTransport removes the response headers listed in
+// data_proxy_strip_response_headers, like a Server header naming the version
+// of the backend
+type proxyStripHeaderTransport struct {
+	transport http.RoundTripper
+	headers   []string
+}
+
+func (t *proxyStripHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range t.headers {
+		resp.Header.Del(name)
+	}
+	return resp, nil
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestDataSourceProxyHeaderRewrites(t *testing.T) {
+	Convey("When rewriting response headers", t, func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Location", "http://backend.internal:8080/api/v1/status")
+			w.Header().Set("Link", "<http://backend.internal:8080/page/2>; rel=next")
+			w.WriteHeader(201)
+		}))
+		defer backend.Close()
+
+		json := simplejson.NewFromAny(map[string]interface{}{
+			"responseHeaderRewrites": []interface{}{
+				map[string]interface{}{"header": "location", "from": "http://backend.internal:8080", "to": "https://grafana.example.com/api/datasources/proxy/250"},
+				map[string]interface{}{"header": "Link", "from": "backend.internal:8080"},
+				map[string]interface{}{"from": "http://backend.internal:8080", "to": "ignored"},
+			},
+		})
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: json}
+			return nil
+		})
+
+		Convey("Should replace the configured values", func() {
+			resp := proxyHandlerRequest(&m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}, "POST", "/api/datasources/proxy/250/api/v1/admin")
+
+			So(resp.Code, ShouldEqual, 201)
+			So(resp.Header().Get("Location"), ShouldEqual, "https://grafana.example.com/api/datasources/proxy/250/api/v1/status")
+			So(resp.Header().Get("Link"), ShouldEqual, "<http:///page/2>; rel=next")
+		})
+
+		Convey("Should skip rules without a header", func() {
+			rewrites := getProxyHeaderRewrites(&m.DataSource{JsonData: json})
+
+			So(len(rewrites), ShouldEqual, 2)
+			So(rewrites[0].header, ShouldEqual, "Location")
+		})
+	})
+
+	Convey("When stripping response headers", t, func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Server", "nginx/1.10.3")
+			w.Header().Set("X-Powered-By", "PHP/5.6")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}"))
+		}))
+		defer backend.Close()
+
+		bus.ClearBusHandlers()
+		defer bus.ClearBusHandlers()
+		bus.AddHandler("test", func(query *m.GetDataSourceByIdQuery) error {
+			query.Result = &m.DataSource{Id: query.Id, OrgId: query.OrgId, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: simplejson.New()}
+			return nil
+		})
+
+		stripHeaders := setting.DataProxy().StripResponseHeaders
+		defer func() { setting.DataProxy().StripResponseHeaders = stripHeaders }()
+		user := &m.SignedInUser{OrgId: 1, OrgRole: m.ROLE_VIEWER}
+
+		Convey("Should pass all headers on by default", func() {
+			setting.DataProxy().StripResponseHeaders = nil
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/251/api/v1/query")
+
+			So(resp.Header().Get("Server"), ShouldEqual, "nginx/1.10.3")
+		})
+
+		Convey("Should remove the configured headers", func() {
+			setting.DataProxy().StripResponseHeaders = []string{"server", "X-Powered-By"}
+			resp := proxyHandlerRequest(user, "GET", "/api/datasources/proxy/251/api/v1/query")
+
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Header().Get("Server"), ShouldEqual, "")
+			So(resp.Header().Get("X-Powered-By"), ShouldEqual, "")
+			So(resp.Header().Get("Content-Type"), ShouldEqual, "application/json")
+		})
+	})
+}
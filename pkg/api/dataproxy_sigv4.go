@@ -0,0 +1,101 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+// the service requests are signed for when sigV4Service is not set, Amazon
+// managed Prometheus
+const defaultSigV4Service = "aps"
+
+type sigV4CredentialsCacheKey struct {
+	id      int64
+	updated time.Time
+}
+
+var sigV4Credentials = struct {
+	sync.Mutex
+	credentials map[sigV4CredentialsCacheKey]*credentials.Credentials
+}{credentials: make(map[sigV4CredentialsCacheKey]*credentials.Credentials)}
+
+func usesSigV4Auth(ds *m.DataSource) bool {
+	return ds.JsonData != nil && ds.JsonData.Get("sigV4Auth").MustBool(false)
+}
+
+// getSigV4Credentials uses the access and secret key from secure json data and
+// falls back to the environment, the shared credentials file and the instance
+// IAM role. The chain is kept per datasource so the role credentials are only
+// fetched again when they expire
+func getSigV4Credentials(ds *m.DataSource) *credentials.Credentials {
+	key := sigV4CredentialsCacheKey{id: ds.Id, updated: ds.Updated}
+
+	sigV4Credentials.Lock()
+	defer sigV4Credentials.Unlock()
+
+	if creds, exists := sigV4Credentials.credentials[key]; exists {
+		return creds
+	}
+
+	decrypted := ds.SecureJsonData.Decrypt()
+	creds := credentials.NewChainCredentials(
+		[]credentials.Provider{
+			&credentials.StaticProvider{Value: credentials.Value{
+				AccessKeyID:     decrypted["sigV4AccessKey"],
+				SecretAccessKey: decrypted["sigV4SecretKey"],
+			}},
+			&credentials.EnvProvider{},
+			&credentials.SharedCredentialsProvider{Filename: "", Profile: ds.JsonData.Get("sigV4Profile").MustString()},
+			&ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(session.New()), ExpiryWindow: 5 * time.Minute},
+		})
+
+	sigV4Credentials.credentials[key] = creds
+	return creds
+}
+
+// newSigV4Authorizer signs proxied requests with AWS signature version 4. It
+// is a hop scheme so every redirected request is signed for its own url
+func newSigV4Authorizer(ds *m.DataSource, dsTransport http.RoundTripper) proxyAuthorizer {
+	return func(req *http.Request) error {
+		return signSigV4Request(ds, req)
+	}
+}
+
+// signSigV4Request signs the request in place, the body is read and replaced
+func signSigV4Request(ds *m.DataSource, req *http.Request) error {
+	region := ds.JsonData.Get("sigV4Region").MustString()
+	if region == "" {
+		return fmt.Errorf("SigV4 region is not configured")
+	}
+	service := ds.JsonData.Get("sigV4Service").MustString(defaultSigV4Service)
+
+	// the signature covers the body, it is read once and replayed
+	var body io.ReadSeeker
+	if req.Body != nil {
+		data, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	signer := v4.NewSigner(getSigV4Credentials(ds))
+	if _, err := signer.Sign(req, body, service, region, time.Now()); err != nil {
+		return fmt.Errorf("SigV4 signing failed: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/components/securejsondata"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func TestDataSourceProxySigV4(t *testing.T) {
+	Convey("When proxying with SigV4 auth", t, func() {
+		var authorization, amzDate, body string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+			amzDate = r.Header.Get("X-Amz-Date")
+			data, _ := ioutil.ReadAll(r.Body)
+			body = string(data)
+			w.WriteHeader(200)
+		}))
+		defer backend.Close()
+
+		json := simplejson.New()
+		json.Set("sigV4Auth", true)
+		json.Set("sigV4Region", "us-east-1")
+
+		ds := &m.DataSource{
+			Id:       100,
+			Type:     m.DS_PROMETHEUS,
+			Url:      backend.URL,
+			JsonData: json,
+			SecureJsonData: securejsondata.GetEncryptedJsonData(map[string]string{
+				"sigV4AccessKey": "AKID",
+				"sigV4SecretKey": "secret",
+			}),
+		}
+		targetUrl, _ := url.Parse(ds.Url)
+
+		request := func(req *http.Request) int {
+			transport, err := ds.GetHttpTransport()
+			So(err, ShouldBeNil)
+
+			proxy := NewReverseProxy(ds, "/api/v1/query", targetUrl)
+			proxy.Transport = newDataProxyTransport(ds, transport, false)
+
+			resp := httptest.NewRecorder()
+			proxy.ServeHTTP(resp, req)
+			return resp.Code
+		}
+
+		Convey("Should sign the request for the configured region", func() {
+			req, _ := http.NewRequest("GET", "http://grafana.com/api/datasources/proxy/100/api/v1/query?query=up", nil)
+			So(request(req), ShouldEqual, 200)
+			So(authorization, ShouldStartWith, "AWS4-HMAC-SHA256 Credential=AKID/")
+			So(authorization, ShouldContainSubstring, "/us-east-1/aps/aws4_request")
+			So(amzDate, ShouldNotBeEmpty)
+		})
+
+		Convey("Should pass on the signed body of post queries", func() {
+			req, _ := http.NewRequest("POST", "http://grafana.com/api/datasources/proxy/100/api/v1/query", strings.NewReader("query=up"))
+			So(request(req), ShouldEqual, 200)
+			So(authorization, ShouldStartWith, "AWS4-HMAC-SHA256")
+			So(body, ShouldEqual, "query=up")
+		})
+
+		Convey("Should fail without a region", func() {
+			json.Del("sigV4Region")
+			req, _ := http.NewRequest("GET", "http://grafana.com/api/datasources/proxy/100/api/v1/query", nil)
+			So(request(req), ShouldEqual, 502)
+			So(authorization, ShouldBeEmpty)
+		})
+
+		Convey("Should sign every request of a redirect for its own url", func() {
+			var signatures []string
+			var otherAuthorization string
+			other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				otherAuthorization = r.Header.Get("Authorization")
+			}))
+			defer other.Close()
+
+			redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				signatures = append(signatures, r.Header.Get("Authorization"))
+				switch r.URL.Path {
+				case "/api/v1/query":
+					http.Redirect(w, r, "/api/v1/moved", 302)
+				case "/api/v1/moved":
+					http.Redirect(w, r, other.URL+"/api/v1/elsewhere", 302)
+				}
+			}))
+			defer redirecting.Close()
+
+			json.Set("followRedirects", 2)
+			ds.Url = redirecting.URL
+			targetUrl, _ = url.Parse(ds.Url)
+
+			req, _ := http.NewRequest("GET", "http://grafana.com/api/datasources/proxy/100/api/v1/query?query=up", nil)
+			So(request(req), ShouldEqual, 200)
+
+			So(len(signatures), ShouldEqual, 2)
+			So(signatures[1], ShouldStartWith, "AWS4-HMAC-SHA256")
+			So(signatures[1], ShouldNotEqual, signatures[0])
+			So(otherAuthorization, ShouldStartWith, "AWS4-HMAC-SHA256")
+		})
+
+		Reset(func() {
+			sigV4Credentials.Lock()
+			sigV4Credentials.credentials = make(map[sigV4CredentialsCacheKey]*credentials.Credentials)
+			sigV4Credentials.Unlock()
+		})
+	})
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// getProxyTimeout returns the timeout in seconds of requests to the
+// datasource, the timeout json data option or else data_proxy_timeout. 0
+// disables the timeout
+func getProxyTimeout(ds *m.DataSource) int {
+	if ds.JsonData == nil {
+		return setting.DataProxy().Timeout
+	}
+	return ds.JsonData.Get("timeout").MustInt(setting.DataProxy().Timeout)
+}
+
+// usesProxyIdleTimeout reports whether the timeout of the datasource only
+// counts the time nothing was sent to the client, with timeoutMode "idle".
+// Streaming queries can then run as long as they keep sending data
+func usesProxyIdleTimeout(ds *m.DataSource) bool {
+	return ds.JsonData != nil && ds.JsonData.Get("timeoutMode").MustString() == "idle"
+}
+
+// proxyIdleContext is done with context.DeadlineExceeded once it was not reset
+// for the timeout, or when its parent is done
+type proxyIdleContext struct {
+	context.Context
+	timeout time.Duration
+	done    chan struct{}
+
+	mu    sync.Mutex
+	err   error
+	timer *time.Timer
+}
+
+// newProxyIdleContext returns the context and a func that must be called when
+// the request is done, to stop its timer
+func newProxyIdleContext(parent context.Context, timeout time.Duration) (*proxyIdleContext, func()) {
+	ctx := &proxyIdleContext{Context: parent, timeout: timeout, done: make(chan struct{})}
+	ctx.timer = time.AfterFunc(timeout, func() { ctx.finish(context.DeadlineExceeded) })
+
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-parent.Done():
+			ctx.finish(parent.Err())
+		case <-stopped:
+		}
+	}()
+
+	return ctx, func() {
+		ctx.timer.Stop()
+		close(stopped)
+	}
+}
+
+func (ctx *proxyIdleContext) Done() <-chan struct{} {
+	return ctx.done
+}
+
+func (ctx *proxyIdleContext) Err() error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.err
+}
+
+func (ctx *proxyIdleContext) finish(err error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.err == nil {
+		ctx.err = err
+		close(ctx.done)
+	}
+}
+
+// reset starts the timeout again, unless the context is already done
+func (ctx *proxyIdleContext) reset() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.err == nil {
+		ctx.timer.Reset(ctx.timeout)
+	}
+}
+
+// idleTimeoutResponseWriter resets the idle timeout of the request whenever
+// the reverse proxy passes bytes of the response on to the client, which it
+// flushes every flush interval
+type idleTimeoutResponseWriter struct {
+	http.ResponseWriter
+	ctx *proxyIdleContext
+}
+
+func (w *idleTimeoutResponseWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	if n > 0 {
+		w.ctx.reset()
+	}
+	return n, err
+}
+
+func (w *idleTimeoutResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// CloseNotify is passed on so the reverse proxy can still cancel the backend request
+func (w *idleTimeoutResponseWriter) CloseNotify() <-chan bool {
+	if notifier, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return make(chan bool)
+}
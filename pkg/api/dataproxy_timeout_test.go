@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestDataSourceProxyTimeouts(t *testing.T) {
+	Convey("When getting the timeout of a datasource", t, func() {
+		setting.DataProxy().Timeout = 30
+		defer func() { setting.DataProxy().Timeout = 0 }()
+
+		Convey("Should use data_proxy_timeout by default", func() {
+			So(getProxyTimeout(&m.DataSource{JsonData: simplejson.New()}), ShouldEqual, 30)
+			So(usesProxyIdleTimeout(&m.DataSource{JsonData: simplejson.New()}), ShouldBeFalse)
+		})
+
+		Convey("Should use the timeout of the datasource", func() {
+			ds := &m.DataSource{JsonData: simplejson.NewFromAny(map[string]interface{}{"timeout": 300, "timeoutMode": "idle"})}
+			So(getProxyTimeout(ds), ShouldEqual, 300)
+			So(usesProxyIdleTimeout(ds), ShouldBeTrue)
+		})
+	})
+
+	Convey("When proxying with an idle timeout", t, func() {
+		var stall time.Duration
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(stall)
+			w.WriteHeader(200)
+			for i := 0; i < 5; i++ {
+				fmt.Fprintf(w, "chunk %d\n", i)
+				w.(http.Flusher).Flush()
+				time.Sleep(40 * time.Millisecond)
+			}
+		}))
+		defer backend.Close()
+
+		ds := m.DataSource{Id: 350, Url: backend.URL, Type: m.DS_PROMETHEUS}
+		targetUrl, _ := url.Parse(ds.Url)
+
+		request := func() *httptest.ResponseRecorder {
+			transport, err := ds.GetHttpTransport()
+			So(err, ShouldBeNil)
+
+			proxy := NewReverseProxy(&ds, "/api/v1/stream", targetUrl)
+			proxy.Transport = &proxyErrorTransport{transport: transport}
+
+			ctx, stop := newProxyIdleContext(context.Background(), 100*time.Millisecond)
+			defer stop()
+
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://grafana.com/api/datasources/proxy/350/api/v1/stream", nil)
+			proxy.ServeHTTP(&idleTimeoutResponseWriter{ResponseWriter: resp, ctx: ctx}, req.WithContext(ctx))
+			return resp
+		}
+
+		Convey("Should keep a request running that streams data", func() {
+			resp := request()
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldEndWith, "chunk 4\n")
+		})
+
+		Convey("Should return 504 when the backend stalls", func() {
+			stall = 300 * time.Millisecond
+			resp := request()
+			So(resp.Code, ShouldEqual, 504)
+			So(decodeProxyError(resp), ShouldEqual, "Gateway Timeout")
+		})
+	})
+
+	Convey("When the parent of an idle timeout context is canceled", t, func() {
+		parent, cancel := context.WithCancel(context.Background())
+		ctx, stop := newProxyIdleContext(parent, time.Minute)
+		defer stop()
+
+		cancel()
+		<-ctx.Done()
+
+		So(ctx.Err(), ShouldEqual, context.Canceled)
+	})
+}
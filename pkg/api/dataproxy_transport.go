@@ -0,0 +1,444 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana/pkg/metrics"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+// proxyErrorTransport reports failed connections as a json error response,
+// httputil.ReverseProxy would otherwise reply with an empty 502. Responses of
+// the backend, error responses included, are passed on unchanged
+type proxyErrorTransport struct {
+	transport  http.RoundTripper
+	datasource string
+	dsType     string
+	// the timeout of the datasource in seconds, for the log
+	timeout int
+	// the raw backend error can name internal hosts so it is only shown to admins
+	showDetails bool
+}
+
+func (t *proxyErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err == nil {
+		if resp.StatusCode >= 500 {
+			countProxyError(proxyErrorBackend5xx, t.dsType)
+		}
+		return resp, nil
+	}
+
+	if req.Context().Err() == context.DeadlineExceeded {
+		countProxyError(proxyErrorBackendTimeout, t.dsType)
+		dataproxyLogger.Error("Proxy request timed out", "url", redactUrl(req.URL), "requestId", req.Header.Get("X-Request-ID"), "timeout", t.timeout)
+		return t.errorResponse(req, 504, "Gateway Timeout", err), nil
+	}
+
+	if req.Context().Err() == context.Canceled && isProxyDataSourceChanged(req) {
+		return t.errorResponse(req, 503, "Datasource was changed while the request was running", err), nil
+	}
+
+	// the client closed its connection, nobody reads the response
+	if req.Context().Err() == context.Canceled {
+		return t.errorResponse(req, 502, "Request canceled", err), nil
+	}
+
+	if err == errProxyBreakerOpen {
+		countProxyError(proxyErrorBreakerOpen, t.dsType)
+		return t.errorResponse(req, 503, err.Error(), err), nil
+	}
+
+	if retryErr, ok := err.(*proxyRetryAfterError); ok {
+		countProxyError(proxyErrorRetryAfter, t.dsType)
+		resp := t.errorResponse(req, 429, err.Error(), err)
+		resp.Header.Set("Retry-After", strconv.Itoa(retryErr.seconds(time.Now())))
+		return resp, nil
+	}
+
+	if isRequestBodyTooLargeError(err) {
+		return t.errorResponse(req, 413, fmt.Sprintf("Request body is larger than %d bytes", setting.DataProxy().MaxRequestBody), err), nil
+	}
+
+	if isBlockedAddressError(err) {
+		dataproxyLogger.Warn("Proxy request to blocked address", "url", redactUrl(req.URL), "requestId", req.Header.Get("X-Request-ID"))
+		return t.errorResponse(req, 403, "Datasource address is blocked", err), nil
+	}
+
+	dataproxyLogger.Error("Proxy request failed", "url", redactUrl(req.URL), "requestId", req.Header.Get("X-Request-ID"), "error", err)
+
+	message := "Bad Gateway"
+	if isTLSVersionError(err) {
+		message = "TLS version or cipher suites of the datasource are not allowed, see tlsMinVersion and tlsCipherSuites"
+	} else if isTLSError(err) {
+		message = "TLS certificate verification failed"
+	}
+
+	return t.errorResponse(req, 502, message, err), nil
+}
+
+func (t *proxyErrorTransport) errorResponse(req *http.Request, status int, message string, err error) *http.Response {
+	reason := getProxyErrorReason(err)
+	if t.showDetails {
+		reason = err.Error()
+	}
+
+	return newProxyJsonResponse(req, status, util.DynMap{
+		"message":    message,
+		"datasource": t.datasource,
+		"error":      reason,
+	})
+}
+
+// getProxyErrorReason describes a backend error without the addresses it contains
+func getProxyErrorReason(err error) string {
+	msg := err.Error()
+	switch {
+	case err == errProxyBreakerOpen:
+		return "Requests are paused after repeated failures of the datasource"
+	case isProxyRetryAfterError(err):
+		return "Requests are paused until the time the datasource asked for with Retry-After"
+	case isRequestBodyTooLargeError(err):
+		return errProxyRequestBodyTooLarge.Error()
+	case err == errProxyBrotliUnsupported:
+		return err.Error()
+	case isBlockedAddressError(err):
+		return m.ErrDataSourceAddressBlocked.Error()
+	case isTLSError(err):
+		return "TLS handshake with the datasource failed"
+	case strings.Contains(msg, "connection refused"):
+		return "Connection refused by the datasource"
+	case strings.Contains(msg, "no such host"):
+		return "Datasource host could not be resolved"
+	case strings.Contains(msg, "timeout") || strings.Contains(msg, "deadline exceeded"):
+		return "Datasource did not respond in time"
+	default:
+		return "Failed to connect to the datasource"
+	}
+}
+
+func isTLSError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "x509: ") || strings.Contains(msg, "tls: ")
+}
+
+// isTLSVersionError reports handshakes that failed on the tls version or
+// cipher suites, from either side of the connection
+func isTLSVersionError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "protocol version") || strings.Contains(msg, "cipher suite")
+}
+
+// the dial and body errors can be wrapped by the transport
+func isBlockedAddressError(err error) bool {
+	return strings.Contains(err.Error(), m.ErrDataSourceAddressBlocked.Error())
+}
+
+func isRequestBodyTooLargeError(err error) bool {
+	return strings.Contains(err.Error(), errProxyRequestBodyTooLarge.Error())
+}
+
+// newProxyJsonResponse is a response of the proxy itself, for errors and dry runs
+func newProxyJsonResponse(req *http.Request, status int, content util.DynMap) *http.Response {
+	body, _ := json.Marshal(content)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	return &http.Response{
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+const proxyRetryBackoff = 100 * time.Millisecond
+
+// proxyRetryTransport retries idempotent requests on connection errors and
+// 502/503 responses, the response is only passed on once retrying is done so
+// nothing has been streamed to the client yet
+type proxyRetryTransport struct {
+	transport  http.RoundTripper
+	maxRetries int
+}
+
+func (t *proxyRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+
+	if !isIdempotentRequest(req) {
+		return resp, err
+	}
+
+	for attempt := 0; attempt < t.maxRetries && shouldRetryProxyRequest(resp, err); attempt++ {
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(proxyRetryBackoff << uint(attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		metrics.M_DataSource_ProxyReq_Retries.Inc(1)
+		dataproxyLogger.Debug("Retrying proxy request", "url", redactUrl(req.URL), "attempt", attempt+1)
+		resp, err = t.transport.RoundTrip(req)
+	}
+
+	return resp, err
+}
+
+func isIdempotentRequest(req *http.Request) bool {
+	return (req.Method == "GET" || req.Method == "HEAD") && req.Body == nil
+}
+
+// a backend that asked for a pause with Retry-After is not retried right away
+func shouldRetryProxyRequest(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return (resp.StatusCode == 502 || resp.StatusCode == 503) && resp.Header.Get("Retry-After") == ""
+}
+
+// proxyBackendStatusTransport reports the status code and response time of
+// the backend in response headers, proxy errors never reach the backend so
+// they do not get them
+type proxyBackendStatusTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *proxyBackendStatusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Header.Set("X-Grafana-Proxy-Backend-Status", strconv.Itoa(resp.StatusCode))
+	resp.Header.Set("X-Grafana-Proxy-Backend-Time", strconv.FormatInt(int64(time.Since(start)/time.Millisecond), 10))
+	return resp, nil
+}
+
+// setQueryParam replaces any value of the parameter sent by the client, the
+// other parameters are kept as they are
+func setQueryParam(rawQuery string, name string, value string) string {
+	return appendQueryParam(removeQueryParam(rawQuery, name), name, value)
+}
+
+// removeQueryParam drops every value of the parameter, the other parameters
+// are kept as they are
+func removeQueryParam(rawQuery string, name string) string {
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+
+		key := param
+		if i := strings.Index(param, "="); i >= 0 {
+			key = param[:i]
+		}
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+			continue
+		}
+
+		kept = append(kept, param)
+	}
+
+	return strings.Join(kept, "&")
+}
+
+// cloneProxyRequest copies the request and its headers, round trippers must
+// not modify the request they are given
+func cloneProxyRequest(req *http.Request) *http.Request {
+	outreq := new(http.Request)
+	*outreq = *req
+	outreq.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		outreq.Header[name] = append([]string(nil), values...)
+	}
+	return outreq
+}
+
+func getProxyQueryParamName(ds *m.DataSource) string {
+	if ds.JsonData == nil {
+		return ""
+	}
+	return ds.JsonData.Get("httpQueryParamName").MustString()
+}
+
+// GetUserClientCertificate selects the client certificate a signed in user
+// authenticates to a datasource with, so users reach the backend as
+// themselves. Without it, or when it returns no certificate, the tls client
+// certificate of the datasource is used
+var GetUserClientCertificate func(ds *m.DataSource, user *m.SignedInUser) (*tls.Certificate, error)
+
+func getProxyTransport(ds *m.DataSource, user *m.SignedInUser) (*http.Transport, error) {
+	if GetUserClientCertificate == nil || user == nil {
+		return ds.GetHttpTransport()
+	}
+
+	cert, err := GetUserClientCertificate(ds, user)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get client certificate: %v", err)
+	}
+
+	if cert == nil {
+		return ds.GetHttpTransport()
+	}
+
+	return ds.GetHttpTransportWithClientCert(cert)
+}
+
+// proxyHopHeaderTransport removes the hop-by-hop headers of the backend
+// response, including the ones named in its Connection header
+type proxyHopHeaderTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *proxyHopHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	removeHopHeaders(resp.Header)
+	return resp, nil
+}
+
+// proxyTransportMode is what the round trippers of a datasource are built for
+type proxyTransportMode int
+
+const (
+	proxyTransportRequest proxyTransportMode = iota
+	proxyTransportProbe
+	proxyTransportDryRun
+)
+
+func newDataProxyTransport(ds *m.DataSource, transport http.RoundTripper, showErrorDetails bool) http.RoundTripper {
+	return buildDataProxyTransport(ds, transport, showErrorDetails, proxyTransportRequest)
+}
+
+// newDataProxyProbeTransport is used to test a datasource, it reports the
+// current state of the backend so responses are not cached or retried
+func newDataProxyProbeTransport(ds *m.DataSource, transport http.RoundTripper) http.RoundTripper {
+	return buildDataProxyTransport(ds, transport, true, proxyTransportProbe)
+}
+
+// newDataProxyDryRunTransport answers with the request that would be sent to
+// the datasource instead of sending it. Like probes it skips the retries,
+// failover and caches, credentials are still fetched with transport
+func newDataProxyDryRunTransport(ds *m.DataSource, transport http.RoundTripper) http.RoundTripper {
+	return buildDataProxyTransport(ds, transport, true, proxyTransportDryRun)
+}
+
+func buildDataProxyTransport(ds *m.DataSource, transport http.RoundTripper, showErrorDetails bool, mode proxyTransportMode) http.RoundTripper {
+	cfg := setting.DataProxy()
+	probe := mode != proxyTransportRequest
+
+	dsTransport := transport
+	if mode == proxyTransportDryRun {
+		transport = newProxyDryRunTransport(ds)
+	} else if httpTransport, ok := transport.(*http.Transport); ok && usesNTLMAuth(ds) {
+		transport = newNTLMTransport(ds, httpTransport)
+	}
+	if mode != proxyTransportDryRun {
+		transport = &proxyPoolTransport{transport: transport}
+	}
+	// logs the requests as they are sent, after all other round trippers
+	if usesProxyDebugLogging(ds) {
+		transport = newProxyDebugTransport(ds, transport)
+	}
+	transport = &proxyHopHeaderTransport{transport: transport}
+	if len(cfg.StripResponseHeaders) > 0 {
+		transport = &proxyStripHeaderTransport{transport: transport, headers: cfg.StripResponseHeaders}
+	}
+	if len(proxyRequestMutators[ds.Type]) > 0 {
+		transport = &proxyMutatorTransport{transport: transport, ds: ds}
+	}
+	transport = wrapDataProxyAuth(dataProxyHopAuthSchemes, ds, transport, dsTransport)
+
+	if maxRedirects := getProxyMaxRedirects(ds); maxRedirects > 0 {
+		transport = &proxyRedirectTransport{transport: transport, maxRedirects: maxRedirects, socket: ds.UnixSocketPath() != ""}
+	}
+
+	// a test of the datasource checks its own url
+	if targets := getProxyFailoverTargets(ds); len(targets) > 1 && !probe {
+		transport = &proxyFailoverTransport{
+			transport:   transport,
+			dsId:        ds.Id,
+			targets:     targets,
+			loadBalance: getProxyLoadBalance(ds),
+			sticky:      usesProxyStickySessions(ds),
+		}
+	}
+
+	transport = wrapDataProxyAuth(dataProxyAuthSchemes, ds, transport, dsTransport)
+
+	if cfg.MaxRetries > 0 && !probe {
+		transport = &proxyRetryTransport{transport: transport, maxRetries: cfg.MaxRetries}
+	}
+
+	if cfg.BackendStatusHeader {
+		transport = &proxyBackendStatusTransport{transport: transport}
+	}
+
+	// testing a datasource reaches the backend even while its breaker is open
+	if cfg.BreakerFailures > 0 && !probe {
+		transport = newProxyBreakerTransport(ds, transport)
+	}
+
+	if cfg.RetryAfterMax > 0 && !probe {
+		transport = &proxyRetryAfterTransport{transport: transport, ds: ds, max: time.Duration(cfg.RetryAfterMax) * time.Second}
+	}
+
+	if (cfg.ResponseCacheTTL > 0 || cfg.ResponseCacheETag) && !probe {
+		transport = &proxyResponseCacheTransport{
+			transport:  transport,
+			ds:         ds,
+			maxTTL:     time.Duration(cfg.ResponseCacheTTL) * time.Second,
+			revalidate: cfg.ResponseCacheETag,
+			clientCert: getClientCertFingerprint(dsTransport),
+		}
+	}
+
+	if rewrites := getProxyHeaderRewrites(ds); len(rewrites) > 0 {
+		transport = &proxyHeaderRewriteTransport{transport: transport, rewrites: rewrites}
+	}
+
+	// checks the content type the client gets, after the rewrites and for
+	// cached responses too
+	if contentTypes := getProxyAllowedContentTypes(ds); len(contentTypes) > 0 && mode != proxyTransportDryRun {
+		transport = &proxyContentTypeTransport{transport: transport, datasource: ds.Name, contentTypes: contentTypes}
+	}
+
+	// above the cache so cached responses stay compressed
+	if usesBackendCompression(ds) {
+		transport = &proxyGzipTransport{transport: transport}
+	}
+	transport = &proxyBrotliTransport{transport: transport}
+
+	if !usesProxyForwardedFor(ds) {
+		transport = &proxyForwardedForTransport{transport: transport}
+	}
+
+	return &proxyErrorTransport{transport: transport, datasource: ds.Name, dsType: ds.Type, timeout: getProxyTimeout(ds), showDetails: showErrorDetails}
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDataProxyTransport(t *testing.T) {
+	Convey("When retrying proxied requests", t, func() {
+		calls := 0
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls < 3 {
+				w.WriteHeader(503)
+				return
+			}
+			w.WriteHeader(200)
+		}))
+		defer backend.Close()
+
+		transport := &proxyRetryTransport{transport: http.DefaultTransport, maxRetries: 2}
+
+		Convey("Should retry GET requests until they succeed", func() {
+			req, _ := http.NewRequest("GET", backend.URL, nil)
+			resp, err := transport.RoundTrip(req)
+
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(calls, ShouldEqual, 3)
+		})
+
+		Convey("Should not retry POST requests", func() {
+			req, _ := http.NewRequest("POST", backend.URL, nil)
+			resp, err := transport.RoundTrip(req)
+
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, 503)
+			So(calls, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,224 @@
+package api
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+// headers needed for the websocket handshake, they are hop-by-hop so they are
+// restored after the director has filtered the request headers
+var webSocketHandshakeHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Protocol",
+	"Sec-Websocket-Extensions",
+}
+
+func isWebSocketRequest(req *http.Request) bool {
+	if strings.ToLower(req.Header.Get("Upgrade")) != "websocket" {
+		return false
+	}
+
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.ToLower(strings.TrimSpace(token)) == "upgrade" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// proxyWebSocket sends the handshake through the director and the auth schemes
+// of the datasource, and then copies bytes in both directions until one
+// side closes. Errors returned happen before the client connection is hijacked.
+func proxyWebSocket(w http.ResponseWriter, req *http.Request, ds *m.DataSource, director func(*http.Request), transport *http.Transport) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("Response writer does not support websocket upgrades")
+	}
+
+	outreq := cloneProxyRequest(req)
+	outreq.URL = new(url.URL)
+	*outreq.URL = *req.URL
+
+	director(outreq)
+
+	for _, name := range webSocketHandshakeHeaders {
+		if values, exists := req.Header[name]; exists {
+			outreq.Header[name] = values
+		}
+	}
+
+	if err := authorizeDataProxyRequest(ds, outreq, transport); err != nil {
+		return err
+	}
+	if err := mutateProxyRequest(ds, outreq); err != nil {
+		return err
+	}
+
+	backendConn, err := dialBackendConn(outreq, transport)
+	if err != nil {
+		return err
+	}
+
+	if err := outreq.Write(backendConn); err != nil {
+		backendConn.Close()
+		return err
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		backendConn.Close()
+		return err
+	}
+
+	done := make(chan struct{}, 2)
+	copyConn := func(dst io.Writer, src io.Reader) {
+		if _, err := io.Copy(dst, src); err != nil {
+			dataproxyLogger.Debug("Websocket proxy connection closed", "url", redactUrl(outreq.URL), "error", err)
+		}
+		done <- struct{}{}
+	}
+
+	go copyConn(backendConn, clientBuf)
+	go copyConn(clientConn, backendConn)
+	<-done
+
+	clientConn.Close()
+	backendConn.Close()
+	<-done
+
+	return nil
+}
+
+// dialBackendConn opens a connection of its own to the backend of req the way
+// transport would, for websockets and handshakes bound to a connection
+func dialBackendConn(req *http.Request, transport *http.Transport) (net.Conn, error) {
+	secure := req.URL.Scheme == "https" || req.URL.Scheme == "wss"
+
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if secure {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+
+	dial := net.Dial
+	if transport.DialContext != nil {
+		// the PROXY protocol header is written by the context dialer
+		dial = func(network, addr string) (net.Conn, error) {
+			return transport.DialContext(req.Context(), network, addr)
+		}
+	} else if transport.Dial != nil {
+		dial = transport.Dial
+	}
+
+	// an http outbound proxy is used through a CONNECT tunnel, so websockets
+	// take the same way out as other proxied requests
+	var proxyUrl *url.URL
+	if transport.Proxy != nil {
+		var err error
+		if proxyUrl, err = transport.Proxy(req); err != nil {
+			return nil, err
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if proxyUrl != nil {
+		conn, err = dialWebSocketTunnel(dial, proxyUrl, addr)
+	} else {
+		conn, err = dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !secure {
+		return conn, nil
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	tlsConfig := &tls.Config{ServerName: host}
+	if transport.TLSClientConfig != nil {
+		tlsConfig.RootCAs = transport.TLSClientConfig.RootCAs
+		tlsConfig.Certificates = transport.TLSClientConfig.Certificates
+		tlsConfig.InsecureSkipVerify = transport.TLSClientConfig.InsecureSkipVerify
+		if transport.TLSClientConfig.ServerName != "" {
+			tlsConfig.ServerName = transport.TLSClientConfig.ServerName
+		}
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// dialWebSocketTunnel connects to addr through an http proxy with CONNECT
+func dialWebSocketTunnel(dial func(network, addr string) (net.Conn, error), proxyUrl *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := hostWithDefaultPort(proxyUrl)
+
+	conn, err := dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyUrl.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: hostWithoutPort(proxyAddr)})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyUrl.User != nil {
+		password, _ := proxyUrl.User.Password()
+		connectReq.Header.Set("Proxy-Authorization", util.GetBasicAuthHeader(proxyUrl.User.Username(), password))
+	}
+
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the proxy sends nothing after its response before the handshake is written
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		conn.Close()
+		return nil, fmt.Errorf("Outbound proxy refused the websocket tunnel: %s", resp.Status)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/components/securejsondata"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+func TestDataSourceProxyWebSocket(t *testing.T) {
+	Convey("When checking for websocket requests", t, func() {
+		req, _ := http.NewRequest("GET", "http://grafana.com/api/datasources/proxy/1/stream", nil)
+
+		Convey("Should require both upgrade and connection headers", func() {
+			So(isWebSocketRequest(req), ShouldBeFalse)
+
+			req.Header.Set("Upgrade", "websocket")
+			So(isWebSocketRequest(req), ShouldBeFalse)
+
+			req.Header.Set("Connection", "keep-alive, Upgrade")
+			So(isWebSocketRequest(req), ShouldBeTrue)
+		})
+	})
+
+	Convey("When proxying a websocket connection", t, func() {
+		var backendAuth string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendAuth = r.Header.Get("Authorization")
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(msgType, append([]byte("echo: "), msg...))
+		}))
+		defer backend.Close()
+
+		json := simplejson.New()
+		json.Set("forwardHeaders", []string{})
+
+		ds := &m.DataSource{
+			Id:                10,
+			Type:              m.DS_PROMETHEUS,
+			Url:               backend.URL,
+			BasicAuth:         true,
+			BasicAuthUser:     "user",
+			BasicAuthPassword: "password",
+			JsonData:          json,
+		}
+
+		targetUrl, _ := url.Parse(ds.Url)
+		transport, err := ds.GetHttpTransport()
+		So(err, ShouldBeNil)
+
+		grafana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxy := NewReverseProxy(ds, "stream", targetUrl)
+			if err := proxyWebSocket(w, r, ds, proxy.Director, transport); err != nil {
+				http.Error(w, err.Error(), 502)
+			}
+		}))
+		defer grafana.Close()
+
+		conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(grafana.URL, "http", "ws", 1), nil)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		Convey("Should pass messages in both directions with datasource auth", func() {
+			So(conn.WriteMessage(websocket.TextMessage, []byte("hello")), ShouldBeNil)
+
+			_, msg, err := conn.ReadMessage()
+			So(err, ShouldBeNil)
+			So(string(msg), ShouldEqual, "echo: hello")
+			So(backendAuth, ShouldEqual, util.GetBasicAuthHeader("user", "password"))
+		})
+	})
+
+	Convey("When proxying a websocket connection with api key and OAuth auth", t, func() {
+		tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"access_token":"wstoken"}`)
+		}))
+		defer tokenServer.Close()
+
+		var backendAuth, backendQuery string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendAuth = r.Header.Get("Authorization")
+			backendQuery = r.URL.RawQuery
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}))
+		defer backend.Close()
+
+		json := simplejson.New()
+		json.Set("httpQueryParamName", "api_key")
+		json.Set("oauthClientCredentials", true)
+		json.Set("oauthTokenUrl", tokenServer.URL)
+
+		ds := &m.DataSource{
+			Id:             11,
+			Type:           m.DS_PROMETHEUS,
+			Url:            backend.URL,
+			JsonData:       json,
+			SecureJsonData: securejsondata.GetEncryptedJsonData(map[string]string{"httpQueryParamValue": "secret"}),
+		}
+
+		targetUrl, _ := url.Parse(ds.Url)
+		transport, err := ds.GetHttpTransport()
+		So(err, ShouldBeNil)
+
+		grafana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxy := NewReverseProxy(ds, "stream", targetUrl)
+			if err := proxyWebSocket(w, r, ds, proxy.Director, transport); err != nil {
+				http.Error(w, err.Error(), 502)
+			}
+		}))
+		defer grafana.Close()
+
+		Convey("Should add the secret query parameter and the bearer token to the handshake", func() {
+			conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(grafana.URL, "http", "ws", 1)+"?api_key=fake", nil)
+			So(err, ShouldBeNil)
+			conn.Close()
+
+			So(backendQuery, ShouldEqual, "api_key=secret")
+			So(backendAuth, ShouldEqual, "Bearer wstoken")
+		})
+	})
+
+	Convey("When proxying a websocket connection through an outbound proxy", t, func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}))
+		defer backend.Close()
+
+		var tunnelHost, tunnelAuth string
+		outbound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tunnelHost = r.Host
+			tunnelAuth = r.Header.Get("Proxy-Authorization")
+			if r.Method != "CONNECT" {
+				w.WriteHeader(405)
+				return
+			}
+
+			backendConn, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				w.WriteHeader(502)
+				return
+			}
+			clientConn, _, _ := w.(http.Hijacker).Hijack()
+			clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			go io.Copy(backendConn, clientConn)
+			io.Copy(clientConn, backendConn)
+			clientConn.Close()
+			backendConn.Close()
+		}))
+		defer outbound.Close()
+
+		setting.DataProxy().OutboundUrl = outbound.URL
+		setting.DataProxy().OutboundUser = "egress"
+		setting.DataProxy().OutboundPassword = "password"
+		defer func() {
+			setting.DataProxy().OutboundUrl, setting.DataProxy().OutboundUser, setting.DataProxy().OutboundPassword = "", "", ""
+		}()
+
+		ds := &m.DataSource{Id: 12, Type: m.DS_PROMETHEUS, Url: backend.URL, JsonData: simplejson.New(), Updated: time.Now()}
+		targetUrl, _ := url.Parse(ds.Url)
+		transport, err := ds.GetHttpTransport()
+		So(err, ShouldBeNil)
+
+		grafana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxy := NewReverseProxy(ds, "stream", targetUrl)
+			if err := proxyWebSocket(w, r, ds, proxy.Director, transport); err != nil {
+				http.Error(w, err.Error(), 502)
+			}
+		}))
+		defer grafana.Close()
+
+		Convey("Should tunnel the connection through the proxy", func() {
+			conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(grafana.URL, "http", "ws", 1), nil)
+			So(err, ShouldBeNil)
+			conn.Close()
+
+			So(tunnelHost, ShouldEqual, targetUrl.Host)
+			So(tunnelAuth, ShouldEqual, util.GetBasicAuthHeader("egress", "password"))
+		})
+	})
+}
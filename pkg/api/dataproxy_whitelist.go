@@ -0,0 +1,113 @@
+package api
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// isInDataProxyWhiteList checks the target host against the whitelist entries,
+// which can be a host:port pair, a bare host or a CIDR range. IPv6 entries can
+// be written with or without brackets, like [::1]:9090 or ::1
+func isInDataProxyWhiteList(targetUrl *url.URL) bool {
+	host, port := splitHostPort(targetUrl.Host)
+	if port == "" {
+		_, port = splitHostPort(hostWithDefaultPort(targetUrl))
+	}
+
+	for entry := range setting.DataProxyWhiteList {
+		// CIDR ranges and unix sockets are checked separately
+		if strings.Contains(entry, "/") {
+			continue
+		}
+
+		entryHost, entryPort := splitHostPort(entry)
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		if isSameHost(entryHost, host) {
+			return true
+		}
+	}
+
+	if len(setting.DataProxyWhiteListNet) == 0 {
+		return false
+	}
+
+	for _, ip := range resolveHost(host) {
+		for _, ipNet := range setting.DataProxyWhiteListNet {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// splitHostPort splits an optional port off the host, the brackets of IPv6
+// literals are removed
+func splitHostPort(hostport string) (host string, port string) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return strings.Trim(hostport, "[]"), ""
+	}
+	return host, port
+}
+
+func hostWithoutPort(hostport string) string {
+	host, _ := splitHostPort(hostport)
+	return host
+}
+
+// isSameHost compares ip addresses by value, so ::1 matches 0:0:0:0:0:0:0:1
+func isSameHost(a string, b string) bool {
+	if ipA, ipB := net.ParseIP(a), net.ParseIP(b); ipA != nil && ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return strings.EqualFold(a, b)
+}
+
+func resolveHost(host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+
+	ips, err := m.LookupDataSourceHost(host)
+	if err != nil {
+		dataproxyLogger.Warn("Failed to resolve datasource host", "host", host, "error", err)
+		return nil
+	}
+	return ips
+}
+
+// resolvesToBlockedAddress checks the datasource host before the request is
+// proxied, the dialer of the transport checks the address again when connecting
+func resolvesToBlockedAddress(targetUrl *url.URL) bool {
+	if !setting.DataProxy().BlockInternalIps {
+		return false
+	}
+
+	for _, ip := range resolveHost(hostWithoutPort(targetUrl.Host)) {
+		if m.IsBlockedDataSourceIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSocketInDataProxyWhiteList checks unix socket datasources, they are listed
+// in the whitelist by their url like unix:///var/run/prometheus.sock
+func isSocketInDataProxyWhiteList(socket string) bool {
+	return setting.DataProxyWhiteList[m.UnixSocketUrlPrefix+socket]
+}
+
+// isBlockedSocket reports whether unix socket datasources are blocked, the
+// socket is on this host so it is treated like a loopback address
+func isBlockedSocket() bool {
+	cfg := setting.DataProxy()
+	return cfg.BlockInternalIps && !cfg.AllowLoopback
+}
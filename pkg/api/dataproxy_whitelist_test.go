@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestDataProxyWhiteList(t *testing.T) {
+	Convey("When checking the data proxy whitelist", t, func() {
+		_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+		_, subnet6, _ := net.ParseCIDR("2001:db8::/32")
+		setting.DataProxyWhiteList = map[string]bool{
+			"graphite:8080": true,
+			"influxdb":      true,
+			"10.0.0.0/24":   true,
+			"[::1]:9090":    true,
+			"fd00::10":      true,
+			"[fd00::20]":    true,
+			"2001:db8::/32": true,
+			"prometheus:80": true,
+			"Elastic.Local": true,
+		}
+		setting.DataProxyWhiteListNet = []*net.IPNet{subnet, subnet6}
+
+		isAllowed := func(rawUrl string) bool {
+			targetUrl, _ := url.Parse(rawUrl)
+			return isInDataProxyWhiteList(targetUrl)
+		}
+
+		Convey("Should match host and port", func() {
+			So(isAllowed("http://graphite:8080"), ShouldBeTrue)
+			So(isAllowed("http://graphite:9090"), ShouldBeFalse)
+		})
+
+		Convey("Should match bare host on any port", func() {
+			So(isAllowed("http://influxdb:8086"), ShouldBeTrue)
+		})
+
+		Convey("Should match ip in CIDR range", func() {
+			So(isAllowed("http://10.0.0.5:9090"), ShouldBeTrue)
+			So(isAllowed("http://10.0.1.5:9090"), ShouldBeFalse)
+		})
+
+		Convey("Should match IPv6 host and port", func() {
+			So(isAllowed("http://[::1]:9090"), ShouldBeTrue)
+			So(isAllowed("http://[0:0:0:0:0:0:0:1]:9090/api"), ShouldBeTrue)
+			So(isAllowed("http://[::1]:9091"), ShouldBeFalse)
+			So(isAllowed("http://[::1]"), ShouldBeFalse)
+		})
+
+		Convey("Should match bare IPv6 host with or without brackets", func() {
+			So(isAllowed("http://[fd00::10]:8086"), ShouldBeTrue)
+			So(isAllowed("http://[fd00::10]"), ShouldBeTrue)
+			So(isAllowed("http://[fd00::20]:3000"), ShouldBeTrue)
+			So(isAllowed("http://[fd00::30]:3000"), ShouldBeFalse)
+		})
+
+		Convey("Should match IPv6 ip in CIDR range", func() {
+			So(isAllowed("http://[2001:db8::1]/"), ShouldBeTrue)
+			So(isAllowed("http://[2001:db9::1]/"), ShouldBeFalse)
+		})
+
+		Convey("Should match the default port of the scheme", func() {
+			So(isAllowed("http://prometheus"), ShouldBeTrue)
+			So(isAllowed("https://prometheus"), ShouldBeFalse)
+		})
+
+		Convey("Should check the address of host overrides against CIDR ranges", func() {
+			setting.DataProxy().HostOverrides = map[string]net.IP{"prometheus.internal": net.ParseIP("10.0.0.7")}
+			defer func() { setting.DataProxy().HostOverrides = nil }()
+
+			So(isAllowed("http://prometheus.internal:9090"), ShouldBeTrue)
+		})
+
+		Convey("Should match hosts case insensitive", func() {
+			So(isAllowed("http://elastic.local:9200"), ShouldBeTrue)
+		})
+
+		Reset(func() {
+			setting.DataProxyWhiteList = map[string]bool{}
+			setting.DataProxyWhiteListNet = nil
+		})
+	})
+}
@@ -1,10 +1,16 @@
 package api
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
 	"sort"
+	"strings"
 
 	"github.com/grafana/grafana/pkg/api/dtos"
 	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/middleware"
 	m "github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/plugins"
@@ -84,12 +90,24 @@ func DeleteDataSource(c *middleware.Context) {
 		return
 	}
 
+	invalidateCachedDataSource(id, c.OrgId)
+
 	c.JsonOK("Data source deleted")
 }
 
 func AddDataSource(c *middleware.Context, cmd m.AddDataSourceCommand) {
 	cmd.OrgId = c.OrgId
 
+	if err := validateDataSourceUrl(cmd.Access, cmd.Url); err != nil {
+		c.JsonApiErr(400, err.Error(), nil)
+		return
+	}
+
+	if err := validateDataSourceFiles(cmd.JsonData); err != nil {
+		c.JsonApiErr(400, err.Error(), nil)
+		return
+	}
+
 	if err := bus.Dispatch(&cmd); err != nil {
 		if err == m.ErrDataSourceNameExists {
 			c.JsonApiErr(409, err.Error(), err)
@@ -107,6 +125,14 @@ func UpdateDataSource(c *middleware.Context, cmd m.UpdateDataSourceCommand) Resp
 	cmd.OrgId = c.OrgId
 	cmd.Id = c.ParamsInt64(":id")
 
+	if err := validateDataSourceUrl(cmd.Access, cmd.Url); err != nil {
+		return ApiError(400, err.Error(), nil)
+	}
+
+	if err := validateDataSourceFiles(cmd.JsonData); err != nil {
+		return ApiError(400, err.Error(), nil)
+	}
+
 	err := fillWithSecureJsonData(&cmd)
 	if err != nil {
 		return ApiError(500, "Failed to update datasource", err)
@@ -117,9 +143,71 @@ func UpdateDataSource(c *middleware.Context, cmd m.UpdateDataSourceCommand) Resp
 		return ApiError(500, "Failed to update datasource", err)
 	}
 
+	invalidateCachedDataSource(cmd.Id, cmd.OrgId)
+
 	return Json(200, util.DynMap{"message": "Datasource updated"})
 }
 
+// parseDataSourceUrl parses the url of a proxied datasource, urls without a
+// scheme default to http. Requests to unix socket datasources are sent to
+// http://localhost, the transport dials the socket
+func parseDataSourceUrl(rawUrl string) (*url.URL, error) {
+	if strings.HasPrefix(rawUrl, m.UnixSocketUrlPrefix) {
+		if !path.IsAbs(strings.TrimPrefix(rawUrl, m.UnixSocketUrlPrefix)) {
+			return nil, errors.New("socket path is not absolute")
+		}
+		return &url.URL{Scheme: "http", Host: "localhost"}, nil
+	}
+
+	if !strings.Contains(rawUrl, "://") {
+		rawUrl = "http://" + rawUrl
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Host == "" {
+		return nil, errors.New("url has no host")
+	}
+
+	return u, nil
+}
+
+// validateDataSourceFiles checks the json data options that name files on
+// the Grafana server, they can only name files in the directories of the
+// server settings
+func validateDataSourceFiles(jsonData *simplejson.Json) error {
+	if err := m.ValidateTLSFiles(jsonData); err != nil {
+		return err
+	}
+	if jsonData == nil {
+		return nil
+	}
+
+	if name := jsonData.Get("kerberosKeytab").MustString(); name != "" {
+		if _, err := resolveKerberosKeytab(name); err != nil {
+			return fmt.Errorf("Invalid kerberosKeytab: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateDataSourceUrl only checks proxied datasources, direct access urls are
+// used by the browser and can be relative
+func validateDataSourceUrl(access m.DsAccess, rawUrl string) error {
+	if access != m.DS_ACCESS_PROXY || rawUrl == "" {
+		return nil
+	}
+
+	if _, err := parseDataSourceUrl(rawUrl); err != nil {
+		return fmt.Errorf("Invalid datasource url %q: %v", rawUrl, err)
+	}
+
+	return nil
+}
+
 func fillWithSecureJsonData(cmd *m.UpdateDataSourceCommand) error {
 	if len(cmd.SecureJsonData) == 0 {
 		return nil
@@ -21,6 +21,7 @@ const (
 	SESS_TOKEN            = "keystone_token"
 	SESS_TOKEN_EXPIRATION = "keystone_expiration"
 	SESS_TOKEN_PROJECT    = "keystone_project"
+	SESS_TOKEN_DOMAIN     = "keystone_domain"
 	TOKEN_BUFFER_TIME     = 5 // Tokens refresh if the token will expire in less than this many minutes
 )
 
@@ -55,13 +56,30 @@ func getOrgName(c *middleware.Context) (string, error) {
 	return orgQuery.Result.Name, nil
 }
 
-func getNewToken(c *middleware.Context) (string, error) {
+// TokenScope is the domain and project a token is issued for. Without a project
+// the token is scoped to the project named like the org, without a domain to
+// the domain of the user
+type TokenScope struct {
+	Domain  string
+	Project string
+}
+
+// getScopeProject returns the project the token is scoped to, the org name
+// unless the scope names a project
+func getScopeProject(c *middleware.Context, scope TokenScope) (string, error) {
+	if scope.Project != "" {
+		return scope.Project, nil
+	}
+	return getOrgName(c)
+}
+
+func getNewToken(c *middleware.Context, scope TokenScope) (string, error) {
 	var username, project string
 	var err error
 	if username, err = getUserName(c); err != nil {
 		return "", err
 	}
-	if project, err = getOrgName(c); err != nil {
+	if project, err = getScopeProject(c, scope); err != nil {
 		return "", err
 	}
 
@@ -89,11 +107,12 @@ func getNewToken(c *middleware.Context) (string, error) {
 	// Remove @domain from project name
 	keystoneProject := strings.Replace(project, "@"+domain, "", 1)
 	auth := Auth_data{
-		Username: user,
-		Project:  keystoneProject,
-		Password: keystonePasswordObj.(string),
-		Domain:   domain,
-		Server:   setting.KeystoneURL,
+		Username:      user,
+		Project:       keystoneProject,
+		ProjectDomain: scope.Domain,
+		Password:      keystonePasswordObj.(string),
+		Domain:        domain,
+		Server:        setting.KeystoneURL,
 	}
 	if err := AuthenticateScoped(&auth); err != nil {
 		c.SetCookie(setting.CookieUserName, "", -1, setting.AppSubUrl+"/", nil, middleware.IsSecure(c), true)
@@ -106,11 +125,12 @@ func getNewToken(c *middleware.Context) (string, error) {
 	c.Session.Set(SESS_TOKEN, auth.Token)
 	c.Session.Set(SESS_TOKEN_EXPIRATION, auth.Expiration)
 	c.Session.Set(SESS_TOKEN_PROJECT, project)
+	c.Session.Set(SESS_TOKEN_DOMAIN, scope.Domain)
 	// in keystone v3 the token is in the response header
 	return auth.Token, nil
 }
 
-func validateCurrentToken(c *middleware.Context) (bool, error) {
+func validateCurrentToken(c *middleware.Context, scope TokenScope) (bool, error) {
 	token := c.Session.Get(SESS_TOKEN)
 	if token == nil {
 		return false, nil
@@ -131,30 +151,75 @@ func validateCurrentToken(c *middleware.Context) (bool, error) {
 	}
 
 	project := c.Session.Get(SESS_TOKEN_PROJECT)
-	org, err := getOrgName(c)
+	scopeProject, err := getScopeProject(c, scope)
 	if err != nil {
 		return false, err
 	}
-	if org != project {
+	if scopeProject != project {
+		return false, nil
+	}
+
+	// sessions from before scoping have no domain, they are scoped to the
+	// domain of the user
+	domain, _ := c.Session.Get(SESS_TOKEN_DOMAIN).(string)
+	if domain != scope.Domain {
 		return false, nil
 	}
 
 	return true, nil
 }
 
-func GetToken(c *middleware.Context) (string, error) {
+// GetToken returns a token of the signed in user for the scope, tokens are
+// reused from the session and the token cache until they expire
+func GetToken(c *middleware.Context, scope TokenScope) (string, error) {
 	var token string
 	var err error
-	valid, err := validateCurrentToken(c)
+
+	cacheKey, cacheable := getTokenCacheKey(c, scope)
+	if cacheable {
+		if token, exists := getCachedToken(cacheKey); exists {
+			return token, nil
+		}
+	}
+
+	valid, err := validateCurrentToken(c, scope)
 	if valid {
-		return c.Session.Get(SESS_TOKEN).(string), nil
+		token = c.Session.Get(SESS_TOKEN).(string)
+	} else if token, err = getNewToken(c, scope); err != nil {
+		return "", err
 	}
-	if token, err = getNewToken(c); err != nil {
+
+	if cacheable {
+		cacheSessionToken(c, cacheKey, token)
+	}
+	return token, nil
+}
+
+// RefreshToken issues a new token for the scope, used when the backend
+// rejected the cached or session token before it expired
+func RefreshToken(c *middleware.Context, scope TokenScope) (string, error) {
+	cacheKey, cacheable := getTokenCacheKey(c, scope)
+	if cacheable {
+		invalidateCachedToken(cacheKey)
+	}
+
+	token, err := getNewToken(c, scope)
+	if err != nil {
 		return "", err
 	}
+
+	if cacheable {
+		cacheSessionToken(c, cacheKey, token)
+	}
 	return token, nil
 }
 
+func cacheSessionToken(c *middleware.Context, cacheKey tokenCacheKey, token string) {
+	if expiration, ok := c.Session.Get(SESS_TOKEN_EXPIRATION).(string); ok {
+		cacheToken(cacheKey, token, expiration)
+	}
+}
+
 func EncryptPassword(password string) string {
 	key := []byte(setting.KeystoneCredentialAesKey)
 	block, err := aes.NewCipher(key)
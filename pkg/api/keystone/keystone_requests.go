@@ -131,6 +131,7 @@ type Auth_data struct {
 	Server        string
 	Domain        string
 	DomainId      string
+	ProjectDomain string // domain of the project, the domain of the user when empty
 	Username      string
 	Password      string
 	Project       string
@@ -146,7 +147,7 @@ func AuthenticateScoped(data *Auth_data) error {
 		var auth_post scoped_auth_token_request_struct
 		auth_post.Auth.Identity.Methods = []string{"token"}
 		auth_post.Auth.Identity.Token.Id = data.UnscopedToken
-		auth_post.Auth.Scope.Project.Domain.Name = data.Domain
+		auth_post.Auth.Scope.Project.Domain.Name = data.projectDomain()
 		auth_post.Auth.Scope.Project.Name = data.Project
 		b, _ := json.Marshal(auth_post)
 		return authenticate(data, b)
@@ -157,13 +158,20 @@ func AuthenticateScoped(data *Auth_data) error {
 		auth_post.Auth.Identity.Password.User.Name = data.Username
 		auth_post.Auth.Identity.Password.User.Password = data.Password
 		auth_post.Auth.Identity.Password.User.Domain.Name = data.Domain
-		auth_post.Auth.Scope.Project.Domain.Name = data.Domain
+		auth_post.Auth.Scope.Project.Domain.Name = data.projectDomain()
 		auth_post.Auth.Scope.Project.Name = data.Project
 		b, _ := json.Marshal(auth_post)
 		return authenticate(data, b)
 	}
 }
 
+func (data *Auth_data) projectDomain() string {
+	if data.ProjectDomain != "" {
+		return data.ProjectDomain
+	}
+	return data.Domain
+}
+
 func AuthenticateUnscoped(data *Auth_data) error {
 	var auth_post auth_request_struct
 	auth_post.Auth.Scope = "unscoped"
@@ -0,0 +1,74 @@
+package keystone
+
+import (
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/middleware"
+)
+
+// tokens are cached per org and user so they are never shared between
+// identities, and per scope so datasources of other projects get their own
+type tokenCacheKey struct {
+	orgId  int64
+	userId int64
+	login  string
+	scope  TokenScope
+}
+
+type tokenCacheItem struct {
+	token   string
+	expires time.Time
+}
+
+var tokenCache = struct {
+	sync.Mutex
+	items map[tokenCacheKey]tokenCacheItem
+}{items: make(map[tokenCacheKey]tokenCacheItem)}
+
+func getTokenCacheKey(c *middleware.Context, scope TokenScope) (tokenCacheKey, bool) {
+	if c.SignedInUser == nil || c.UserId == 0 {
+		return tokenCacheKey{}, false
+	}
+	return tokenCacheKey{orgId: c.OrgId, userId: c.UserId, login: c.Login, scope: scope}, true
+}
+
+func getCachedToken(key tokenCacheKey) (string, bool) {
+	tokenCache.Lock()
+	defer tokenCache.Unlock()
+
+	item, exists := tokenCache.items[key]
+	if !exists {
+		return "", false
+	}
+
+	if time.Now().After(item.expires) {
+		delete(tokenCache.items, key)
+		return "", false
+	}
+
+	return item.token, true
+}
+
+// cacheToken keeps the token until TOKEN_BUFFER_TIME before it expires
+func cacheToken(key tokenCacheKey, token string, expiration string) {
+	expires, err := time.Parse(time.RFC3339, expiration)
+	if err != nil {
+		return
+	}
+
+	tokenCache.Lock()
+	defer tokenCache.Unlock()
+
+	tokenCache.items[key] = tokenCacheItem{
+		token:   token,
+		expires: expires.Add(-TOKEN_BUFFER_TIME * time.Minute),
+	}
+}
+
+func invalidateCachedToken(key tokenCacheKey) {
+	tokenCache.Lock()
+	defer tokenCache.Unlock()
+
+	delete(tokenCache.items, key)
+}
@@ -0,0 +1,55 @@
+package keystone
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/grafana/grafana/pkg/middleware"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+func TestKeystoneTokenCache(t *testing.T) {
+	Convey("When caching keystone tokens", t, func() {
+		c := &middleware.Context{SignedInUser: &m.SignedInUser{OrgId: 1, UserId: 2, Login: "admin"}}
+		key, cacheable := getTokenCacheKey(c, TokenScope{})
+		So(cacheable, ShouldBeTrue)
+		defer invalidateCachedToken(key)
+
+		cacheToken(key, "token", time.Now().Add(time.Hour).Format(time.RFC3339))
+
+		Convey("Should return the token for the same user and org", func() {
+			token, exists := getCachedToken(key)
+			So(exists, ShouldBeTrue)
+			So(token, ShouldEqual, "token")
+		})
+
+		Convey("Should not share the token with another org or user", func() {
+			otherOrg, _ := getTokenCacheKey(&middleware.Context{SignedInUser: &m.SignedInUser{OrgId: 3, UserId: 2, Login: "admin"}}, TokenScope{})
+			_, exists := getCachedToken(otherOrg)
+			So(exists, ShouldBeFalse)
+
+			otherUser, _ := getTokenCacheKey(&middleware.Context{SignedInUser: &m.SignedInUser{OrgId: 1, UserId: 4, Login: "editor"}}, TokenScope{})
+			_, exists = getCachedToken(otherUser)
+			So(exists, ShouldBeFalse)
+		})
+
+		Convey("Should not share the token with another scope", func() {
+			otherProject, _ := getTokenCacheKey(c, TokenScope{Domain: "ops", Project: "monitoring"})
+			_, exists := getCachedToken(otherProject)
+			So(exists, ShouldBeFalse)
+		})
+
+		Convey("Should not return tokens about to expire", func() {
+			cacheToken(key, "token", time.Now().Add(time.Minute).Format(time.RFC3339))
+			_, exists := getCachedToken(key)
+			So(exists, ShouldBeFalse)
+		})
+
+		Convey("Should not cache for anonymous users", func() {
+			_, cacheable := getTokenCacheKey(&middleware.Context{SignedInUser: &m.SignedInUser{OrgId: 1}}, TokenScope{})
+			So(cacheable, ShouldBeFalse)
+		})
+	})
+}
@@ -175,6 +175,14 @@ func OAuthLogin(ctx *middleware.Context) {
 	// login
 	loginUserWithUser(userQuery.Result, ctx)
 
+	// kept for datasources that pass the token of the user on, see oauthPassThru
+	var expiry int64
+	if !token.Expiry.IsZero() {
+		expiry = token.Expiry.Unix()
+	}
+	ctx.Session.Set(middleware.SESS_KEY_OAUTH_ACCESS_TOKEN, token.AccessToken)
+	ctx.Session.Set(middleware.SESS_KEY_OAUTH_EXPIRY, expiry)
+
 	metrics.M_Api_Login_OAuth.Inc(1)
 
 	ctx.Redirect(setting.AppSubUrl + "/")
@@ -0,0 +1,109 @@
+package stackdriver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+
+	"github.com/grafana/grafana/pkg/api/tokenproxy"
+	"github.com/grafana/grafana/pkg/middleware"
+	m "github.com/grafana/grafana/pkg/models"
+)
+
+const (
+	defaultTokenUrl = "https://oauth2.googleapis.com/token"
+	monitoringUrl   = "https://monitoring.googleapis.com"
+	monitoringScope = "https://www.googleapis.com/auth/monitoring.read"
+	// tokens are refreshed this long before they expire
+	tokenExpiryDelta = 5 * time.Minute
+)
+
+// datasourceInfo holds the fields of the service account key file, the
+// private key is kept in the secure json data
+type datasourceInfo struct {
+	DatasourceId  int64
+	Updated       time.Time
+	ClientEmail   string
+	PrivateKey    string
+	TokenUrl      string
+	MonitoringUrl string
+}
+
+func getDatasourceInfo(ds *m.DataSource) *datasourceInfo {
+	info := &datasourceInfo{
+		DatasourceId:  ds.Id,
+		Updated:       ds.Updated,
+		PrivateKey:    ds.SecureJsonData.Decrypt()["privateKey"],
+		TokenUrl:      defaultTokenUrl,
+		MonitoringUrl: monitoringUrl,
+	}
+
+	if ds.JsonData != nil {
+		info.ClientEmail = ds.JsonData.Get("clientEmail").MustString()
+		info.TokenUrl = ds.JsonData.Get("tokenUri").MustString(defaultTokenUrl)
+	}
+
+	return info
+}
+
+// GetEndpoints returns the monitoring and token urls the credentials of the
+// datasource are sent to
+func GetEndpoints(ds *m.DataSource) []string {
+	info := getDatasourceInfo(ds)
+	return []string{info.MonitoringUrl, info.TokenUrl}
+}
+
+type tokenCacheKey struct {
+	datasourceId int64
+	updated      time.Time
+}
+
+var tokenCache map[tokenCacheKey]*oauth2.Token = make(map[tokenCacheKey]*oauth2.Token)
+var tokenCacheLock sync.Mutex
+
+// getAccessToken exchanges a JWT signed with the service account key for an
+// access token, tokens are cached until they expire or the datasource changes
+func getAccessToken(info *datasourceInfo, client *http.Client) (string, error) {
+	cacheKey := tokenCacheKey{datasourceId: info.DatasourceId, updated: info.Updated}
+
+	tokenCacheLock.Lock()
+	defer tokenCacheLock.Unlock()
+
+	if token, ok := tokenCache[cacheKey]; ok && time.Now().Before(token.Expiry.Add(-tokenExpiryDelta)) {
+		return token.AccessToken, nil
+	}
+
+	if info.ClientEmail == "" || info.PrivateKey == "" {
+		return "", errors.New("Google service account client email and private key are required")
+	}
+
+	conf := &jwt.Config{
+		Email:      info.ClientEmail,
+		PrivateKey: []byte(info.PrivateKey),
+		Scopes:     []string{monitoringScope},
+		TokenURL:   info.TokenUrl,
+	}
+
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+	token, err := conf.TokenSource(ctx).Token()
+	if err != nil {
+		return "", err
+	}
+
+	tokenCache[cacheKey] = token
+	return token.AccessToken, nil
+}
+
+// HandleRequest proxies the request to the Cloud Monitoring api with the
+// access token of the datasource
+func HandleRequest(c *middleware.Context, ds *m.DataSource, wrapTransport func(http.RoundTripper) http.RoundTripper) {
+	info := getDatasourceInfo(ds)
+	tokenproxy.HandleRequest(c, ds, info.MonitoringUrl, func(client *http.Client) (string, error) {
+		return getAccessToken(info, client)
+	}, wrapTransport)
+}
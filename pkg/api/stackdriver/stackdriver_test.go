@@ -0,0 +1,78 @@
+package stackdriver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
+)
+
+func TestStackdriver(t *testing.T) {
+	Convey("When getting a Google access token", t, func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		So(err, ShouldBeNil)
+		privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+		tokenRequests := 0
+		var grantType string
+		var claims *jws.ClaimSet
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenRequests++
+			r.ParseForm()
+			grantType = r.PostForm.Get("grant_type")
+			claims, _ = jws.Decode(r.PostForm.Get("assertion"))
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token":"token","token_type":"Bearer","expires_in":3599}`)
+		}))
+		defer server.Close()
+
+		info := &datasourceInfo{
+			DatasourceId:  1,
+			ClientEmail:   "grafana@project.iam.gserviceaccount.com",
+			PrivateKey:    string(privateKey),
+			TokenUrl:      server.URL,
+			MonitoringUrl: monitoringUrl,
+		}
+
+		Convey("Should exchange a JWT signed with the service account key and cache the token", func() {
+			token, err := getAccessToken(info, http.DefaultClient)
+			So(err, ShouldBeNil)
+			So(token, ShouldEqual, "token")
+			So(grantType, ShouldEqual, "urn:ietf:params:oauth:grant-type:jwt-bearer")
+			So(claims.Iss, ShouldEqual, "grafana@project.iam.gserviceaccount.com")
+			So(claims.Aud, ShouldEqual, server.URL)
+			So(claims.Scope, ShouldEqual, monitoringScope)
+
+			getAccessToken(info, http.DefaultClient)
+			So(tokenRequests, ShouldEqual, 1)
+		})
+
+		Convey("Should not share tokens between datasources", func() {
+			getAccessToken(info, http.DefaultClient)
+
+			other := *info
+			other.DatasourceId = 2
+			getAccessToken(&other, http.DefaultClient)
+			So(tokenRequests, ShouldEqual, 2)
+		})
+
+		Convey("Should require the client email and private key", func() {
+			info.PrivateKey = ""
+			_, err := getAccessToken(info, http.DefaultClient)
+			So(err, ShouldNotBeNil)
+			So(tokenRequests, ShouldEqual, 0)
+		})
+
+		Reset(func() {
+			tokenCache = make(map[tokenCacheKey]*oauth2.Token)
+		})
+	})
+}
@@ -0,0 +1,65 @@
+package tokenproxy
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/grafana/grafana/pkg/middleware"
+	m "github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+// TokenFunc gets the bearer token of the datasource, client uses the
+// transport of the datasource
+type TokenFunc func(client *http.Client) (string, error)
+
+// NewReverseProxy proxies to the api at target and signs the requests with
+// the token, the cookies of the client are not passed on
+func NewReverseProxy(target string, token string, proxyPath string) (*httputil.ReverseProxy, error) {
+	targetUrl, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	director := func(req *http.Request) {
+		req.URL.Scheme = targetUrl.Scheme
+		req.URL.Host = targetUrl.Host
+		req.Host = targetUrl.Host
+		req.URL.Path = util.JoinUrlFragments(targetUrl.Path, proxyPath)
+
+		req.Header.Del("Cookie")
+		req.Header.Del("Set-Cookie")
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return &httputil.ReverseProxy{Director: director, FlushInterval: time.Millisecond * 200}, nil
+}
+
+// HandleRequest proxies the request to the api at target with the token of
+// getToken, wrapTransport wraps the round tripper of the proxy, like with one
+// that answers failed connections with a json error
+func HandleRequest(c *middleware.Context, ds *m.DataSource, target string, getToken TokenFunc, wrapTransport func(http.RoundTripper) http.RoundTripper) {
+	transport, err := ds.GetHttpTransport()
+	if err != nil {
+		c.JsonApiErr(500, err.Error(), err)
+		return
+	}
+
+	token, err := getToken(&http.Client{Transport: transport, Timeout: 30 * time.Second})
+	if err != nil {
+		c.JsonApiErr(500, "Failed to get access token for datasource", err)
+		return
+	}
+
+	proxy, err := NewReverseProxy(target, token, c.Params("*"))
+	if err != nil {
+		c.JsonApiErr(400, "Invalid datasource api url", err)
+		return
+	}
+
+	proxy.Transport = wrapTransport(transport)
+	proxy.ServeHTTP(c.Resp, c.Req.Request)
+	c.Resp.Header().Del("Set-Cookie")
+}
@@ -0,0 +1,26 @@
+package tokenproxy
+
+import (
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTokenProxy(t *testing.T) {
+	Convey("When proxying with a bearer token", t, func() {
+		proxy, err := NewReverseProxy("https://management.azure.com/api", "token", "subscriptions/1/providers")
+		So(err, ShouldBeNil)
+
+		req, _ := http.NewRequest("GET", "http://grafana.com/api/datasources/proxy/1/subscriptions/1/providers", nil)
+		req.Header.Set("Cookie", "grafana_sess=1")
+		proxy.Director(req)
+
+		Convey("Should sign the request with the token", func() {
+			So(req.URL.String(), ShouldEqual, "https://management.azure.com/api/subscriptions/1/providers")
+			So(req.Host, ShouldEqual, "management.azure.com")
+			So(req.Header.Get("Authorization"), ShouldEqual, "Bearer token")
+			So(req.Header.Get("Cookie"), ShouldEqual, "")
+		})
+	})
+}
@@ -61,12 +61,16 @@ func main() {
 	server.Start()
 }
 
-func initRuntime() {
-	err := setting.NewConfigContext(&setting.CommandLineArgs{
+func commandLineArgs() *setting.CommandLineArgs {
+	return &setting.CommandLineArgs{
 		Config:   *configFile,
 		HomePath: *homePath,
 		Args:     flag.Args(),
-	})
+	}
+}
+
+func initRuntime() {
+	err := setting.NewConfigContext(commandLineArgs())
 
 	if err != nil {
 		log.Fatal(3, err.Error())
@@ -103,16 +107,35 @@ func writePIDFile() {
 
 func listenToSystemSignals(server models.GrafanaServer) {
 	signalChan := make(chan os.Signal, 1)
-	ignoreChan := make(chan os.Signal, 1)
+	reloadChan := make(chan os.Signal, 1)
 	code := 0
 
-	signal.Notify(ignoreChan, syscall.SIGHUP)
+	signal.Notify(reloadChan, syscall.SIGHUP)
 	signal.Notify(signalChan, os.Interrupt, os.Kill, syscall.SIGTERM)
 
-	select {
-	case sig := <-signalChan:
-		server.Shutdown(0, fmt.Sprintf("system signal: %s", sig))
-	case code = <-exitChan:
-		server.Shutdown(code, "startup error")
+	for {
+		select {
+		case <-reloadChan:
+			reloadDataProxy()
+		case sig := <-signalChan:
+			server.Shutdown(0, fmt.Sprintf("system signal: %s", sig))
+			return
+		case code = <-exitChan:
+			server.Shutdown(code, "startup error")
+			return
+		}
 	}
 }
+
+// reloadDataProxy applies changed [dataproxy] settings on SIGHUP, the
+// datasource transports are built again with them
+func reloadDataProxy() {
+	logger := log.New("main")
+	if err := setting.ReloadDataProxySettings(commandLineArgs()); err != nil {
+		logger.Error("Failed to reload data proxy settings", "error", err)
+		return
+	}
+
+	models.CloseDataSourceTransports()
+	logger.Info("Reloaded data proxy settings")
+}
@@ -22,6 +22,7 @@ var (
 	M_Proxy_Status_404                     Counter
 	M_Proxy_Status_500                     Counter
 	M_Proxy_Status_Unknown                 Counter
+	M_DataSource_ProxyReq_Retries          Counter
 	M_Api_User_SignUpStarted               Counter
 	M_Api_User_SignUpCompleted             Counter
 	M_Api_User_SignUpInvite                Counter
@@ -58,6 +59,8 @@ var (
 	M_StatTotal_Users        Gauge
 	M_StatTotal_Orgs         Gauge
 	M_StatTotal_Playlists    Gauge
+
+	M_DataSource_ProxyReq_Utilization Gauge
 )
 
 func initMetricVars(settings *MetricSettings) {
@@ -81,6 +84,8 @@ func initMetricVars(settings *MetricSettings) {
 	M_Proxy_Status_500 = RegCounter("proxy.resp_status", "code", "500")
 	M_Proxy_Status_Unknown = RegCounter("proxy.resp_status", "code", "unknown")
 
+	M_DataSource_ProxyReq_Retries = RegCounter("api.dataproxy.request.retries")
+
 	M_Api_User_SignUpStarted = RegCounter("api.user.signup_started")
 	M_Api_User_SignUpCompleted = RegCounter("api.user.signup_completed")
 	M_Api_User_SignUpInvite = RegCounter("api.user.signup_invite")
@@ -123,4 +128,6 @@ func initMetricVars(settings *MetricSettings) {
 	M_StatTotal_Users = RegGauge("stat_totals", "stat", "users")
 	M_StatTotal_Orgs = RegGauge("stat_totals", "stat", "orgs")
 	M_StatTotal_Playlists = RegGauge("stat_totals", "stat", "playlists")
+
+	M_DataSource_ProxyReq_Utilization = RegGauge("api.dataproxy.request.utilization")
 }
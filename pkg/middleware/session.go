@@ -15,6 +15,10 @@ const (
 	SESS_KEY_USERID      = "uid"
 	SESS_KEY_OAUTH_STATE = "state"
 	SESS_KEY_PASSWORD    = "grafana_password"
+	// the access token of an OAuth login and its expiry in unix seconds, 0
+	// when the provider did not report one
+	SESS_KEY_OAUTH_ACCESS_TOKEN = "oauth_access_token"
+	SESS_KEY_OAUTH_EXPIRY       = "oauth_expiry"
 )
 
 var sessionManager *session.Manager
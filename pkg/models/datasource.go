@@ -17,6 +17,8 @@ const (
 	DS_CLOUDWATCH    = "cloudwatch"
 	DS_KAIROSDB      = "kairosdb"
 	DS_PROMETHEUS    = "prometheus"
+	DS_AZURE_MONITOR = "grafana-azure-monitor-datasource"
+	DS_STACKDRIVER   = "stackdriver"
 	DS_ACCESS_DIRECT = "direct"
 	DS_ACCESS_PROXY  = "proxy"
 )
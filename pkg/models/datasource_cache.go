@@ -1,14 +1,38 @@
 package models
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+
+	"github.com/grafana/grafana/pkg/setting"
 )
 
+var ErrDataSourceAddressBlocked = errors.New("Connection to a blocked address, see data_proxy_block_internal_ips")
+
+// UnixSocketUrlPrefix starts the url of datasources reached over a unix socket
+const UnixSocketUrlPrefix = "unix://"
+
+// cloud metadata endpoints that are not covered by the link-local ranges
+var blockedDataSourceNets = []*net.IPNet{
+	mustParseCIDR("169.254.0.0/16"),
+	mustParseCIDR("fe80::/10"),
+	mustParseCIDR("100.100.100.200/32"),
+	mustParseCIDR("fd00:ec2::254/128"),
+}
+
 type proxyTransportCache struct {
 	cache map[int64]cachedTransport
 	sync.Mutex
@@ -16,6 +40,8 @@ type proxyTransportCache struct {
 
 type cachedTransport struct {
 	updated time.Time
+	// the version of the tls files the transport was built with
+	tlsFiles string
 
 	*http.Transport
 }
@@ -41,55 +67,396 @@ func (ds *DataSource) GetHttpTransport() (*http.Transport, error) {
 	ptc.Lock()
 	defer ptc.Unlock()
 
-	if t, present := ptc.cache[ds.Id]; present && ds.Updated.Equal(t.updated) {
+	tlsFiles := ds.getTLSFilesVersion()
+	if t, present := ptc.cache[ds.Id]; present && ds.Updated.Equal(t.updated) && t.tlsFiles == tlsFiles {
+		return t.Transport, nil
+	}
+
+	transport, err := ds.newHttpTransport(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// requests in flight finish on the transport of the old settings
+	if t, present := ptc.cache[ds.Id]; present {
+		t.CloseIdleConnections()
+	}
+	ptc.cache[ds.Id] = cachedTransport{
+		Transport: transport,
+		updated:   ds.Updated,
+		tlsFiles:  tlsFiles,
+	}
+
+	return transport, nil
+}
+
+type clientCertTransportKey struct {
+	dsId        int64
+	fingerprint [sha256.Size]byte
+}
+
+var clientCertTransports = struct {
+	cache map[clientCertTransportKey]cachedTransport
+	sync.Mutex
+}{cache: make(map[clientCertTransportKey]cachedTransport)}
+
+// CloseDataSourceTransports drops the cached transports, so they are built
+// with the current settings on the next request. Only their idle connections
+// are closed, requests in flight finish on the old transports
+func CloseDataSourceTransports() {
+	ptc.Lock()
+	transports := ptc.cache
+	ptc.cache = make(map[int64]cachedTransport)
+	ptc.Unlock()
+
+	clientCertTransports.Lock()
+	clientCertCache := clientCertTransports.cache
+	clientCertTransports.cache = make(map[clientCertTransportKey]cachedTransport)
+	clientCertTransports.Unlock()
+
+	for _, t := range transports {
+		t.CloseIdleConnections()
+	}
+	for _, t := range clientCertCache {
+		t.CloseIdleConnections()
+	}
+}
+
+// GetHttpTransportWithClientCert returns a transport that authenticates with
+// the given client certificate instead of the one of the datasource, the
+// transports are cached per certificate so connections are never shared
+// between certificates
+func (ds *DataSource) GetHttpTransportWithClientCert(cert *tls.Certificate) (*http.Transport, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("Client certificate is empty")
+	}
+
+	key := clientCertTransportKey{dsId: ds.Id, fingerprint: sha256.Sum256(cert.Certificate[0])}
+
+	clientCertTransports.Lock()
+	defer clientCertTransports.Unlock()
+
+	tlsFiles := ds.getTLSFilesVersion()
+	if t, present := clientCertTransports.cache[key]; present && ds.Updated.Equal(t.updated) && t.tlsFiles == tlsFiles {
 		return t.Transport, nil
 	}
 
+	transport, err := ds.newHttpTransport(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	if t, present := clientCertTransports.cache[key]; present {
+		t.CloseIdleConnections()
+	}
+	clientCertTransports.cache[key] = cachedTransport{
+		Transport: transport,
+		updated:   ds.Updated,
+		tlsFiles:  tlsFiles,
+	}
+
+	return transport, nil
+}
+
+// newHttpTransport builds the transport of the datasource, clientCert replaces
+// the tls client certificate of the datasource when it is set
+func (ds *DataSource) newHttpTransport(clientCert *tls.Certificate) (*http.Transport, error) {
+	cfg := setting.DataProxy()
+	var tlsSkipVerify, tlsAuth, tlsAuthWithCACert bool
+	var tlsServerName string
+	if ds.JsonData != nil {
+		tlsSkipVerify = ds.JsonData.Get("tlsSkipVerify").MustBool(false)
+		tlsAuth = ds.JsonData.Get("tlsAuth").MustBool(false)
+		tlsAuthWithCACert = ds.JsonData.Get("tlsAuthWithCACert").MustBool(false)
+		tlsServerName = ds.GetTLSServerName()
+	}
+	// data_proxy_tls_verify verifies all datasources, whatever they are set to
+	if cfg.TLSVerify {
+		tlsSkipVerify = false
+	}
+
+	// unreachable backends fail after the connect timeout while slow queries
+	// can wait for the response header timeout
+	connectTimeout := cfg.DialTimeout
+	responseHeaderTimeout := cfg.ResponseHeaderTimeout
+	if ds.JsonData != nil {
+		connectTimeout = ds.JsonData.Get("connectTimeout").MustInt(connectTimeout)
+		responseHeaderTimeout = ds.JsonData.Get("responseHeaderTimeout").MustInt(responseHeaderTimeout)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(connectTimeout) * time.Second,
+		KeepAlive: time.Duration(cfg.KeepAlive) * time.Second,
+	}
+
 	transport := &http.Transport{
 		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
+			InsecureSkipVerify: tlsSkipVerify,
+			ServerName:         tlsServerName,
 		},
-		Proxy: http.ProxyFromEnvironment,
-		Dial: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).Dial,
-		TLSHandshakeTimeout:   10 * time.Second,
+		Proxy:                 http.ProxyFromEnvironment,
+		Dial:                  dialer.Dial,
+		TLSHandshakeTimeout:   time.Duration(cfg.TLSHandshakeTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(responseHeaderTimeout) * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(cfg.IdleConnTimeout) * time.Second,
 	}
 
-	var tlsAuth, tlsAuthWithCACert bool
-	if ds.JsonData != nil {
-		tlsAuth = ds.JsonData.Get("tlsAuth").MustBool(false)
-		tlsAuthWithCACert = ds.JsonData.Get("tlsAuthWithCACert").MustBool(false)
+	if err := configureTLSVersion(transport.TLSClientConfig, ds.JsonData); err != nil {
+		return nil, err
 	}
 
-	if tlsAuth {
-		transport.TLSClientConfig.InsecureSkipVerify = false
+	if socket := ds.UnixSocketPath(); socket != "" {
+		// every connection goes to the socket on this host, the outbound proxy
+		// can not reach it
+		transport.Proxy = nil
+		transport.Dial = countConnsDial(func(network, addr string) (net.Conn, error) {
+			return dialer.Dial("unix", socket)
+		})
+	} else {
+		if err := setOutboundProxy(transport, dialer); err != nil {
+			return nil, err
+		}
+		transport.Dial = hostOverrideDial(transport.Dial)
 
+		// the outbound proxy resolves the datasource host itself, only direct
+		// connections can be checked. The proxies of HTTP_PROXY and HTTPS_PROXY
+		// are not used, the check would only see the address of the proxy
+		if cfg.BlockInternalIps && cfg.OutboundUrl == "" {
+			transport.Proxy = nil
+			transport.Dial = blockInternalDial(transport.Dial, LookupDataSourceHost)
+		}
+		transport.Dial = countConnsDial(transport.Dial)
+
+		// the header has to reach the load balancer in front of the datasource,
+		// not an http proxy on the way
+		if ds.UsesProxyProtocol() {
+			if transport.Proxy != nil && cfg.OutboundUrl != "" {
+				return nil, errProxyProtocolOutboundProxy
+			}
+			transport.Proxy = nil
+			transport.DialContext = proxyProtocolDial(transport.Dial)
+			transport.DisableKeepAlives = true
+		}
+	}
+
+	if tlsAuth || tlsAuthWithCACert {
 		decrypted := ds.SecureJsonData.Decrypt()
+		if err := ds.readTLSFiles(decrypted); err != nil {
+			return nil, err
+		}
 
 		if tlsAuthWithCACert && len(decrypted["tlsCACert"]) > 0 {
 			caPool := x509.NewCertPool()
-			ok := caPool.AppendCertsFromPEM([]byte(decrypted["tlsCACert"]))
-			if ok {
-				transport.TLSClientConfig.RootCAs = caPool
+			if ok := caPool.AppendCertsFromPEM([]byte(decrypted["tlsCACert"])); !ok {
+				return nil, errors.New("Failed to parse tlsCACert: no valid PEM certificates found")
+			}
+			transport.TLSClientConfig.RootCAs = caPool
+		}
+
+		if tlsAuth && clientCert == nil {
+			cert, err := loadClientCertificate(decrypted["tlsClientCert"], decrypted["tlsClientKey"])
+			if err != nil {
+				return nil, err
 			}
+			transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	if clientCert != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+
+	// a custom dialer or tls config disables the automatic http2 support of
+	// http.Transport, enableHTTP2 negotiates it with ALPN again
+	if ds.JsonData != nil && ds.JsonData.Get("enableHTTP2").MustBool(false) {
+		if err := http2.ConfigureTransport(transport); err != nil {
+			return nil, fmt.Errorf("Failed to enable HTTP/2: %v", err)
+		}
+	}
+
+	return transport, nil
+}
+
+// UnixSocketPath returns the socket of datasources with a unix:///path/to.sock
+// url, empty for datasources reached over tcp
+func (ds *DataSource) UnixSocketPath() string {
+	if !strings.HasPrefix(ds.Url, UnixSocketUrlPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(ds.Url, UnixSocketUrlPrefix)
+}
+
+// GetTLSServerName returns the server name sent with SNI and used to verify the
+// certificate of the datasource, tlsServerName in json data or else the host
+// of customHost. Empty means the host of the datasource url
+func (ds *DataSource) GetTLSServerName() string {
+	if ds.JsonData == nil {
+		return ""
+	}
+
+	if serverName := ds.JsonData.Get("tlsServerName").MustString(); serverName != "" {
+		return serverName
+	}
+
+	customHost := ds.JsonData.Get("customHost").MustString()
+	if host, _, err := net.SplitHostPort(customHost); err == nil {
+		return host
+	}
+
+	return customHost
+}
+
+func loadClientCertificate(certPEM string, keyPEM string) (tls.Certificate, error) {
+	if block, _ := pem.Decode([]byte(certPEM)); block == nil {
+		return tls.Certificate{}, errors.New("Failed to parse tlsClientCert: no valid PEM data found")
+	}
+
+	if block, _ := pem.Decode([]byte(keyPEM)); block == nil {
+		return tls.Certificate{}, errors.New("Failed to parse tlsClientKey: no valid PEM data found")
+	}
+
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Failed to parse tlsClientCert and tlsClientKey: %v", err)
+	}
+
+	return cert, nil
+}
+
+// setOutboundProxy routes datasource traffic through the configured http or
+// socks5 proxy, without one the proxy environment variables are used
+func setOutboundProxy(transport *http.Transport, dialer *net.Dialer) error {
+	cfg := setting.DataProxy()
+	if cfg.OutboundUrl == "" {
+		return nil
+	}
+
+	proxyUrl, err := url.Parse(cfg.OutboundUrl)
+	if err != nil {
+		return fmt.Errorf("Invalid data_proxy_outbound_url: %v", err)
+	}
+
+	switch proxyUrl.Scheme {
+	case "http", "https":
+		if cfg.OutboundUser != "" {
+			proxyUrl.User = url.UserPassword(cfg.OutboundUser, cfg.OutboundPassword)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	case "socks5":
+		var auth *proxy.Auth
+		if cfg.OutboundUser != "" {
+			auth = &proxy.Auth{User: cfg.OutboundUser, Password: cfg.OutboundPassword}
 		}
 
-		cert, err := tls.X509KeyPair([]byte(decrypted["tlsClientCert"]), []byte(decrypted["tlsClientKey"]))
+		socksDialer, err := proxy.SOCKS5("tcp", proxyUrl.Host, auth, dialer)
+		if err != nil {
+			return fmt.Errorf("Invalid data_proxy_outbound_url: %v", err)
+		}
+		transport.Proxy = nil
+		transport.Dial = socksDialer.Dial
+	default:
+		return fmt.Errorf("Unsupported data_proxy_outbound_url scheme %s", proxyUrl.Scheme)
+	}
+
+	return nil
+}
+
+// IsBlockedDataSourceIP returns true for addresses datasources may not connect
+// to when data_proxy_block_internal_ips is enabled, link-local and cloud
+// metadata addresses and loopback addresses unless data_proxy_allow_loopback
+// is set
+func IsBlockedDataSourceIP(ip net.IP) bool {
+	cfg := setting.DataProxy()
+	if !cfg.BlockInternalIps {
+		return false
+	}
+
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return !cfg.AllowLoopback
+	}
+
+	for _, blocked := range blockedDataSourceNets {
+		if blocked.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockInternalDial resolves the host once and dials the allowed addresses in
+// turn, so the address that is checked is the one that is connected to. A host
+// name that resolved to an allowed address when the request was checked can
+// resolve to a blocked one by the time it is dialed
+func blockInternalDial(dial func(network, addr string) (net.Conn, error), lookup func(host string) ([]net.IP, error)) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
 		if err != nil {
 			return nil, err
 		}
-		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			if ips, err = lookup(host); err != nil {
+				return nil, err
+			}
+		}
+
+		err = ErrDataSourceAddressBlocked
+		for _, ip := range ips {
+			if IsBlockedDataSourceIP(ip) {
+				continue
+			}
+
+			var conn net.Conn
+			conn, err = dial(network, net.JoinHostPort(ip.String(), port))
+			if err != nil {
+				continue
+			}
+			// the address that was connected to is checked as well
+			if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && IsBlockedDataSourceIP(tcpAddr.IP) {
+				conn.Close()
+				err = ErrDataSourceAddressBlocked
+				continue
+			}
+			return conn, nil
+		}
+		return nil, err
 	}
+}
 
-	ptc.cache[ds.Id] = cachedTransport{
-		Transport: transport,
-		updated:   ds.Updated,
+// LookupDataSourceHost resolves the host of a datasource like its transport
+// does, with the address data_proxy_host_overrides sets for the host or else
+// the system resolver
+func LookupDataSourceHost(host string) ([]net.IP, error) {
+	if ip, ok := setting.DataProxy().HostOverrides[strings.ToLower(host)]; ok {
+		return []net.IP{ip}, nil
 	}
+	return net.LookupIP(host)
+}
 
-	return transport, nil
+// hostOverrideDial connects to the address data_proxy_host_overrides sets for
+// the host instead of resolving it. Through an http outbound proxy the proxy
+// is dialed, it resolves the datasource host itself
+func hostOverrideDial(dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dial(network, addr)
+		}
+		if ip, ok := setting.DataProxy().HostOverrides[strings.ToLower(host)]; ok {
+			addr = net.JoinHostPort(ip.String(), port)
+		}
+		return dial(network, addr)
+	}
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
 }
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"net"
+	"sync"
+)
+
+// OnDataSourceConn is called with 1 when a datasource transport opened a
+// connection to addr and with -1 once it is closed. addr is the first hop, the
+// outbound http proxy for datasources reached through one. The data proxy
+// sets it to follow the connection pools of the transports
+var OnDataSourceConn = func(addr string, delta int64) {}
+
+func countConnsDial(dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		OnDataSourceConn(addr, 1)
+		return &countedConn{Conn: conn, addr: addr}, nil
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	addr string
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { OnDataSourceConn(c.addr, -1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ResolveDataSourceFile returns the path of the file a datasource option
+// names. Datasources are edited by org admins, so they can only name files in
+// the directory the server setting dirSetting sets to dir, relative to it.
+// Symlinks are followed before the path is checked
+func ResolveDataSourceFile(dir string, dirSetting string, name string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("Files can not be used by datasources, %s is not set", dirSetting)
+	}
+
+	base := filepath.Clean(dir)
+	path := filepath.Clean(filepath.Join(base, name))
+	if filepath.IsAbs(name) {
+		path = filepath.Clean(name)
+	}
+	if !isInDirectory(base, path) {
+		return "", fmt.Errorf("File %s is not in %s", name, dirSetting)
+	}
+
+	// a missing file fails when it is read
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		if realBase, err := filepath.EvalSymlinks(base); err == nil && !isInDirectory(realBase, real) {
+			return "", fmt.Errorf("File %s is not in %s", name, dirSetting)
+		}
+	}
+
+	return path, nil
+}
+
+func isInDirectory(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+type proxyProtocolSourceKey struct{}
+
+// WithProxyProtocolSource sets the client address sent in the PROXY protocol
+// header of new connections to datasources that enable proxyProtocol
+func WithProxyProtocolSource(ctx context.Context, addr *net.TCPAddr) context.Context {
+	return context.WithValue(ctx, proxyProtocolSourceKey{}, addr)
+}
+
+func getProxyProtocolSource(ctx context.Context) *net.TCPAddr {
+	addr, _ := ctx.Value(proxyProtocolSourceKey{}).(*net.TCPAddr)
+	return addr
+}
+
+// UsesProxyProtocol reports whether connections to the datasource start with a
+// PROXY protocol v1 header, with the proxyProtocol json data option
+func (ds *DataSource) UsesProxyProtocol() bool {
+	return ds.JsonData != nil && ds.JsonData.Get("proxyProtocol").MustBool(false) && ds.UnixSocketPath() == ""
+}
+
+var errProxyProtocolOutboundProxy = errors.New("The PROXY protocol can not be used through an http data_proxy_outbound_url")
+
+// proxyProtocolDial writes the PROXY protocol header on every new connection,
+// with the client of the request that opened it. The transport does not keep
+// the connections alive, the load balancer would see the client that opened a
+// connection for the requests of other clients
+func proxyProtocolDial(dial func(network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		header := getProxyProtocolHeader(getProxyProtocolSource(ctx), conn.RemoteAddr())
+		if _, err := conn.Write([]byte(header)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// getProxyProtocolHeader returns the v1 header for a connection from source
+// to destination. IPv4 addresses are mapped to IPv6 when the other address is
+// IPv6, unknown addresses send an UNKNOWN header
+func getProxyProtocolHeader(source *net.TCPAddr, destination net.Addr) string {
+	dest, ok := destination.(*net.TCPAddr)
+	if source == nil || source.IP == nil || !ok {
+		return "PROXY UNKNOWN\r\n"
+	}
+
+	family, srcIP, destIP := "TCP4", source.IP.String(), dest.IP.String()
+	if source.IP.To4() == nil || dest.IP.To4() == nil {
+		family, srcIP, destIP = "TCP6", mappedIPv6(source.IP), mappedIPv6(dest.IP)
+	}
+
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, destIP, source.Port, dest.Port)
+}
+
+// mappedIPv6 writes IPv4 addresses as ::ffff:a.b.c.d for TCP6 headers
+func mappedIPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
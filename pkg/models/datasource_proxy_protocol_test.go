@@ -0,0 +1,56 @@
+package models
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	Convey("When writing the PROXY protocol header", t, func() {
+		dest := &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 9090}
+
+		Convey("Should use TCP4 for IPv4 addresses", func() {
+			source := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+			So(getProxyProtocolHeader(source, dest), ShouldEqual, "PROXY TCP4 203.0.113.7 10.0.0.5 51234 9090\r\n")
+		})
+
+		Convey("Should map IPv4 addresses for IPv6 connections", func() {
+			source := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234}
+			So(getProxyProtocolHeader(source, dest), ShouldEqual, "PROXY TCP6 2001:db8::7 ::ffff:10.0.0.5 51234 9090\r\n")
+		})
+
+		Convey("Should send UNKNOWN without a client", func() {
+			So(getProxyProtocolHeader(nil, dest), ShouldEqual, "PROXY UNKNOWN\r\n")
+		})
+	})
+
+	Convey("When dialing a datasource with the PROXY protocol", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		header := make(chan string, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			header <- line
+		}()
+
+		dial := proxyProtocolDial(net.Dial)
+		ctx := WithProxyProtocolSource(context.Background(), &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234})
+		conn, err := dial(ctx, "tcp", listener.Addr().String())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		So(<-header, ShouldEqual, "PROXY TCP4 203.0.113.7 127.0.0.1 51234 "+port+"\r\n")
+	})
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// the cipher suites that can be allowed with tlsCipherSuites, by their IANA
+// names. RC4 suites are left out, they are broken
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+}
+
+// configureTLSVersion applies the tlsMinVersion and tlsCipherSuites json data
+// options, backends that only offer an older version or other suites fail the
+// handshake. Without them the defaults of crypto/tls are used
+func configureTLSVersion(config *tls.Config, jsonData *simplejson.Json) error {
+	if jsonData == nil {
+		return nil
+	}
+
+	if minVersion := jsonData.Get("tlsMinVersion").MustString(); minVersion != "" {
+		version, exists := tlsVersions[minVersion]
+		if !exists {
+			return fmt.Errorf("Invalid tlsMinVersion %q, supported versions are 1.0, 1.1 and 1.2", minVersion)
+		}
+		config.MinVersion = version
+	}
+
+	for _, name := range jsonData.Get("tlsCipherSuites").MustStringArray() {
+		suite, exists := tlsCipherSuites[name]
+		if !exists {
+			return fmt.Errorf("Unsupported cipher suite %q in tlsCipherSuites", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, suite)
+	}
+
+	return nil
+}
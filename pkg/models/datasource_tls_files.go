@@ -0,0 +1,110 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// the secure json data certificates that can be read from a file instead, with
+// the json data option of the same name and a File suffix
+var tlsFileFields = []string{"tlsCACert", "tlsClientCert", "tlsClientKey"}
+
+// ValidateTLSFiles checks the tlsCACertFile, tlsClientCertFile and
+// tlsClientKeyFile json data options of a datasource that is saved, they can
+// only name files in data_proxy_tls_files_path
+func ValidateTLSFiles(jsonData *simplejson.Json) error {
+	if jsonData == nil {
+		return nil
+	}
+
+	for _, field := range tlsFileFields {
+		if name := jsonData.Get(field + "File").MustString(); name != "" {
+			if _, err := resolveTLSFile(name); err != nil {
+				return fmt.Errorf("Invalid %sFile: %v", field, err)
+			}
+		}
+	}
+	return nil
+}
+
+func resolveTLSFile(name string) (string, error) {
+	return ResolveDataSourceFile(setting.DataProxy().TLSFilesPath, "data_proxy_tls_files_path", name)
+}
+
+// getTLSFiles returns the paths of the tlsCACertFile, tlsClientCertFile and
+// tlsClientKeyFile json data options by the certificate they replace. Only the
+// certificates of the enabled tls options are read
+func (ds *DataSource) getTLSFiles() (map[string]string, error) {
+	files := make(map[string]string)
+	if ds.JsonData == nil {
+		return files, nil
+	}
+
+	tlsAuth := ds.JsonData.Get("tlsAuth").MustBool(false)
+	tlsAuthWithCACert := ds.JsonData.Get("tlsAuthWithCACert").MustBool(false)
+	for _, field := range tlsFileFields {
+		enabled := tlsAuth
+		if field == "tlsCACert" {
+			enabled = tlsAuthWithCACert
+		}
+		if !enabled {
+			continue
+		}
+		if name := ds.JsonData.Get(field + "File").MustString(); name != "" {
+			path, err := resolveTLSFile(name)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %sFile: %v", field, err)
+			}
+			files[field] = path
+		}
+	}
+	return files, nil
+}
+
+// getTLSFilesVersion returns the size and modification time of the tls files
+// of the datasource. The cached transports are built again when it changes,
+// rotated certificates are used by the next request without saving the
+// datasource. Files that can not be read fail when the transport is built
+func (ds *DataSource) getTLSFilesVersion() string {
+	files, err := ds.getTLSFiles()
+	if err != nil {
+		return "invalid;"
+	}
+
+	var version bytes.Buffer
+	for _, field := range tlsFileFields {
+		path, ok := files[field]
+		if !ok {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&version, "%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+		} else {
+			fmt.Fprintf(&version, "%s:missing;", path)
+		}
+	}
+	return version.String()
+}
+
+// readTLSFiles replaces the decrypted certificates with the content of their
+// files, the files are kept outside of the database and can be rotated
+func (ds *DataSource) readTLSFiles(decrypted map[string]string) error {
+	files, err := ds.getTLSFiles()
+	if err != nil {
+		return err
+	}
+
+	for field, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Failed to read %sFile: %v", field, err)
+		}
+		decrypted[field] = string(data)
+	}
+	return nil
+}
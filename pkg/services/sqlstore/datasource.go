@@ -5,6 +5,7 @@ import (
 
 	"github.com/grafana/grafana/pkg/bus"
 	"github.com/grafana/grafana/pkg/components/securejsondata"
+	"github.com/grafana/grafana/pkg/events"
 	m "github.com/grafana/grafana/pkg/models"
 
 	"github.com/go-xorm/xorm"
@@ -23,24 +24,32 @@ func GetDataSourceById(query *m.GetDataSourceByIdQuery) error {
 	datasource := m.DataSource{OrgId: query.OrgId, Id: query.Id}
 	has, err := x.Get(&datasource)
 
+	if err != nil {
+		return err
+	}
+
 	if !has {
 		return m.ErrDataSourceNotFound
 	}
 
 	query.Result = &datasource
-	return err
+	return nil
 }
 
 func GetDataSourceByName(query *m.GetDataSourceByNameQuery) error {
 	datasource := m.DataSource{OrgId: query.OrgId, Name: query.Name}
 	has, err := x.Get(&datasource)
 
+	if err != nil {
+		return err
+	}
+
 	if !has {
 		return m.ErrDataSourceNotFound
 	}
 
 	query.Result = &datasource
-	return err
+	return nil
 }
 
 func GetDataSources(query *m.GetDataSourcesQuery) error {
@@ -51,10 +60,19 @@ func GetDataSources(query *m.GetDataSourcesQuery) error {
 }
 
 func DeleteDataSource(cmd *m.DeleteDataSourceCommand) error {
-	return inTransaction(func(sess *xorm.Session) error {
+	return inTransaction2(func(sess *session) error {
 		var rawSql = "DELETE FROM data_source WHERE id=? and org_id=?"
-		_, err := sess.Exec(rawSql, cmd.Id, cmd.OrgId)
-		return err
+		if _, err := sess.Exec(rawSql, cmd.Id, cmd.OrgId); err != nil {
+			return err
+		}
+
+		sess.publishAfterCommit(&events.DataSourceDeleted{
+			Timestamp: time.Now(),
+			Id:        cmd.Id,
+			OrgId:     cmd.OrgId,
+		})
+
+		return nil
 	})
 }
 
@@ -113,7 +131,7 @@ func updateIsDefaultFlag(ds *m.DataSource, sess *xorm.Session) error {
 
 func UpdateDataSource(cmd *m.UpdateDataSourceCommand) error {
 
-	return inTransaction(func(sess *xorm.Session) error {
+	return inTransaction2(func(sess *session) error {
 		ds := &m.DataSource{
 			Id:                cmd.Id,
 			OrgId:             cmd.OrgId,
@@ -143,7 +161,17 @@ func UpdateDataSource(cmd *m.UpdateDataSourceCommand) error {
 			return err
 		}
 
-		err = updateIsDefaultFlag(ds, sess)
-		return err
+		if err := updateIsDefaultFlag(ds, sess.Session); err != nil {
+			return err
+		}
+
+		sess.publishAfterCommit(&events.DataSourceUpdated{
+			Timestamp: ds.Updated,
+			Id:        ds.Id,
+			OrgId:     ds.OrgId,
+			Name:      ds.Name,
+		})
+
+		return nil
 	})
 }
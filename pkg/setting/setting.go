@@ -6,13 +6,16 @@ package setting
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/go-macaron/session"
 	"gopkg.in/ini.v1"
@@ -77,6 +80,7 @@ var (
 	DisableGravatar       bool
 	EmailCodeValidMinutes int
 	DataProxyWhiteList    map[string]bool
+	DataProxyWhiteListNet []*net.IPNet
 
 	// Snapshots
 	ExternalSnapshotUrl   string
@@ -529,10 +533,20 @@ func NewConfigContext(args *CommandLineArgs) error {
 
 	//  read data source proxy white list
 	DataProxyWhiteList = make(map[string]bool)
+	DataProxyWhiteListNet = make([]*net.IPNet, 0)
 	for _, hostAndIp := range security.Key("data_source_proxy_whitelist").Strings(" ") {
 		DataProxyWhiteList[hostAndIp] = true
+		if strings.Contains(hostAndIp, "/") && !strings.HasPrefix(hostAndIp, "unix://") {
+			_, ipNet, err := net.ParseCIDR(hostAndIp)
+			if err != nil {
+				log.Fatal(3, "Invalid CIDR in data_source_proxy_whitelist: %s", hostAndIp)
+			}
+			DataProxyWhiteListNet = append(DataProxyWhiteListNet, ipNet)
+		}
 	}
 
+	readDataProxySettings(Cfg.Section("dataproxy"))
+
 	// admin
 	AdminUser = security.Key("admin_user").String()
 	AdminPassword = security.Key("admin_password").String()
@@ -610,6 +624,211 @@ func NewConfigContext(args *CommandLineArgs) error {
 	return nil
 }
 
+// DataProxySettings are the settings of the [dataproxy] section. A reload on
+// SIGHUP stores new settings instead of changing the ones requests are reading
+type DataProxySettings struct {
+	Timeout               int
+	MaxRetries            int
+	DialTimeout           int
+	KeepAlive             int
+	TLSHandshakeTimeout   int
+	OutboundUrl           string
+	OutboundUser          string
+	OutboundPassword      string
+	DataSourceCacheTTL    int
+	FlushInterval         int
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       int
+	BackendStatusHeader   bool
+	MaxRequestBody        int64
+	ResponseCacheTTL      int
+	ResponseCacheETag     bool
+	BlockInternalIps      bool
+	AllowLoopback         bool
+	ResponseHeaderTimeout int
+	DebugLogging          bool
+	AllowedTypes          map[string]bool
+	DisabledOrgs          map[int64]bool
+	StripResponseHeaders  []string
+	BreakerFailures       int
+	BreakerWindow         int
+	BreakerCooldown       int
+	RetryAfterMax         int
+	MaxConcurrent         int
+	MaxRequestHeaderBytes int
+	HostOverrides         map[string]net.IP
+	TLSVerify             bool
+	TLSFilesPath          string
+	KerberosKeytabsPath   string
+	TrustedProxies        []*net.IPNet
+	ViewerMethods         map[string]bool
+}
+
+var dataProxySettings atomic.Value
+
+func init() {
+	dataProxySettings.Store(&DataProxySettings{
+		DialTimeout:         30,
+		KeepAlive:           30,
+		TLSHandshakeTimeout: 10,
+		DataSourceCacheTTL:  5,
+		FlushInterval:       200,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90,
+		MaxRequestBody:      10485760,
+		ViewerMethods:       map[string]bool{"GET": true, "HEAD": true, "POST": true},
+	})
+}
+
+// DataProxy returns the current [dataproxy] settings. Only tests change them,
+// they are replaced as a whole when the settings are read
+func DataProxy() *DataProxySettings {
+	return dataProxySettings.Load().(*DataProxySettings)
+}
+
+func readDataProxySettings(dataproxy *ini.Section) {
+	cfg := &DataProxySettings{}
+	cfg.Timeout = dataproxy.Key("data_proxy_timeout").MustInt(0)
+	cfg.MaxRetries = dataproxy.Key("data_proxy_max_retries").MustInt(0)
+	cfg.DialTimeout = dataproxy.Key("data_proxy_dial_timeout").MustInt(30)
+	cfg.KeepAlive = dataproxy.Key("data_proxy_keepalive").MustInt(30)
+	cfg.TLSHandshakeTimeout = dataproxy.Key("data_proxy_tls_handshake_timeout").MustInt(10)
+	cfg.OutboundUrl = dataproxy.Key("data_proxy_outbound_url").String()
+	cfg.OutboundUser = dataproxy.Key("data_proxy_outbound_user").String()
+	cfg.OutboundPassword = dataproxy.Key("data_proxy_outbound_password").String()
+	cfg.DataSourceCacheTTL = dataproxy.Key("data_proxy_datasource_cache_ttl").MustInt(5)
+	cfg.FlushInterval = dataproxy.Key("data_proxy_flush_interval").MustInt(200)
+	cfg.MaxIdleConns = dataproxy.Key("data_proxy_max_idle_conns").MustInt(100)
+	cfg.MaxIdleConnsPerHost = dataproxy.Key("data_proxy_max_idle_conns_per_host").MustInt(2)
+	cfg.IdleConnTimeout = dataproxy.Key("data_proxy_idle_conn_timeout").MustInt(90)
+	cfg.BackendStatusHeader = dataproxy.Key("data_proxy_backend_status_header").MustBool(false)
+	cfg.MaxRequestBody = dataproxy.Key("data_proxy_max_request_body").MustInt64(10485760)
+	cfg.ResponseCacheTTL = dataproxy.Key("data_proxy_response_cache_ttl").MustInt(0)
+	cfg.ResponseCacheETag = dataproxy.Key("data_proxy_response_cache_etag").MustBool(false)
+	cfg.BlockInternalIps = dataproxy.Key("data_proxy_block_internal_ips").MustBool(false)
+	if cfg.BlockInternalIps && cfg.OutboundUrl == "" {
+		for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+			if os.Getenv(name) != "" {
+				log.Warn("Data proxy: %s is not used while data_proxy_block_internal_ips is enabled, set data_proxy_outbound_url instead", name)
+				break
+			}
+		}
+	}
+	cfg.AllowLoopback = dataproxy.Key("data_proxy_allow_loopback").MustBool(false)
+	cfg.ResponseHeaderTimeout = dataproxy.Key("data_proxy_response_header_timeout").MustInt(0)
+	cfg.DebugLogging = dataproxy.Key("data_proxy_debug_logging").MustBool(false)
+	cfg.TLSVerify = dataproxy.Key("data_proxy_tls_verify").MustBool(false)
+	cfg.TLSFilesPath = dataproxy.Key("data_proxy_tls_files_path").String()
+	cfg.KerberosKeytabsPath = dataproxy.Key("data_proxy_kerberos_keytabs_path").String()
+	cfg.AllowedTypes = make(map[string]bool)
+	for _, dsType := range strings.Fields(dataproxy.Key("data_proxy_allowed_types").String()) {
+		cfg.AllowedTypes[dsType] = true
+	}
+	cfg.DisabledOrgs = make(map[int64]bool)
+	for _, orgId := range strings.Fields(dataproxy.Key("data_proxy_disabled_orgs").String()) {
+		id, err := strconv.ParseInt(orgId, 10, 64)
+		if err != nil {
+			log.Warn("Invalid org id in data_proxy_disabled_orgs: %s", orgId)
+			continue
+		}
+		cfg.DisabledOrgs[id] = true
+	}
+	cfg.HostOverrides = make(map[string]net.IP)
+	for _, override := range strings.Fields(dataproxy.Key("data_proxy_host_overrides").String()) {
+		parts := strings.SplitN(override, "=", 2)
+		var ip net.IP
+		if len(parts) == 2 {
+			ip = net.ParseIP(strings.Trim(parts[1], "[]"))
+		}
+		if ip == nil {
+			log.Warn("Invalid host override in data_proxy_host_overrides, expected host=ip: %s", override)
+			continue
+		}
+		cfg.HostOverrides[strings.ToLower(parts[0])] = ip
+	}
+	cfg.TrustedProxies = nil
+	for _, proxy := range strings.Fields(dataproxy.Key("data_proxy_trusted_proxies").String()) {
+		cidr := proxy
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Warn("Invalid proxy in data_proxy_trusted_proxies, expected an ip or cidr range: %s", proxy)
+			continue
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, network)
+	}
+	cfg.StripResponseHeaders = strings.Fields(dataproxy.Key("data_proxy_strip_response_headers").String())
+	cfg.BreakerFailures = dataproxy.Key("data_proxy_breaker_failures").MustInt(0)
+	cfg.BreakerWindow = dataproxy.Key("data_proxy_breaker_window").MustInt(60)
+	cfg.BreakerCooldown = dataproxy.Key("data_proxy_breaker_cooldown").MustInt(30)
+	cfg.RetryAfterMax = dataproxy.Key("data_proxy_retry_after_max").MustInt(300)
+	cfg.MaxConcurrent = dataproxy.Key("data_proxy_max_concurrent").MustInt(0)
+	cfg.MaxRequestHeaderBytes = dataproxy.Key("data_proxy_max_request_header_bytes").MustInt(0)
+	cfg.ViewerMethods = make(map[string]bool)
+	for _, method := range strings.Fields(dataproxy.Key("data_proxy_viewer_methods").MustString("GET HEAD POST")) {
+		cfg.ViewerMethods[strings.ToUpper(method)] = true
+	}
+
+	dataProxySettings.Store(cfg)
+}
+
+// ReloadDataProxySettings reads the [dataproxy] section of the config files,
+// environment and command line again. The other sections are only read at
+// startup
+func ReloadDataProxySettings(args *CommandLineArgs) error {
+	defaults, err := ini.Load(path.Join(HomePath, "conf/defaults.ini"))
+	if err != nil {
+		return fmt.Errorf("Failed to parse defaults.ini, %v", err)
+	}
+	defaults.BlockMode = false
+
+	dataproxy := defaults.Section("dataproxy")
+	props := getCommandLineProperties(args.Args)
+	for _, key := range dataproxy.Keys() {
+		if value, exists := props["default.dataproxy."+key.Name()]; exists {
+			key.SetValue(value)
+		}
+	}
+
+	configFile := args.Config
+	if configFile == "" {
+		configFile = filepath.Join(HomePath, CustomInitPath)
+	}
+	if args.Config != "" || pathExists(configFile) {
+		userConfig, err := ini.Load(configFile)
+		if err != nil {
+			return fmt.Errorf("Failed to parse %v, %v", configFile, err)
+		}
+		for _, key := range userConfig.Section("dataproxy").Keys() {
+			if key.Value() != "" {
+				dataproxy.Key(key.Name()).SetValue(key.Value())
+			}
+		}
+	}
+
+	for _, key := range dataproxy.Keys() {
+		envKey := "GF_DATAPROXY_" + strings.ToUpper(strings.Replace(key.Name(), ".", "_", -1))
+		if envValue := os.Getenv(envKey); len(envValue) > 0 {
+			key.SetValue(envValue)
+		}
+		if value, exists := props["dataproxy."+key.Name()]; exists {
+			key.SetValue(value)
+		}
+		key.SetValue(evalEnvVarExpression(key.Value()))
+	}
+
+	readDataProxySettings(dataproxy)
+	return nil
+}
+
 func readSessionConfig() {
 	sec := Cfg.Section("session")
 	SessionOptions = session.Options{}
@@ -667,4 +886,5 @@ func LogConfigurationInfo() {
 	logger.Info("Path Data", "path", DataPath)
 	logger.Info("Path Logs", "path", LogsPath)
 	logger.Info("Path Plugins", "path", PluginsPath)
+	logger.Info("Data proxy connection pool", "maxIdleConns", DataProxy().MaxIdleConns, "maxIdleConnsPerHost", DataProxy().MaxIdleConnsPerHost, "idleConnTimeout", DataProxy().IdleConnTimeout)
 }
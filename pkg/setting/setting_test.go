@@ -18,6 +18,11 @@ func TestLoadingSettings(t *testing.T) {
 			So(err, ShouldBeNil)
 
 			So(AdminUser, ShouldEqual, "admin")
+			So(DataProxy().DialTimeout, ShouldEqual, 30)
+			So(DataProxy().TLSHandshakeTimeout, ShouldEqual, 10)
+			So(DataProxy().MaxIdleConns, ShouldEqual, 100)
+			So(DataProxy().MaxIdleConnsPerHost, ShouldEqual, 2)
+			So(DataProxy().IdleConnTimeout, ShouldEqual, 90)
 		})
 
 		Convey("Should be able to override via environment variables", func() {
@@ -112,5 +117,35 @@ func TestLoadingSettings(t *testing.T) {
 			So(InstanceName, ShouldEqual, hostname)
 		})
 
+		Convey("Should reload the data proxy settings", func() {
+			NewConfigContext(&CommandLineArgs{HomePath: "../../"})
+			So(DataProxy().DialTimeout, ShouldEqual, 30)
+
+			os.Setenv("GF_DATAPROXY_DATA_PROXY_TLS_HANDSHAKE_TIMEOUT", "5")
+			defer os.Unsetenv("GF_DATAPROXY_DATA_PROXY_TLS_HANDSHAKE_TIMEOUT")
+
+			err := ReloadDataProxySettings(&CommandLineArgs{
+				HomePath: "../../",
+				Args:     []string{"cfg:dataproxy.data_proxy_dial_timeout=10", "cfg:paths.data=/tmp/reloaded"},
+			})
+			So(err, ShouldBeNil)
+
+			So(DataProxy().DialTimeout, ShouldEqual, 10)
+			So(DataProxy().TLSHandshakeTimeout, ShouldEqual, 5)
+			So(DataPath, ShouldNotEqual, "/tmp/reloaded")
+		})
+
+		Convey("Should read the host overrides of the data proxy", func() {
+			os.Setenv("GF_DATAPROXY_DATA_PROXY_HOST_OVERRIDES", "Prometheus.Internal=10.0.0.5 influxdb.internal=[fd00::12] invalid")
+			defer os.Unsetenv("GF_DATAPROXY_DATA_PROXY_HOST_OVERRIDES")
+
+			err := ReloadDataProxySettings(&CommandLineArgs{HomePath: "../../"})
+			So(err, ShouldBeNil)
+
+			So(DataProxy().HostOverrides, ShouldHaveLength, 2)
+			So(DataProxy().HostOverrides["prometheus.internal"].String(), ShouldEqual, "10.0.0.5")
+			So(DataProxy().HostOverrides["influxdb.internal"].String(), ShouldEqual, "fd00::12")
+		})
+
 	})
 }
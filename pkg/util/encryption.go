@@ -28,12 +28,13 @@ func Decrypt(payload []byte, secret string) []byte {
 	}
 	iv := payload[saltLength : saltLength+aes.BlockSize]
 	payload = payload[saltLength+aes.BlockSize:]
+	plaintext := make([]byte, len(payload))
 
 	stream := cipher.NewCFBDecrypter(block, iv)
 
-	// XORKeyStream can work in-place if the two arguments are the same.
-	stream.XORKeyStream(payload, payload)
-	return payload
+	// decrypt into a new buffer so the encrypted payload can be decrypted again
+	stream.XORKeyStream(plaintext, payload)
+	return plaintext
 }
 
 func Encrypt(payload []byte, secret string) []byte {
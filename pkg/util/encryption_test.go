@@ -24,4 +24,12 @@ func TestEncryption(t *testing.T) {
 		So(string(decrypted), ShouldEqual, "grafana")
 	})
 
+	Convey("When decrypting the same payload twice", t, func() {
+		encrypted := Encrypt([]byte("grafana"), "1234")
+		Decrypt(encrypted, "1234")
+		decrypted := Decrypt(encrypted, "1234")
+
+		So(string(decrypted), ShouldEqual, "grafana")
+	})
+
 }